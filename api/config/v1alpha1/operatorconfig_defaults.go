@@ -0,0 +1,155 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"net"
+	"path"
+
+	"k8s.io/apimachinery/pkg/util/validation"
+	cfg "sigs.k8s.io/controller-runtime/pkg/config/v1alpha1"
+)
+
+const (
+	DefaultInitContainerImage      = "k8s.gcr.io/busybox"
+	DefaultInitContainerVolumeName = "podexternalip-podinfo"
+	DefaultInitContainerMountPath  = "/etc/podexternalip"
+	DefaultProvider                = "azurecni"
+	DefaultTraceExporter           = "none"
+)
+
+// Complete implements config.ControllerManagerConfiguration, it defaults and
+// validates the configuration once it is loaded.
+func (c *OperatorConfig) Complete() (cfg.ControllerManagerConfigurationSpec, error) {
+	c.Default()
+	if err := c.Validate(); err != nil {
+		return cfg.ControllerManagerConfigurationSpec{}, err
+	}
+	return c.ControllerManagerConfigurationSpec, nil
+}
+
+// Default sets the default values of the unset fields.
+func (c *OperatorConfig) Default() {
+	if c.Provider.Name == "" {
+		c.Provider.Name = DefaultProvider
+	}
+	if c.InjectionMode == "" {
+		c.InjectionMode = InjectionModeInitContainer
+	}
+	if c.Tracing.Exporter == "" {
+		c.Tracing.Exporter = DefaultTraceExporter
+	}
+
+	ic := &c.InitContainer
+	if ic.Image == "" {
+		ic.Image = DefaultInitContainerImage
+	}
+	if ic.VolumeName == "" {
+		ic.VolumeName = DefaultInitContainerVolumeName
+	}
+	if ic.MountPath == "" {
+		ic.MountPath = DefaultInitContainerMountPath
+	}
+	if ic.FailurePolicy == "" {
+		ic.FailurePolicy = FailurePolicyFail
+	}
+}
+
+// Validate returns an error describing the invalid fields, if any. The
+// configs of the providers are validated by the providers, and the trace
+// exporter by the tracing setup.
+func (c *OperatorConfig) Validate() error {
+	names := map[string]bool{c.Provider.Name: true}
+	for i, p := range c.Providers {
+		if p.Name == "" {
+			return fmt.Errorf("providers[%d].name must be set", i)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("providers[%d].name %q is configured more than once", i, p.Name)
+		}
+		names[p.Name] = true
+	}
+
+	r := c.Retry
+	if r.IPInUseBackoff.Duration < 0 {
+		return fmt.Errorf("retry.ipInUseBackoff %v must not be negative", r.IPInUseBackoff.Duration)
+	}
+	if r.IPInUseMaxBackoff.Duration < 0 {
+		return fmt.Errorf("retry.ipInUseMaxBackoff %v must not be negative", r.IPInUseMaxBackoff.Duration)
+	}
+	if r.IPInUseMaxBackoff.Duration > 0 && r.IPInUseMaxBackoff.Duration < r.IPInUseBackoff.Duration {
+		return fmt.Errorf("retry.ipInUseMaxBackoff %v must not be less than retry.ipInUseBackoff %v", r.IPInUseMaxBackoff.Duration, r.IPInUseBackoff.Duration)
+	}
+	if r.IPInUseRetryBudget != nil && *r.IPInUseRetryBudget < 0 {
+		return fmt.Errorf("retry.ipInUseRetryBudget %d must not be negative", *r.IPInUseRetryBudget)
+	}
+
+	for _, network := range c.LocalNetworks {
+		if !isNetwork(network) {
+			return fmt.Errorf("localNetworks %q must be an IP address or a CIDR", network)
+		}
+	}
+	for _, network := range c.ServiceCIDRs {
+		if !isNetwork(network) {
+			return fmt.Errorf("serviceCIDRs %q must be an IP address or a CIDR", network)
+		}
+	}
+
+	if c.InjectionMode != InjectionModeInitContainer && c.InjectionMode != InjectionModeReadinessGate {
+		return fmt.Errorf("injectionMode %q must be %s or %s", c.InjectionMode, InjectionModeInitContainer, InjectionModeReadinessGate)
+	}
+
+	if c.Intervals.LocalNetworksResync.Duration < 0 {
+		return fmt.Errorf("intervals.localNetworksResync %v must not be negative", c.Intervals.LocalNetworksResync.Duration)
+	}
+	if c.Intervals.NodeMachineCheck.Duration < 0 {
+		return fmt.Errorf("intervals.nodeMachineCheck %v must not be negative", c.Intervals.NodeMachineCheck.Duration)
+	}
+	if c.Intervals.HolderCheck.Duration < 0 {
+		return fmt.Errorf("intervals.holderCheck %v must not be negative", c.Intervals.HolderCheck.Duration)
+	}
+
+	ic := c.InitContainer
+	if errs := validation.IsDNS1123Label(ic.VolumeName); len(errs) > 0 {
+		return fmt.Errorf("initContainer.volumeName %q is invalid: %v", ic.VolumeName, errs)
+	}
+	if !path.IsAbs(ic.MountPath) {
+		return fmt.Errorf("initContainer.mountPath %q must be an absolute path", ic.MountPath)
+	}
+	if ic.Timeout.Duration < 0 {
+		return fmt.Errorf("initContainer.timeout %v must not be negative", ic.Timeout.Duration)
+	}
+	if ic.FailurePolicy != FailurePolicyIgnore && ic.FailurePolicy != FailurePolicyFail {
+		return fmt.Errorf("initContainer.failurePolicy %q must be %s or %s", ic.FailurePolicy, FailurePolicyIgnore, FailurePolicyFail)
+	}
+	for name, limit := range ic.Resources.Limits {
+		if request, ok := ic.Resources.Requests[name]; ok && request.Cmp(limit) > 0 {
+			return fmt.Errorf("initContainer.resources request %s of %s exceeds its limit %s", request.String(), name, limit.String())
+		}
+	}
+	return nil
+}
+
+// isNetwork tells whether s is an IP address or a CIDR.
+func isNetwork(s string) bool {
+	if net.ParseIP(s) != nil {
+		return true
+	}
+	_, _, err := net.ParseCIDR(s)
+	return err == nil
+}
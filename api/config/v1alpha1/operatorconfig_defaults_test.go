@@ -0,0 +1,233 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestDefault(t *testing.T) {
+	var c OperatorConfig
+	c.Default()
+	if c.Provider.Name != DefaultProvider || c.InjectionMode != InjectionModeInitContainer || c.Tracing.Exporter != DefaultTraceExporter {
+		t.Errorf("Default() = provider %q, injection mode %q, trace exporter %q", c.Provider.Name, c.InjectionMode, c.Tracing.Exporter)
+	}
+	ic := c.InitContainer
+	if ic.Image != DefaultInitContainerImage || ic.VolumeName != DefaultInitContainerVolumeName || ic.MountPath != DefaultInitContainerMountPath || ic.FailurePolicy != FailurePolicyFail {
+		t.Errorf("Default() = init container %+v", ic)
+	}
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate() of the defaults = %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	duration := func(d time.Duration) metav1.Duration { return metav1.Duration{Duration: d} }
+	budget := int32(-1)
+	tests := []struct {
+		name    string
+		change  func(c *OperatorConfig)
+		wantErr string
+	}{
+		{
+			name:   "defaults",
+			change: func(c *OperatorConfig) {},
+		},
+		{
+			name: "other providers",
+			change: func(c *OperatorConfig) {
+				c.Providers = []ProviderConfig{{Name: "fake"}, {Name: "other"}}
+			},
+		},
+		{
+			name: "provider without name",
+			change: func(c *OperatorConfig) {
+				c.Providers = []ProviderConfig{{Name: "fake"}, {}}
+			},
+			wantErr: "providers[1].name must be set",
+		},
+		{
+			name: "default provider configured again",
+			change: func(c *OperatorConfig) {
+				c.Providers = []ProviderConfig{{Name: DefaultProvider}}
+			},
+			wantErr: `providers[0].name "azurecni" is configured more than once`,
+		},
+		{
+			name: "retries",
+			change: func(c *OperatorConfig) {
+				c.Retry = RetryConfig{IPInUseBackoff: duration(time.Second), IPInUseMaxBackoff: duration(time.Minute)}
+			},
+		},
+		{
+			name: "negative backoff",
+			change: func(c *OperatorConfig) {
+				c.Retry.IPInUseBackoff = duration(-time.Second)
+			},
+			wantErr: "retry.ipInUseBackoff -1s must not be negative",
+		},
+		{
+			name: "negative max backoff",
+			change: func(c *OperatorConfig) {
+				c.Retry.IPInUseMaxBackoff = duration(-time.Second)
+			},
+			wantErr: "retry.ipInUseMaxBackoff -1s must not be negative",
+		},
+		{
+			name: "max backoff less than the backoff",
+			change: func(c *OperatorConfig) {
+				c.Retry = RetryConfig{IPInUseBackoff: duration(time.Minute), IPInUseMaxBackoff: duration(time.Second)}
+			},
+			wantErr: "retry.ipInUseMaxBackoff 1s must not be less than retry.ipInUseBackoff 1m0s",
+		},
+		{
+			name: "negative retry budget",
+			change: func(c *OperatorConfig) {
+				c.Retry.IPInUseRetryBudget = &budget
+			},
+			wantErr: "retry.ipInUseRetryBudget -1 must not be negative",
+		},
+		{
+			name: "local networks",
+			change: func(c *OperatorConfig) {
+				c.LocalNetworks = []string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"}
+				c.ServiceCIDRs = []string{"10.96.0.0/12"}
+			},
+		},
+		{
+			name: "invalid local network",
+			change: func(c *OperatorConfig) {
+				c.LocalNetworks = []string{"10.0.0.0/33"}
+			},
+			wantErr: `localNetworks "10.0.0.0/33" must be an IP address or a CIDR`,
+		},
+		{
+			name: "invalid service CIDR",
+			change: func(c *OperatorConfig) {
+				c.ServiceCIDRs = []string{"services"}
+			},
+			wantErr: `serviceCIDRs "services" must be an IP address or a CIDR`,
+		},
+		{
+			name: "readiness gate",
+			change: func(c *OperatorConfig) {
+				c.InjectionMode = InjectionModeReadinessGate
+			},
+		},
+		{
+			name: "unknown injection mode",
+			change: func(c *OperatorConfig) {
+				c.InjectionMode = "sidecar"
+			},
+			wantErr: `injectionMode "sidecar" must be init-container or readiness-gate`,
+		},
+		{
+			name: "negative local networks resync",
+			change: func(c *OperatorConfig) {
+				c.Intervals.LocalNetworksResync = duration(-time.Minute)
+			},
+			wantErr: "intervals.localNetworksResync -1m0s must not be negative",
+		},
+		{
+			name: "negative node machine check",
+			change: func(c *OperatorConfig) {
+				c.Intervals.NodeMachineCheck = duration(-time.Minute)
+			},
+			wantErr: "intervals.nodeMachineCheck -1m0s must not be negative",
+		},
+		{
+			name: "negative holder check",
+			change: func(c *OperatorConfig) {
+				c.Intervals.HolderCheck = duration(-time.Minute)
+			},
+			wantErr: "intervals.holderCheck -1m0s must not be negative",
+		},
+		{
+			name: "negative egress drift check",
+			change: func(c *OperatorConfig) {
+				c.Intervals.EgressDriftCheck = duration(-time.Second)
+			},
+		},
+		{
+			name: "invalid volume name",
+			change: func(c *OperatorConfig) {
+				c.InitContainer.VolumeName = "Pod_Info"
+			},
+			wantErr: `initContainer.volumeName "Pod_Info" is invalid`,
+		},
+		{
+			name: "relative mount path",
+			change: func(c *OperatorConfig) {
+				c.InitContainer.MountPath = "etc/podexternalip"
+			},
+			wantErr: `initContainer.mountPath "etc/podexternalip" must be an absolute path`,
+		},
+		{
+			name: "negative timeout",
+			change: func(c *OperatorConfig) {
+				c.InitContainer.Timeout = duration(-time.Second)
+			},
+			wantErr: "initContainer.timeout -1s must not be negative",
+		},
+		{
+			name: "unknown failure policy",
+			change: func(c *OperatorConfig) {
+				c.InitContainer.FailurePolicy = "Retry"
+			},
+			wantErr: `initContainer.failurePolicy "Retry" must be Ignore or Fail`,
+		},
+		{
+			name: "resources",
+			change: func(c *OperatorConfig) {
+				c.InitContainer.Resources = corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("10m")},
+					Limits:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")},
+				}
+			},
+		},
+		{
+			name: "request over the limit",
+			change: func(c *OperatorConfig) {
+				c.InitContainer.Resources = corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("64Mi")},
+					Limits:   corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("32Mi")},
+				}
+			},
+			wantErr: "initContainer.resources request 64Mi of memory exceeds its limit 32Mi",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c OperatorConfig
+			c.Default()
+			tt.change(&c)
+			err := c.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("Validate() = %v, want nil", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("Validate() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
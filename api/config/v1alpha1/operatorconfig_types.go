@@ -0,0 +1,194 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	cfg "sigs.k8s.io/controller-runtime/pkg/config/v1alpha1"
+)
+
+// FailurePolicy is what the injected init container does when the pod is not
+// associated with its external IP in time.
+type FailurePolicy string
+
+const (
+	// FailurePolicyIgnore lets the pod start without its external IP.
+	FailurePolicyIgnore FailurePolicy = "Ignore"
+	// FailurePolicyFail fails the init container, so the pod does not start.
+	FailurePolicyFail FailurePolicy = "Fail"
+)
+
+// InitContainerConfig is the template of the init container the pod webhook
+// injects to hold pods until they are associated with their external IP.
+type InitContainerConfig struct {
+	// Image runs the sh, grep and date commands of the wait script.
+	Image string `json:"image,omitempty"`
+
+	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy,omitempty"`
+
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	SecurityContext *corev1.SecurityContext `json:"securityContext,omitempty"`
+
+	// VolumeName is the name of the downward API volume holding the pod
+	// annotations. It must not be used by the pods.
+	VolumeName string `json:"volumeName,omitempty"`
+
+	// MountPath is where the volume is mounted in the init container.
+	MountPath string `json:"mountPath,omitempty"`
+
+	// Timeout is how long the init container waits for the association. Zero
+	// waits forever.
+	Timeout metav1.Duration `json:"timeout,omitempty"`
+
+	// FailurePolicy is applied when the timeout expires, Ignore or Fail.
+	FailurePolicy FailurePolicy `json:"failurePolicy,omitempty"`
+}
+
+const (
+	// InjectionModeInitContainer holds the pods in an init container until
+	// they are associated with their external IP.
+	InjectionModeInitContainer = "init-container"
+	// InjectionModeReadinessGate adds a readiness gate on the association
+	// condition of the pods.
+	InjectionModeReadinessGate = "readiness-gate"
+)
+
+// ProviderConfig selects a provider and configures it.
+type ProviderConfig struct {
+	// Name is the name the provider is registered with, e.g. azurecni.
+	Name string `json:"name,omitempty"`
+
+	// Config is the config of the provider, decoded into the typed config
+	// of the provider package, e.g. azurecni.Config. The defaults of the
+	// provider are used when it is empty.
+	Config runtime.RawExtension `json:"config,omitempty"`
+}
+
+// RetryConfig is how the daemon retries to associate the external IPs that
+// are in use. Zero durations use the defaults.
+type RetryConfig struct {
+	// IPInUseBackoff is the delay before the first retry, 5s by default. It
+	// doubles on each retry.
+	IPInUseBackoff metav1.Duration `json:"ipInUseBackoff,omitempty"`
+
+	// IPInUseMaxBackoff caps the delay between the retries, 5m by default.
+	IPInUseMaxBackoff metav1.Duration `json:"ipInUseMaxBackoff,omitempty"`
+
+	// IPInUseRetryBudget is the number of retries after which the pod is
+	// marked Stuck, 10 by default, 0 to never mark it.
+	IPInUseRetryBudget *int32 `json:"ipInUseRetryBudget,omitempty"`
+
+	// HandoffNodeNotReadyTimeout is how long the node of the pod holding an
+	// external IP may be NotReady before the daemon detaches the IP for
+	// another pod, 2m by default. Negative to never detach it.
+	HandoffNodeNotReadyTimeout metav1.Duration `json:"handoffNodeNotReadyTimeout,omitempty"`
+}
+
+// IntervalsConfig is how often the periodic checks run. Zero durations use
+// the defaults.
+type IntervalsConfig struct {
+	// LocalNetworksResync is how often the daemon updates the local networks
+	// with the pod CIDRs of the nodes, 5m by default.
+	LocalNetworksResync metav1.Duration `json:"localNetworksResync,omitempty"`
+
+	// NodeMachineCheck is how often the controller checks whether the
+	// machine of a NotReady node still exists, 1m by default.
+	NodeMachineCheck metav1.Duration `json:"nodeMachineCheck,omitempty"`
+
+	// EgressDriftCheck is how often the daemon repairs the egress rules of
+	// its node, 30s by default. Negative to never repair them, the readiness
+	// probe still checks them.
+	EgressDriftCheck metav1.Duration `json:"egressDriftCheck,omitempty"`
+
+	// HolderCheck is how often the daemon checks that the external IPs of
+	// its associated pods are still attached to them, 5m by default.
+	HolderCheck metav1.Duration `json:"holderCheck,omitempty"`
+}
+
+// TracingConfig is where the traces are exported.
+type TracingConfig struct {
+	// Exporter is none, otlp or stdout.
+	Exporter string `json:"exporter,omitempty"`
+
+	// Endpoint is the host:port of the OTLP/HTTP collector.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// Insecure disables TLS to the OTLP collector.
+	Insecure bool `json:"insecure,omitempty"`
+
+	// File is the file the stdout exporter writes to instead of stdout.
+	File string `json:"file,omitempty"`
+}
+
+// DebugConfig enables the debug endpoints of the daemon.
+type DebugConfig struct {
+	// Endpoints serves /debug/state and /debug/resync on the metrics server.
+	Endpoints bool `json:"endpoints,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// OperatorConfig is the Schema for the operator configuration file
+type OperatorConfig struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// ControllerManagerConfigurationSpec returns the configurations for controllers
+	cfg.ControllerManagerConfigurationSpec `json:",inline"`
+
+	// Provider is the default provider, which provides the external IPs
+	// that no PodExternalIP or ExternalIPPolicy assigns to another provider.
+	Provider ProviderConfig `json:"provider,omitempty"`
+
+	// Providers are the other providers the PodExternalIPs and the
+	// ExternalIPPolicies may select by name.
+	Providers []ProviderConfig `json:"providers,omitempty"`
+
+	// Retry is how the daemon retries the external IPs that are in use.
+	Retry RetryConfig `json:"retry,omitempty"`
+
+	// LocalNetworks are the networks, besides the ones the daemon discovers,
+	// that are not SNATed to the external IPs. The LOCAL_NETWORKS env var
+	// overrides them.
+	LocalNetworks []string `json:"localNetworks,omitempty"`
+
+	// ServiceCIDRs are the service networks of the cluster, which cannot be
+	// read from the API server. The SERVICE_CIDRS env var overrides them.
+	ServiceCIDRs []string `json:"serviceCIDRs,omitempty"`
+
+	// InjectionMode is how the pod webhook makes the pods wait for their
+	// external IP, init-container or readiness-gate.
+	InjectionMode string `json:"injectionMode,omitempty"`
+
+	// InitContainer is the template of the injected init container.
+	InitContainer InitContainerConfig `json:"initContainer,omitempty"`
+
+	// Intervals are the periods of the periodic checks.
+	Intervals IntervalsConfig `json:"intervals,omitempty"`
+
+	// Tracing is where the traces are exported.
+	Tracing TracingConfig `json:"tracing,omitempty"`
+
+	// Debug enables the debug endpoints of the daemon.
+	Debug DebugConfig `json:"debug,omitempty"`
+}
+
+func init() {
+	SchemeBuilder.Register(&OperatorConfig{})
+}
@@ -0,0 +1,185 @@
+//go:build !ignore_autogenerated
+// +build !ignore_autogenerated
+
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Code generated by controller-gen. DO NOT EDIT.
+
+package v1alpha1
+
+import (
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DebugConfig) DeepCopyInto(out *DebugConfig) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DebugConfig.
+func (in *DebugConfig) DeepCopy() *DebugConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(DebugConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *InitContainerConfig) DeepCopyInto(out *InitContainerConfig) {
+	*out = *in
+	in.Resources.DeepCopyInto(&out.Resources)
+	if in.SecurityContext != nil {
+		in, out := &in.SecurityContext, &out.SecurityContext
+		*out = new(v1.SecurityContext)
+		(*in).DeepCopyInto(*out)
+	}
+	out.Timeout = in.Timeout
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new InitContainerConfig.
+func (in *InitContainerConfig) DeepCopy() *InitContainerConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(InitContainerConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *IntervalsConfig) DeepCopyInto(out *IntervalsConfig) {
+	*out = *in
+	out.LocalNetworksResync = in.LocalNetworksResync
+	out.NodeMachineCheck = in.NodeMachineCheck
+	out.EgressDriftCheck = in.EgressDriftCheck
+	out.HolderCheck = in.HolderCheck
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new IntervalsConfig.
+func (in *IntervalsConfig) DeepCopy() *IntervalsConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(IntervalsConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *OperatorConfig) DeepCopyInto(out *OperatorConfig) {
+	*out = *in
+	out.TypeMeta = in.TypeMeta
+	in.ControllerManagerConfigurationSpec.DeepCopyInto(&out.ControllerManagerConfigurationSpec)
+	in.Provider.DeepCopyInto(&out.Provider)
+	if in.Providers != nil {
+		in, out := &in.Providers, &out.Providers
+		*out = make([]ProviderConfig, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	in.Retry.DeepCopyInto(&out.Retry)
+	if in.LocalNetworks != nil {
+		in, out := &in.LocalNetworks, &out.LocalNetworks
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.ServiceCIDRs != nil {
+		in, out := &in.ServiceCIDRs, &out.ServiceCIDRs
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	in.InitContainer.DeepCopyInto(&out.InitContainer)
+	out.Intervals = in.Intervals
+	out.Tracing = in.Tracing
+	out.Debug = in.Debug
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new OperatorConfig.
+func (in *OperatorConfig) DeepCopy() *OperatorConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(OperatorConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyObject is an autogenerated deepcopy function, copying the receiver, creating a new runtime.Object.
+func (in *OperatorConfig) DeepCopyObject() runtime.Object {
+	if c := in.DeepCopy(); c != nil {
+		return c
+	}
+	return nil
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ProviderConfig) DeepCopyInto(out *ProviderConfig) {
+	*out = *in
+	in.Config.DeepCopyInto(&out.Config)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ProviderConfig.
+func (in *ProviderConfig) DeepCopy() *ProviderConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(ProviderConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RetryConfig) DeepCopyInto(out *RetryConfig) {
+	*out = *in
+	out.IPInUseBackoff = in.IPInUseBackoff
+	out.IPInUseMaxBackoff = in.IPInUseMaxBackoff
+	if in.IPInUseRetryBudget != nil {
+		in, out := &in.IPInUseRetryBudget, &out.IPInUseRetryBudget
+		*out = new(int32)
+		**out = **in
+	}
+	out.HandoffNodeNotReadyTimeout = in.HandoffNodeNotReadyTimeout
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RetryConfig.
+func (in *RetryConfig) DeepCopy() *RetryConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(RetryConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *TracingConfig) DeepCopyInto(out *TracingConfig) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new TracingConfig.
+func (in *TracingConfig) DeepCopy() *TracingConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(TracingConfig)
+	in.DeepCopyInto(out)
+	return out
+}
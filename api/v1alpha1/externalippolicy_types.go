@@ -0,0 +1,69 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ExternalIPPolicySpec defines which pods may use which external IPs
+type ExternalIPPolicySpec struct {
+	// Namespaces are the namespaces whose pods may use the external IPs.
+	// +optional
+	Namespaces []string `json:"namespaces,omitempty"`
+
+	// ServiceAccounts are the service accounts, as namespace/name, whose pods
+	// may use the external IPs.
+	// +optional
+	ServiceAccounts []string `json:"serviceAccounts,omitempty"`
+
+	// ExternalIPs are the external IPs the pods may use. An entry is either an
+	// IP address or the CIDR range of a pool of addresses.
+	ExternalIPs []string `json:"externalIPs"`
+
+	// Provider is the name of the provider of the external IPs, one of the
+	// providers of the operator config. The default provider provides them
+	// when empty.
+	// +optional
+	Provider string `json:"provider,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:resource:scope=Cluster
+
+// ExternalIPPolicy is the Schema for the externalippolicies API. Once any
+// policy exists, a pod may only request the external IPs allowed to its
+// namespace or service account by a policy.
+type ExternalIPPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ExternalIPPolicySpec `json:"spec,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// ExternalIPPolicyList contains a list of ExternalIPPolicy
+type ExternalIPPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ExternalIPPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ExternalIPPolicy{}, &ExternalIPPolicyList{})
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// log is for logging in this package.
+var externalippolicylog = logf.Log.WithName("externalippolicy-resource")
+
+func (r *ExternalIPPolicy) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+//+kubebuilder:webhook:path=/validate-podexternalip-yglab-eu-org-v1alpha1-externalippolicy,mutating=false,failurePolicy=fail,sideEffects=None,groups=podexternalip.yglab.eu.org,resources=externalippolicies,verbs=create;update,versions=v1alpha1,name=vexternalippolicy.kb.io,admissionReviewVersions={v1,v1beta1}
+
+var _ webhook.Validator = &ExternalIPPolicy{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *ExternalIPPolicy) ValidateCreate() error {
+	externalippolicylog.Info("validate create", "name", r.Name)
+
+	return r.validate()
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *ExternalIPPolicy) ValidateUpdate(old runtime.Object) error {
+	externalippolicylog.Info("validate update", "name", r.Name)
+
+	return r.validate()
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *ExternalIPPolicy) ValidateDelete() error {
+	return nil
+}
+
+func (r *ExternalIPPolicy) validate() error {
+	for _, ns := range r.Spec.Namespaces {
+		if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+			return fmt.Errorf("invalid namespace %q: %s", ns, strings.Join(errs, ", "))
+		}
+	}
+	for _, sa := range r.Spec.ServiceAccounts {
+		parts := strings.Split(sa, "/")
+		if len(parts) != 2 || len(validation.IsDNS1123Label(parts[0])) > 0 || len(validation.IsDNS1123Subdomain(parts[1])) > 0 {
+			return fmt.Errorf("invalid service account %q, expected namespace/name", sa)
+		}
+	}
+	if len(r.Spec.ExternalIPs) == 0 {
+		return fmt.Errorf("externalIPs must not be empty")
+	}
+	for _, ip := range r.Spec.ExternalIPs {
+		if net.ParseIP(ip) == nil {
+			if _, _, err := net.ParseCIDR(ip); err != nil {
+				return fmt.Errorf("invalid external IP %q, expected an IP address or a CIDR range", ip)
+			}
+		}
+	}
+	return nil
+}
@@ -33,6 +33,12 @@ type PodExternalIPSpec struct {
 
 	IP          string               `json:"ip"`
 	PodSelector metav1.LabelSelector `json:"podSelector"`
+
+	// Provider is the name of the provider of the IP, one of the providers
+	// of the operator config. The IP is provided by the provider of the
+	// ExternalIPPolicy allowing it, or by the default provider, when empty.
+	// +optional
+	Provider string `json:"provider,omitempty"`
 }
 
 // PodExternalIPStatus defines the observed state of PodExternalIP
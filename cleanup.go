@@ -0,0 +1,130 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/yingeli/pod-external-ip-operator/controllers"
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+// runCleanup runs the cleanup subcommand, which undoes what the operator did
+// so it can be uninstalled. By default it cleans up the pods of the cluster.
+// With --egress-rules it removes the egress rules of the node it runs on,
+// and is meant to run in a DaemonSet. The providers are those of the operator
+// config file given with --config.
+func runCleanup(args []string) int {
+	fs := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	var configFile string
+	var dryRun, egressRules, wait bool
+	fs.StringVar(&configFile, "config", "",
+		"The operator config file the providers are read from. Omit this flag to use the default providers.")
+	fs.BoolVar(&dryRun, "dry-run", false,
+		"Only report what would be cleaned up.")
+	fs.BoolVar(&egressRules, "egress-rules", false,
+		"Remove the egress rules of the node instead of cleaning up the pods.")
+	fs.BoolVar(&wait, "wait", false,
+		"Wait for a termination signal once done, so the command can run in a DaemonSet.")
+	opts := zap.Options{
+		Development: true,
+	}
+	opts.BindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+
+	ctx := ctrl.SetupSignalHandler()
+	providerSet, err := loadProviders(configFile)
+	if err == nil {
+		if egressRules {
+			err = cleanupEgressRules(providerSet, dryRun)
+		} else {
+			err = cleanupPods(ctx, providerSet, dryRun)
+		}
+	}
+	if err != nil {
+		setupLog.Error(err, "cleanup failed")
+		return 1
+	}
+	if wait {
+		<-ctx.Done()
+	}
+	return 0
+}
+
+func cleanupPods(ctx context.Context, providerSet controllers.Providers, dryRun bool) error {
+	c, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+	cleanup := controllers.Cleanup{
+		Client:    c,
+		Providers: providerSet,
+		DryRun:    dryRun,
+		Out:       os.Stdout,
+	}
+	return cleanup.Run(ctx)
+}
+
+// cleanupEgressRules removes the egress rules of the providers that program
+// them.
+func cleanupEgressRules(providerSet controllers.Providers, dryRun bool) error {
+	names := make([]string, 0, len(providerSet.ByName))
+	for name := range providerSet.ByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var cleanups []providers.EgressCleanup
+	var err error
+	for _, name := range names {
+		cleaner, ok := providerSet.ByName[name].(providers.EgressCleaner)
+		if !ok {
+			continue
+		}
+		var providerCleanups []providers.EgressCleanup
+		providerCleanups, err = cleaner.CleanupEgressRules(dryRun)
+		cleanups = append(cleanups, providerCleanups...)
+		if err != nil {
+			break
+		}
+	}
+	action := "removed"
+	if dryRun {
+		action = "would remove"
+	}
+	node := os.Getenv("NODE_NAME")
+	for _, cleanup := range cleanups {
+		fmt.Printf("node %s: %s the %s egress rules of %d pod IPs\n", node, action, cleanup.Backend, len(cleanup.Pods))
+		for ip, pod := range cleanup.Pods {
+			fmt.Printf("node %s:   %s of pod %s\n", node, ip, pod)
+		}
+	}
+	if err == nil && len(cleanups) == 0 {
+		fmt.Printf("node %s: no egress rules\n", node)
+	}
+	return err
+}
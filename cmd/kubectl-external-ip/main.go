@@ -0,0 +1,476 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Command kubectl-external-ip is a kubectl plugin to inspect and move the
+// external IPs of pods. Install it on the PATH and run kubectl external-ip.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	podexternalipv1alpha1 "github.com/yingeli/pod-external-ip-operator/api/v1alpha1"
+	"github.com/yingeli/pod-external-ip-operator/controllers"
+)
+
+const usage = `Inspect and move the external IPs of pods.
+
+Usage:
+  kubectl external-ip list [-n namespace | -A]
+  kubectl external-ip describe <ip>
+  kubectl external-ip move <ip> --to pod/<name> [-n namespace] [--timeout 2m]
+  kubectl external-ip release <ip> [--timeout 2m]
+
+Every command accepts --kubeconfig and --context.
+`
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(podexternalipv1alpha1.AddToScheme(scheme))
+}
+
+// plugin holds the flags shared by the commands and the client they build.
+type plugin struct {
+	kubeconfig    string
+	context       string
+	namespace     string
+	allNamespaces bool
+	client        client.Client
+}
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] == "-h" || os.Args[1] == "--help" || os.Args[1] == "help" {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	p := &plugin{}
+	var err error
+	switch command, args := os.Args[1], os.Args[2:]; command {
+	case "list":
+		err = p.list(ctx, args)
+	case "describe":
+		err = p.describe(ctx, args)
+	case "move":
+		err = p.move(ctx, args)
+	case "release":
+		err = p.release(ctx, args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", command, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// flags returns the flag set of a command, with the shared flags.
+func (p *plugin) flags(command string) *flag.FlagSet {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	fs.StringVar(&p.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file.")
+	fs.StringVar(&p.context, "context", "", "The kubeconfig context to use.")
+	fs.StringVar(&p.namespace, "namespace", "", "The namespace of the pods, the one of the context by default.")
+	fs.StringVar(&p.namespace, "n", "", "Shorthand for --namespace.")
+	return fs
+}
+
+// parse parses the flags of a command, which may follow its arguments as
+// they do with kubectl, and builds the client.
+func (p *plugin) parse(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = p.kubeconfig
+	config := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{CurrentContext: p.context})
+	if p.namespace == "" {
+		namespace, _, err := config.Namespace()
+		if err != nil {
+			return nil, err
+		}
+		p.namespace = namespace
+	}
+	restConfig, err := config.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	p.client, err = client.New(restConfig, client.Options{Scheme: scheme})
+	return positional, err
+}
+
+// claimants returns the pods that request the external IP, in every
+// namespace.
+func (p *plugin) claimants(ctx context.Context, externalIP string) ([]corev1.Pod, error) {
+	var pods corev1.PodList
+	if err := p.client.List(ctx, &pods); err != nil {
+		return nil, err
+	}
+	var claimants []corev1.Pod
+	for _, pod := range pods.Items {
+		if controllers.RequestsExternalIP(&pod, externalIP) {
+			claimants = append(claimants, pod)
+		}
+	}
+	return claimants, nil
+}
+
+func (p *plugin) list(ctx context.Context, args []string) error {
+	fs := p.flags("list")
+	fs.BoolVar(&p.allNamespaces, "all-namespaces", false, "List the external IPs of the pods of every namespace.")
+	fs.BoolVar(&p.allNamespaces, "A", false, "Shorthand for --all-namespaces.")
+	if _, err := p.parse(fs, args); err != nil {
+		return err
+	}
+	var opts []client.ListOption
+	if !p.allNamespaces {
+		opts = append(opts, client.InNamespace(p.namespace))
+	}
+	var pods corev1.PodList
+	if err := p.client.List(ctx, &pods, opts...); err != nil {
+		return err
+	}
+	var externalIPs podexternalipv1alpha1.PodExternalIPList
+	if err := p.client.List(ctx, &externalIPs, opts...); err != nil {
+		return err
+	}
+
+	// The PodExternalIPs have no status, the state of their IP is the one
+	// of the pods that request it.
+	assigned := make(map[string]string)
+	for i := range externalIPs.Items {
+		eip := &externalIPs.Items[i]
+		assigned[eip.Spec.IP] = podExternalIPName(eip, p.allNamespaces)
+	}
+
+	type row struct{ ip, podExternalIP, pod, node, state string }
+	var rows []row
+	claimed := make(map[string]bool)
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		for _, ip := range controllers.ExternalIPs(pod) {
+			claimed[ip] = true
+			rows = append(rows, row{ip: ip, podExternalIP: valueOr(assigned[ip], "<none>"), pod: podName(pod, p.allNamespaces), node: valueOr(pod.Spec.NodeName, "<none>"), state: controllers.ExternalIPState(pod)})
+		}
+	}
+	// PodExternalIPs that no pod uses yet are listed as unclaimed.
+	for i := range externalIPs.Items {
+		eip := &externalIPs.Items[i]
+		if !claimed[eip.Spec.IP] {
+			rows = append(rows, row{ip: eip.Spec.IP, podExternalIP: podExternalIPName(eip, p.allNamespaces), pod: "<none>", node: "<none>", state: "Unclaimed"})
+		}
+	}
+	sort.SliceStable(rows, func(i, j int) bool { return rows[i].ip < rows[j].ip })
+
+	if len(rows) == 0 {
+		fmt.Fprintln(os.Stderr, "No external IPs found.")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 3, ' ', 0)
+	fmt.Fprintln(w, "IP\tPODEXTERNALIP\tPOD\tNODE\tSTATE")
+	for _, r := range rows {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", r.ip, r.podExternalIP, r.pod, r.node, r.state)
+	}
+	return w.Flush()
+}
+
+func (p *plugin) describe(ctx context.Context, args []string) error {
+	args, err := p.parse(p.flags("describe"), args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("describe takes an external IP")
+	}
+	externalIP := args[0]
+	claimants, err := p.claimants(ctx, externalIP)
+	if err != nil {
+		return err
+	}
+	var externalIPs podexternalipv1alpha1.PodExternalIPList
+	if err := p.client.List(ctx, &externalIPs); err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 1, ' ', 0)
+	fmt.Fprintf(w, "External IP:\t%s\n", externalIP)
+	for _, eip := range externalIPs.Items {
+		if eip.Spec.IP == externalIP {
+			fmt.Fprintf(w, "PodExternalIP:\t%s/%s (pod selector %s)\n", eip.Namespace, eip.Name, metav1.FormatLabelSelector(&eip.Spec.PodSelector))
+		}
+	}
+	if len(claimants) == 0 {
+		fmt.Fprintf(w, "Pods:\t<none>\n")
+	}
+	for i := range claimants {
+		pod := &claimants[i]
+		fmt.Fprintf(w, "\nPod:\t%s/%s\n", pod.Namespace, pod.Name)
+		fmt.Fprintf(w, "State:\t%s\n", controllers.ExternalIPState(pod))
+		if c := controllers.ExternalIPCondition(pod); c != nil && c.Message != "" {
+			fmt.Fprintf(w, "Message:\t%s\n", c.Message)
+		}
+		fmt.Fprintf(w, "Node:\t%s\n", valueOr(pod.Spec.NodeName, "<none>"))
+		fmt.Fprintf(w, "Pod IPs:\t%s\n", valueOr(strings.Join(controllers.PodIPs(pod), ", "), "<none>"))
+		fmt.Fprintf(w, "Holder (inferred):\t%s\n", p.holder(ctx, pod))
+		fmt.Fprintf(w, "Finalizers:\t%s\n", valueOr(strings.Join(pod.Finalizers, ", "), "<none>"))
+		if err := p.printEvents(ctx, w, pod); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// holder describes the pod IPs of the node VM that hold the external IP of
+// the pod. The plugin does not query the cloud provider, so they are
+// inferred from the finalizers of the pod, which the daemon adds before it
+// associates the IP and removes once it released it. The doctor command of
+// the manager reports the actual holder.
+func (p *plugin) holder(ctx context.Context, pod *corev1.Pod) string {
+	held := controllers.HeldPodIPs(pod)
+	if len(held) == 0 {
+		return "<none>"
+	}
+	vm := pod.Spec.NodeName
+	var node corev1.Node
+	if err := p.client.Get(ctx, client.ObjectKey{Name: pod.Spec.NodeName}, &node); err == nil && node.Spec.ProviderID != "" {
+		vm = node.Spec.ProviderID
+	}
+	return fmt.Sprintf("private IP %s of %s", strings.Join(held, ", "), vm)
+}
+
+func (p *plugin) printEvents(ctx context.Context, w *tabwriter.Writer, pod *corev1.Pod) error {
+	var events corev1.EventList
+	if err := p.client.List(ctx, &events, client.InNamespace(pod.Namespace), client.MatchingFields{
+		"involvedObject.kind": "Pod",
+		"involvedObject.name": pod.Name,
+		"involvedObject.uid":  string(pod.UID),
+	}); err != nil {
+		return err
+	}
+	if len(events.Items) == 0 {
+		fmt.Fprintf(w, "Events:\t<none>\n")
+		return nil
+	}
+	sort.Slice(events.Items, func(i, j int) bool { return lastSeen(&events.Items[i]).Before(lastSeen(&events.Items[j])) })
+	fmt.Fprintf(w, "Events:\n")
+	for i := range events.Items {
+		e := &events.Items[i]
+		fmt.Fprintf(w, "  %s\t%s\t%s\t%s\n", lastSeen(e).UTC().Format(time.RFC3339), e.Type, e.Reason, e.Message)
+	}
+	return nil
+}
+
+func (p *plugin) move(ctx context.Context, args []string) error {
+	fs := p.flags("move")
+	var to string
+	var timeout time.Duration
+	fs.StringVar(&to, "to", "", "The pod to move the external IP to, pod/<name>.")
+	fs.DurationVar(&timeout, "timeout", 2*time.Minute, "How long to wait for the pods to release and associate the IP.")
+	args, err := p.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 || to == "" {
+		return errors.New("move takes an external IP and --to pod/<name>")
+	}
+	externalIP := args[0]
+	name := strings.TrimPrefix(to, "pod/")
+	if strings.Contains(name, "/") {
+		return fmt.Errorf("--to must name a pod, pod/<name>, got %q", to)
+	}
+
+	var target corev1.Pod
+	if err := p.client.Get(ctx, client.ObjectKey{Namespace: p.namespace, Name: name}, &target); err != nil {
+		return err
+	}
+	if controllers.HoldsExternalIP(&target) && !controllers.RequestsExternalIP(&target, externalIP) {
+		return fmt.Errorf("pod %s/%s holds external IP %s, release it first", target.Namespace, target.Name, strings.Join(controllers.ExternalIPs(&target), ","))
+	}
+
+	claimants, err := p.claimants(ctx, externalIP)
+	if err != nil {
+		return err
+	}
+	var releases []corev1.Pod
+	for _, pod := range claimants {
+		if pod.UID != target.UID {
+			releases = append(releases, pod)
+		}
+	}
+	// The external IP of a scheduled pod can only change once it released
+	// its previous one, if any.
+	if target.Spec.NodeName != "" && !controllers.RequestsExternalIP(&target, externalIP) {
+		releases = append(releases, target)
+	}
+	if err := p.requestRelease(ctx, releases, timeout); err != nil {
+		return err
+	}
+	if err := p.client.Get(ctx, client.ObjectKeyFromObject(&target), &target); err != nil {
+		return err
+	}
+
+	original := target.DeepCopy()
+	controllers.SetExternalIP(&target, externalIP)
+	if err := p.client.Patch(ctx, &target, client.MergeFrom(original)); err != nil {
+		return err
+	}
+	fmt.Printf("pod/%s requests external IP %s\n", target.Name, externalIP)
+	key := client.ObjectKeyFromObject(&target)
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err = wait.PollImmediateUntil(time.Second, func() (bool, error) {
+		if err := p.client.Get(ctx, key, &target); err != nil {
+			return false, err
+		}
+		return controllers.IsAssociated(&target), nil
+	}, waitCtx.Done())
+	if errors.Is(err, wait.ErrWaitTimeout) {
+		return fmt.Errorf("pod/%s is not associated with external IP %s after %s, its state is %s", target.Name, externalIP, timeout, controllers.ExternalIPState(&target))
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("pod/%s is associated with external IP %s\n", target.Name, externalIP)
+	return nil
+}
+
+func (p *plugin) release(ctx context.Context, args []string) error {
+	fs := p.flags("release")
+	var timeout time.Duration
+	fs.DurationVar(&timeout, "timeout", 2*time.Minute, "How long to wait for the pods to release the IP.")
+	args, err := p.parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("release takes an external IP")
+	}
+	claimants, err := p.claimants(ctx, args[0])
+	if err != nil {
+		return err
+	}
+	if len(claimants) == 0 {
+		return fmt.Errorf("no pod requests external IP %s", args[0])
+	}
+	return p.requestRelease(ctx, claimants, timeout)
+}
+
+// requestRelease asks the daemons to release the external IP of the pods,
+// and waits until none of them holds it anymore.
+func (p *plugin) requestRelease(ctx context.Context, pods []corev1.Pod, timeout time.Duration) error {
+	for i := range pods {
+		pod := &pods[i]
+		if controllers.ReleaseRequested(pod) || !pod.DeletionTimestamp.IsZero() {
+			continue
+		}
+		original := pod.DeepCopy()
+		controllers.RequestRelease(pod)
+		if err := p.client.Patch(ctx, pod, client.MergeFrom(original)); err != nil {
+			return err
+		}
+		fmt.Printf("pod/%s in %s asked to release external IP %s\n", pod.Name, pod.Namespace, valueOr(strings.Join(controllers.ExternalIPs(pod), ","), "<none>"))
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	err := wait.PollImmediateUntil(time.Second, func() (bool, error) {
+		for i := range pods {
+			pod := &pods[i]
+			if err := p.client.Get(ctx, client.ObjectKeyFromObject(pod), pod); err != nil {
+				if client.IgnoreNotFound(err) != nil {
+					return false, err
+				}
+				continue
+			}
+			if controllers.HoldsExternalIP(pod) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}, waitCtx.Done())
+	if errors.Is(err, wait.ErrWaitTimeout) {
+		return fmt.Errorf("pods still hold the external IP after %s, check their events with kubectl external-ip describe", timeout)
+	}
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		fmt.Printf("pod/%s in %s released its external IP\n", pod.Name, pod.Namespace)
+	}
+	return nil
+}
+
+func podName(pod *corev1.Pod, withNamespace bool) string {
+	if withNamespace {
+		return pod.Namespace + "/" + pod.Name
+	}
+	return pod.Name
+}
+
+func podExternalIPName(eip *podexternalipv1alpha1.PodExternalIP, withNamespace bool) string {
+	if withNamespace {
+		return eip.Namespace + "/" + eip.Name
+	}
+	return eip.Name
+}
+
+func lastSeen(e *corev1.Event) time.Time {
+	if !e.LastTimestamp.IsZero() {
+		return e.LastTimestamp.Time
+	}
+	if !e.EventTime.IsZero() {
+		return e.EventTime.Time
+	}
+	return e.CreationTimestamp.Time
+}
+
+func valueOr(s string, fallback string) string {
+	if s == "" {
+		return fallback
+	}
+	return s
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Backoff configures the retries of the associations whose external IP is
+// still in use by another network interface.
+type Backoff struct {
+	// Initial is the delay before the first retry. It doubles on each retry.
+	Initial time.Duration
+	// Max caps the delay between the retries.
+	Max time.Duration
+	// Budget is the number of retries after which the pod is marked Stuck,
+	// or 0 to retry without marking it.
+	Budget int
+}
+
+// DefaultBackoff retries after 5s, 10s, 20s... up to 5m, and marks the pod
+// Stuck after about 20 minutes.
+var DefaultBackoff = Backoff{
+	Initial: 5 * time.Second,
+	Max:     5 * time.Minute,
+	Budget:  10,
+}
+
+// backoffJitter is the fraction by which the delays are randomly shortened,
+// so the pods waiting for the same external IP don't retry in lockstep.
+const backoffJitter = 0.2
+
+// podBackoff counts the retries of each pod.
+type podBackoff struct {
+	Backoff
+
+	mu       sync.Mutex
+	attempts map[string]int
+}
+
+func newPodBackoff(backoff Backoff) *podBackoff {
+	if backoff.Initial <= 0 {
+		backoff.Initial = DefaultBackoff.Initial
+	}
+	if backoff.Max < backoff.Initial {
+		backoff.Max = backoff.Initial
+	}
+	return &podBackoff{
+		Backoff:  backoff,
+		attempts: make(map[string]int),
+	}
+}
+
+// next counts a retry of the pod and returns the delay before it along with
+// the number of retries so far.
+func (b *podBackoff) next(key string) (time.Duration, int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.attempts[key]++
+	attempts := b.attempts[key]
+
+	delay := b.Max
+	if shift := attempts - 1; shift < 32 {
+		if d := b.Initial << uint(shift); d > 0 && d < b.Max {
+			delay = d
+		}
+	}
+	return delay - time.Duration(rand.Float64()*backoffJitter*float64(delay)), attempts
+}
+
+// exhausted tells whether the pod used up the retry budget.
+func (b *podBackoff) exhausted(attempts int) bool {
+	return b.Budget > 0 && attempts >= b.Budget
+}
+
+// reset forgets the retries of the pod.
+func (b *podBackoff) reset(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.attempts, key)
+}
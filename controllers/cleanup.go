@@ -0,0 +1,134 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+// Cleanup undoes what the operator did to the pods, so it can be uninstalled:
+// it dissociates the external IPs from the pod IPs, and removes the
+// finalizers and the associatedpodip annotation. The egress rules of the
+// nodes are removed on every node, see providers.EgressCleaner.
+type Cleanup struct {
+	Client client.Client
+	// Providers dissociate every external IP with the finalizer of its
+	// provider.
+	Providers Providers
+	// DryRun only reports what would be done.
+	DryRun bool
+	Out    io.Writer
+
+	finalizer providers.Finalizer
+}
+
+// Run cleans up every pod, and returns an error if any of them failed.
+func (c *Cleanup) Run(ctx context.Context) error {
+	finalizer := newProviderFinalizer(c.Client, c.Providers)
+	if err := finalizer.Initialize(ctx); err != nil {
+		return err
+	}
+	c.finalizer = finalizer
+
+	var pods corev1.PodList
+	if err := c.Client.List(ctx, &pods); err != nil {
+		return err
+	}
+	cleaned, failed := 0, 0
+	for i := range pods.Items {
+		done, err := c.cleanupPod(ctx, &pods.Items[i])
+		if err != nil {
+			fmt.Fprintf(c.Out, "error cleaning up pod %s: %v\n", namespacedName(&pods.Items[i]), err)
+			failed++
+		} else if done {
+			cleaned++
+		}
+	}
+	if c.DryRun {
+		fmt.Fprintf(c.Out, "dry run: %d pods would be cleaned up\n", cleaned)
+	} else {
+		fmt.Fprintf(c.Out, "%d pods cleaned up\n", cleaned)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d pods could not be cleaned up", failed)
+	}
+	return nil
+}
+
+// cleanupPod dissociates the pod IPs recorded in the finalizers, and the
+// current pod IPs, from the external IPs of the pod. It returns whether the
+// pod had anything to clean up.
+func (c *Cleanup) cleanupPod(ctx context.Context, pod *corev1.Pod) (bool, error) {
+	finalizers, dissociaters := parseFinalizers(pod), parseDissociaters(pod)
+	managed := len(finalizers) > 0 || len(dissociaters) > 0 || parseAssociatedPodIP(pod) != ""
+	externalIPs := parseExternalIPs(pod)
+	if !managed && len(externalIPs) == 0 {
+		return false, nil
+	}
+
+	var localIPs []string
+	for _, ips := range [][]string{finalizers, dissociaters, parsePodIPs(pod)} {
+		for _, ip := range ips {
+			if !containsIP(localIPs, ip) {
+				localIPs = append(localIPs, ip)
+			}
+		}
+	}
+	action := "dissociating"
+	if c.DryRun {
+		action = "would dissociate"
+	}
+	if pod.Spec.NodeName != "" {
+		for _, localIP := range localIPs {
+			externalIP := matchIPFamily(externalIPs, localIP)
+			if externalIP == "" {
+				continue
+			}
+			fmt.Fprintf(c.Out, "pod %s: %s external IP %s from pod IP %s\n", namespacedName(pod), action, externalIP, localIP)
+			if c.DryRun {
+				continue
+			}
+			if err := c.finalizer.Finalize(ctx, pod, localIP, externalIP); err != nil {
+				return true, err
+			}
+		}
+	}
+
+	if !managed {
+		return true, nil
+	}
+	if c.DryRun {
+		fmt.Fprintf(c.Out, "pod %s: would remove the finalizers and the associatedpodip annotation\n", namespacedName(pod))
+		return true, nil
+	}
+	original := pod.DeepCopy()
+	removeFinalizer(pod)
+	removeDissociater(pod)
+	removeAssociatedPodIP(pod)
+	if err := c.Client.Patch(ctx, pod, client.StrategicMergeFrom(original)); err != nil {
+		return true, client.IgnoreNotFound(err)
+	}
+	fmt.Fprintf(c.Out, "pod %s: removed the finalizers and the associatedpodip annotation\n", namespacedName(pod))
+	return true, nil
+}
@@ -19,15 +19,21 @@ package controllers
 import (
 	"context"
 	"os"
-	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
-
-	"github.com/yingeli/pod-external-ip-operator/providers/azurecni"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 )
 
 // PodReconciler reconciles a Pod object
@@ -35,6 +41,49 @@ type DaemonPodReconciler struct {
 	client.Client
 	Scheme *runtime.Scheme
 
+	// Providers associate the external IPs of the pods. The egress rules
+	// of the node are checked, repaired and served when the associater of
+	// one of them implements providers.EgressRules.
+	Providers Providers
+
+	Recorder record.EventRecorder
+
+	// Backoff configures the retries of the pods whose external IP is in
+	// use, DefaultBackoff when zero.
+	Backoff Backoff
+
+	// NodeNotReadyTimeout is how long the node of the pod holding an
+	// external IP may be NotReady before the IP is detached from it,
+	// DefaultNodeNotReadyTimeout when zero. The IP is never detached from
+	// pods of NotReady nodes when it is negative.
+	NodeNotReadyTimeout time.Duration
+
+	// EgressDriftCheckPeriod is how often the egress rules of the node are
+	// compared with the desired ones and repaired,
+	// DefaultEgressDriftCheckPeriod when zero. They are never repaired when
+	// it is negative, and only checked by the readiness probe.
+	EgressDriftCheckPeriod time.Duration
+
+	// HolderCheckPeriod is how often the external IPs of the associated pods
+	// are checked to still be associated with them,
+	// DefaultHolderCheckInterval when zero.
+	HolderCheckPeriod time.Duration
+
+	// DebugEndpoints serves DebugStatePath and DebugResyncPath on the
+	// metrics server.
+	DebugEndpoints bool
+
+	// LocalNetworks and ServiceCIDRs are not SNATed to the external IPs,
+	// besides the networks the provider discovers. The LOCAL_NETWORKS and
+	// SERVICE_CIDRS env vars override them.
+	LocalNetworks []string
+	ServiceCIDRs  []string
+
+	// LocalNetworksResyncPeriod is how often the local networks are updated
+	// with the pod CIDRs of the nodes, DefaultLocalNetworksResyncPeriod when
+	// zero.
+	LocalNetworksResyncPeriod time.Duration
+
 	// yingeli
 	associater PodAssociater
 }
@@ -42,6 +91,7 @@ type DaemonPodReconciler struct {
 //+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=core,resources=pods/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=core,resources=pods/finalizers,verbs=update
+//+kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -58,10 +108,14 @@ func (r *DaemonPodReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 	// your logic here
 	var pod corev1.Pod
 	if err := r.Get(ctx, req.NamespacedName, &pod); err != nil {
+		if apierrors.IsNotFound(err) {
+			r.associater.forget(req.NamespacedName)
+		}
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
 	result, err := r.associater.reconcile(ctx, &pod)
+	r.associater.markReconciled(req.NamespacedName)
 
 	return result, err
 }
@@ -69,15 +123,93 @@ func (r *DaemonPodReconciler) Reconcile(ctx context.Context, req ctrl.Request) (
 // SetupWithManager sets up the controller with the Manager.
 func (r *DaemonPodReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	// yingeli
-	associater := azurecni.NewAssociater()
-	finalizer := azurecni.NewFinalizer()
-	r.associater = newPodAssociater(&r.Client, &associater, &finalizer)
-	localNetworks := strings.Split(os.Getenv("LOCAL_NETWORKS"), ",; ")
+	associater := newProviderAssociater(mgr.GetClient(), r.Providers)
+	finalizer := newProviderFinalizer(mgr.GetClient(), r.Providers)
+	backoff := r.Backoff
+	if backoff == (Backoff{}) {
+		backoff = DefaultBackoff
+	}
+	nodeNotReadyTimeout := r.NodeNotReadyTimeout
+	if nodeNotReadyTimeout == 0 {
+		nodeNotReadyTimeout = DefaultNodeNotReadyTimeout
+	}
+	holderCheck := r.HolderCheckPeriod
+	if holderCheck == 0 {
+		holderCheck = DefaultHolderCheckInterval
+	}
+	r.associater = newPodAssociater(&r.Client, mgr.GetAPIReader(), associater, finalizer, r.Recorder, backoff, nodeNotReadyTimeout, holderCheck)
+	localNetworks := configuredLocalNetworks(r.LocalNetworks, r.ServiceCIDRs)
 	if err := r.associater.setup(localNetworks); err != nil {
 		return err
 	}
+	localNetworksResyncPeriod := r.LocalNetworksResyncPeriod
+	if localNetworksResyncPeriod == 0 {
+		localNetworksResyncPeriod = DefaultLocalNetworksResyncPeriod
+	}
+	if err := mgr.Add(newLocalNetworkWatcher(mgr.GetClient(), associater, localNetworks, localNetworksResyncPeriod)); err != nil {
+		return err
+	}
+	if err := addProviderChecks(mgr, r.Providers); err != nil {
+		return err
+	}
+	egress := associater.egressRules()
+	if egress != nil {
+		if err := mgr.AddMetricsExtraHandler(EgressRulesPath, egressRulesHandler(egress)); err != nil {
+			return err
+		}
+		driftCheckPeriod := r.EgressDriftCheckPeriod
+		if driftCheckPeriod == 0 {
+			driftCheckPeriod = DefaultEgressDriftCheckPeriod
+		}
+		if driftCheckPeriod > 0 {
+			drift := newEgressDriftWatcher(mgr.GetAPIReader(), mgr.GetClient(), &r.associater, egress, r.Recorder, os.Getenv("NODE_NAME"), driftCheckPeriod)
+			if err := mgr.Add(drift); err != nil {
+				return err
+			}
+		}
+		if err := addEgressRulesChecks(mgr, egress); err != nil {
+			return err
+		}
+	}
 
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.Pod{}).
-		Complete(r)
+	b := ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Pod{}, builder.WithPredicates(podSpecOrIPChanged()))
+	if r.DebugEndpoints {
+		resyncs := make(chan event.GenericEvent, debugResyncQueueSize)
+		if err := mgr.AddMetricsExtraHandler(DebugStatePath, debugStateHandler(&r.associater, egress)); err != nil {
+			return err
+		}
+		if err := mgr.AddMetricsExtraHandler(DebugResyncPath, debugResyncHandler(r.Client, &r.associater, resyncs)); err != nil {
+			return err
+		}
+		b = b.Watches(&source.Channel{Source: resyncs}, &handler.EnqueueRequestForObject{})
+	}
+	return b.Complete(r)
+}
+
+// podSpecOrIPChanged ignores the updates of a pod that only change its status,
+// such as the external IP condition the daemon sets, which would otherwise
+// requeue the pod at once and defeat the retry delays. The updates of its
+// metadata, spec, phase and IPs are reconciled.
+func podSpecOrIPChanged() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			old, ok := e.ObjectOld.(*corev1.Pod)
+			if !ok {
+				return true
+			}
+			pod, ok := e.ObjectNew.(*corev1.Pod)
+			if !ok {
+				return true
+			}
+			return !equality.Semantic.DeepEqual(old.Annotations, pod.Annotations) ||
+				!equality.Semantic.DeepEqual(old.Labels, pod.Labels) ||
+				!equality.Semantic.DeepEqual(old.Finalizers, pod.Finalizers) ||
+				!equality.Semantic.DeepEqual(old.DeletionTimestamp, pod.DeletionTimestamp) ||
+				!equality.Semantic.DeepEqual(old.Spec, pod.Spec) ||
+				old.Status.Phase != pod.Status.Phase ||
+				old.Status.PodIP != pod.Status.PodIP ||
+				!equality.Semantic.DeepEqual(old.Status.PodIPs, pod.Status.PodIPs)
+		},
+	}
 }
@@ -0,0 +1,231 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+// Paths of the debug endpoints of the daemon metrics server, which are
+// protected by its auth proxy.
+const (
+	// DebugStatePath serves the state of the daemon as a DebugState.
+	DebugStatePath = "/debug/state"
+	// DebugResyncPath forces a reconcile of the pod given by the pod query
+	// parameter, namespace/name, on POST.
+	DebugResyncPath = "/debug/resync"
+)
+
+// debugResyncQueueSize is how many resyncs may be pending.
+const debugResyncQueueSize = 16
+
+// DebugState is the state of the daemon served at DebugStatePath.
+type DebugState struct {
+	Node string `json:"node"`
+	// Associations are the pod IPs of the pods the daemon associated with
+	// their external IP, by namespaced name of the pod.
+	Associations map[string]string `json:"associations"`
+	// LocalNetworks are the networks the egress rules were set up with.
+	LocalNetworks []string `json:"localNetworks"`
+	// Rules are the egress rules read back from the node.
+	Rules      providers.EgressState `json:"rules"`
+	RulesError string                `json:"rulesError,omitempty"`
+	// ProviderErrors are the last provider errors, by namespaced name of
+	// the pod.
+	ProviderErrors map[string]ProviderErrorState `json:"providerErrors"`
+}
+
+// ProviderErrorState is the last provider error of a pod.
+type ProviderErrorState struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Code   string    `json:"code,omitempty"`
+	Error  string    `json:"error"`
+}
+
+// associatedPodIPs returns the pod IPs the pod is associated with, if any.
+func (r *PodAssociater) associatedPodIPs(pod *corev1.Pod) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.assoMap[namespacedName(pod)]
+}
+
+// setAssociated records the pod IPs the pod is associated with, or that it
+// is not associated when podIPs is empty.
+func (r *PodAssociater) setAssociated(pod *corev1.Pod, podIPs string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if podIPs == "" {
+		delete(r.assoMap, namespacedName(pod))
+	} else {
+		r.assoMap[namespacedName(pod)] = podIPs
+	}
+	associationsPerNode.WithLabelValues(pod.Spec.NodeName).Set(float64(len(r.assoMap)))
+}
+
+// recordProviderError records a ProviderError event on the pod, and keeps
+// the error for the debug state.
+func (r *PodAssociater) recordProviderError(pod *corev1.Pod, action string, err error) {
+	recordProviderError(r.recorder, pod, action, err)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providerErrors[namespacedName(pod)] = ProviderErrorState{
+		Time:   time.Now(),
+		Action: action,
+		Code:   providers.ErrorCode(err),
+		Error:  err.Error(),
+	}
+}
+
+func (r *PodAssociater) forgetProviderError(pod *corev1.Pod) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.providerErrors, namespacedName(pod))
+}
+
+// requestResync makes the next reconcile of the pod associate it again, even
+// when it is associated.
+func (r *PodAssociater) requestResync(key types.NamespacedName) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.resyncs[key.String()] = true
+}
+
+// takeResync tells whether a resync of the pod was requested, and clears the
+// request.
+func (r *PodAssociater) takeResync(pod *corev1.Pod) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	resync := r.resyncs[namespacedName(pod)]
+	delete(r.resyncs, namespacedName(pod))
+	return resync
+}
+
+// markReconciled records that the pod was reconciled since the daemon started.
+func (r *PodAssociater) markReconciled(key types.NamespacedName) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reconciled[key.String()] = true
+}
+
+// reconciledAll tells whether every given pod, by namespaced name, was
+// reconciled since the daemon started.
+func (r *PodAssociater) reconciledAll(keys []string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range keys {
+		if !r.reconciled[key] {
+			return false
+		}
+	}
+	return true
+}
+
+// forget forgets the state kept for a pod that no longer exists.
+func (r *PodAssociater) forget(key types.NamespacedName) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.reconciled, key.String())
+	delete(r.seen, key.String())
+}
+
+// debugState returns the state of the associater, without the egress rules.
+func (r *PodAssociater) debugState() DebugState {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state := DebugState{
+		Associations:   make(map[string]string, len(r.assoMap)),
+		ProviderErrors: make(map[string]ProviderErrorState, len(r.providerErrors)),
+	}
+	for k, v := range r.assoMap {
+		state.Associations[k] = v
+	}
+	for k, v := range r.providerErrors {
+		state.ProviderErrors[k] = v
+	}
+	return state
+}
+
+// debugStateHandler serves the state of the daemon, with the egress rules of
+// the node when associater is not nil.
+func debugStateHandler(r *PodAssociater, associater providers.EgressRules) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		state := r.debugState()
+		state.Node = os.Getenv("NODE_NAME")
+		if associater != nil {
+			state.LocalNetworks = associater.LocalNetworks()
+			rules, err := associater.EgressState()
+			if err != nil {
+				state.RulesError = err.Error()
+			}
+			state.Rules = rules
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(state); err != nil {
+			log.Log.Error(err, "error writing the debug state")
+		}
+	})
+}
+
+// debugResyncHandler forces a reconcile of a pod of the node.
+func debugResyncHandler(c client.Reader, r *PodAssociater, resyncs chan<- event.GenericEvent) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "use POST", http.StatusMethodNotAllowed)
+			return
+		}
+		parts := strings.Split(req.URL.Query().Get("pod"), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			http.Error(w, "the pod query parameter must be namespace/name", http.StatusBadRequest)
+			return
+		}
+		key := types.NamespacedName{Namespace: parts[0], Name: parts[1]}
+		// The cache of the daemon only holds the pods of its node.
+		var pod corev1.Pod
+		if err := c.Get(req.Context(), key, &pod); err != nil {
+			status := http.StatusInternalServerError
+			if client.IgnoreNotFound(err) == nil {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		r.requestResync(key)
+		select {
+		case resyncs <- event.GenericEvent{Object: &pod}:
+		default:
+			http.Error(w, "too many pending resyncs", http.StatusServiceUnavailable)
+			return
+		}
+		log.Log.Info("resync requested", "pod", key.String())
+		fmt.Fprintf(w, "resync of pod %s queued\n", key)
+	})
+}
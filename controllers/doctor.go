@@ -0,0 +1,386 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+// Severities of the doctor findings.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// stuckTerminationPeriod is how long a pod may be terminating with finalizers
+// before the doctor reports it.
+const stuckTerminationPeriod = 5 * time.Minute
+
+// Finding is an inconsistency found by the doctor.
+type Finding struct {
+	Severity string `json:"severity"`
+	Kind     string `json:"kind"`
+	Object   string `json:"object"`
+	Message  string `json:"message"`
+}
+
+// DoctorReport is what the doctor audited and the inconsistencies it found.
+type DoctorReport struct {
+	Pods        int       `json:"pods"`
+	ExternalIPs int       `json:"externalIPs"`
+	Nodes       int       `json:"nodes"`
+	Findings    []Finding `json:"findings"`
+}
+
+// Errors returns the number of findings of the error severity.
+func (r *DoctorReport) Errors() int {
+	n := 0
+	for _, f := range r.Findings {
+		if f.Severity == SeverityError {
+			n++
+		}
+	}
+	return n
+}
+
+// Doctor audits the pods with an external IP, their finalizers and
+// associatedpodip annotation, the external IPs of the cloud provider, and the
+// egress rules of the nodes against each other.
+type Doctor struct {
+	Client client.Client
+	// Providers list the external IPs, the doctor audits those of every
+	// provider.
+	Providers Providers
+	Daemons   *DaemonClient
+}
+
+// externalIPs lists the external IPs of every provider.
+func (d *Doctor) externalIPs(ctx context.Context) ([]providers.ExternalIP, error) {
+	var ips []providers.ExternalIP
+	for _, name := range d.Providers.names() {
+		inventory := d.Providers.ByName[name].NewInventory()
+		if err := inventory.Initialize(ctx); err != nil {
+			return nil, fmt.Errorf("error initializing provider %s: %v", name, err)
+		}
+		providerIPs, err := inventory.ExternalIPs(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error listing the external IPs of provider %s: %v", name, err)
+		}
+		ips = append(ips, providerIPs...)
+	}
+	return ips, nil
+}
+
+// doctorAudit holds the state collected by the doctor.
+type doctorAudit struct {
+	pods        []*corev1.Pod
+	nodes       map[string]*corev1.Node
+	providerIDs map[string]string
+	externalIPs map[string]providers.ExternalIP
+	egress      map[string]providers.EgressState
+	report      DoctorReport
+}
+
+// Run collects the state and audits it.
+func (d *Doctor) Run(ctx context.Context) (*DoctorReport, error) {
+	a := &doctorAudit{
+		nodes:       make(map[string]*corev1.Node),
+		providerIDs: make(map[string]string),
+		externalIPs: make(map[string]providers.ExternalIP),
+	}
+
+	var pods corev1.PodList
+	if err := d.Client.List(ctx, &pods); err != nil {
+		return nil, err
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if parseExternalIP(pod) != "" || len(parseFinalizers(pod)) > 0 || len(parseDissociaters(pod)) > 0 || parseAssociatedPodIP(pod) != "" {
+			a.pods = append(a.pods, pod)
+		}
+	}
+
+	var nodes corev1.NodeList
+	if err := d.Client.List(ctx, &nodes); err != nil {
+		return nil, err
+	}
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		a.nodes[node.Name] = node
+		a.providerIDs[strings.ToLower(node.Spec.ProviderID)] = node.Name
+	}
+
+	ips, err := d.externalIPs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if ip.Address != "" {
+			a.externalIPs[normalizeIP(ip.Address)] = ip
+		}
+	}
+
+	egress, errs, err := d.Daemons.EgressStates(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a.egress = egress
+	for node, err := range errs {
+		a.add(SeverityWarning, "daemon-unreachable", "node/"+node, fmt.Sprintf("cannot read the egress rules of the node: %v", err))
+	}
+
+	a.report.Pods, a.report.ExternalIPs, a.report.Nodes = len(a.pods), len(ips), len(nodes.Items)
+	a.audit()
+	return &a.report, nil
+}
+
+// audit checks the collected state and sorts the findings, errors first.
+func (a *doctorAudit) audit() {
+	a.auditPods()
+	a.auditEgress()
+	a.auditExternalIPs()
+	sort.Slice(a.report.Findings, func(i, j int) bool {
+		fi, fj := a.report.Findings[i], a.report.Findings[j]
+		if fi.Severity != fj.Severity {
+			return fi.Severity == SeverityError
+		}
+		if fi.Kind != fj.Kind {
+			return fi.Kind < fj.Kind
+		}
+		return fi.Object < fj.Object
+	})
+}
+
+func (a *doctorAudit) add(severity string, kind string, object string, message string) {
+	a.report.Findings = append(a.report.Findings, Finding{Severity: severity, Kind: kind, Object: object, Message: message})
+}
+
+// active tells whether the pod is neither terminating nor terminated, and
+// was not asked to release its external IP.
+func active(pod *corev1.Pod) bool {
+	return pod.DeletionTimestamp.IsZero() && pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed && !releaseRequested(pod)
+}
+
+func (a *doctorAudit) auditPods() {
+	claims := make(map[string][]string)
+	for _, pod := range a.pods {
+		object := "pod/" + namespacedName(pod)
+		finalizers := parseFinalizers(pod)
+		hasFinalizers := len(finalizers) > 0 || len(parseDissociaters(pod)) > 0
+
+		if _, ok := a.nodes[pod.Spec.NodeName]; pod.Spec.NodeName != "" && !ok && hasFinalizers {
+			a.add(SeverityError, "stale-finalizer", object, fmt.Sprintf("node %s no longer exists, but the pod still has finalizers", pod.Spec.NodeName))
+		}
+		if !active(pod) {
+			if hasFinalizers && !pod.DeletionTimestamp.IsZero() && time.Since(pod.DeletionTimestamp.Time) > stuckTerminationPeriod {
+				a.add(SeverityWarning, "stuck-finalizer", object, fmt.Sprintf("terminating since %s with finalizers %v", pod.DeletionTimestamp.UTC().Format(time.RFC3339), pod.Finalizers))
+			}
+			continue
+		}
+
+		podIPs := parsePodIPs(pod)
+		for _, ip := range finalizers {
+			if !containsIP(podIPs, ip) {
+				a.add(SeverityWarning, "stale-finalizer", object, fmt.Sprintf("finalizer for pod IP %s, which the pod no longer has", ip))
+			}
+		}
+		for _, externalIP := range parseExternalIPs(pod) {
+			claims[normalizeIP(externalIP)] = append(claims[normalizeIP(externalIP)], namespacedName(pod))
+		}
+		if len(podIPs) == 0 {
+			continue
+		}
+
+		associated := parseAssociatedPodIP(pod) == joinPodIPs(podIPs)
+		associations, _ := parseAssociations(pod)
+		for _, as := range associations {
+			a.auditAssociation(pod, object, as, associated)
+		}
+	}
+
+	for externalIP, pods := range claims {
+		if len(pods) > 1 {
+			sort.Strings(pods)
+			a.add(SeverityWarning, "duplicate-claim", "externalip/"+externalIP, fmt.Sprintf("requested by pods %s", strings.Join(pods, ", ")))
+		}
+	}
+}
+
+// auditAssociation checks that the external IP is attached to the pod IP, and
+// that the node egress rules SNAT the pod IP, once the pod is associated.
+func (a *doctorAudit) auditAssociation(pod *corev1.Pod, object string, as association, associated bool) {
+	ip, ok := a.externalIPs[normalizeIP(as.externalIP)]
+	if !ok {
+		a.add(SeverityError, "unknown-ip", object, fmt.Sprintf("external IP %s is not a public IP of the resource group", as.externalIP))
+		return
+	}
+	switch {
+	case ip.Holder.PrivateIP == "" && associated:
+		a.add(SeverityError, "not-attached", object, fmt.Sprintf("external IP %s is not attached, but the pod is marked associated", as.externalIP))
+	case ip.Holder.PrivateIP == "":
+		a.add(SeverityWarning, "pending", object, fmt.Sprintf("external IP %s is not associated with pod IP %s yet", as.externalIP, as.localIP))
+	case !sameIP(ip.Holder.PrivateIP, as.localIP) && associated:
+		a.add(SeverityError, "wrong-ipconfig", object, fmt.Sprintf("external IP %s is attached to %s (private IP %s) instead of pod IP %s", as.externalIP, ip.Holder.ID, ip.Holder.PrivateIP, as.localIP))
+	case !sameIP(ip.Holder.PrivateIP, as.localIP):
+		a.add(SeverityWarning, "pending", object, fmt.Sprintf("external IP %s is still attached to %s (private IP %s)", as.externalIP, ip.Holder.ID, ip.Holder.PrivateIP))
+	}
+
+	if !associated {
+		return
+	}
+	state, ok := a.egress[pod.Spec.NodeName]
+	if !ok {
+		return
+	}
+	if owner := lookupIP(state.Pods, as.localIP); owner != namespacedName(pod) {
+		a.add(SeverityError, "missing-snat", object, fmt.Sprintf("node %s has no egress rule for pod IP %s", pod.Spec.NodeName, as.localIP))
+	}
+}
+
+// auditEgress checks that every egress rule belongs to an active pod of the
+// node that requests an external IP.
+func (a *doctorAudit) auditEgress() {
+	owners := make(map[string]map[string]string)
+	for _, pod := range a.pods {
+		if !active(pod) || len(parseExternalIPs(pod)) == 0 {
+			continue
+		}
+		if owners[pod.Spec.NodeName] == nil {
+			owners[pod.Spec.NodeName] = make(map[string]string)
+		}
+		for _, ip := range parsePodIPs(pod) {
+			owners[pod.Spec.NodeName][normalizeIP(ip)] = namespacedName(pod)
+		}
+	}
+	for node, state := range a.egress {
+		if _, ok := a.nodes[node]; !ok {
+			continue
+		}
+		for ip, pod := range state.Pods {
+			if owners[node][normalizeIP(ip)] != pod {
+				a.add(SeverityError, "stale-snat", "node/"+node, fmt.Sprintf("egress rule for pod IP %s of pod %s, which no longer requests an external IP on the node", ip, pod))
+			}
+		}
+	}
+}
+
+// auditExternalIPs checks that the external IPs attached to pod IPs of the
+// cluster nodes are requested by a pod.
+func (a *doctorAudit) auditExternalIPs() {
+	claimed := make(map[string]bool)
+	for _, pod := range a.pods {
+		if active(pod) {
+			for _, ip := range parseExternalIPs(pod) {
+				claimed[normalizeIP(ip)] = true
+			}
+		}
+	}
+	for address, ip := range a.externalIPs {
+		if ip.Holder.PrivateIP == "" || ip.Holder.Primary || claimed[address] {
+			continue
+		}
+		if node, ok := a.providerIDs[strings.ToLower(ip.Holder.ProviderID)]; ok && ip.Holder.ProviderID != "" {
+			a.add(SeverityWarning, "orphaned-ip", "externalip/"+address, fmt.Sprintf("attached to pod IP %s on node %s, but no pod requests it", ip.Holder.PrivateIP, node))
+		}
+	}
+}
+
+// lookupIP returns the value of the IP in a map keyed by IP addresses, which
+// may be written differently when they are IPv6 addresses.
+func lookupIP(m map[string]string, ip string) string {
+	for k, v := range m {
+		if sameIP(k, ip) {
+			return v
+		}
+	}
+	return ""
+}
+
+// normalizeIP writes an IP address in its canonical form.
+func normalizeIP(ip string) string {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		return parsed.String()
+	}
+	return ip
+}
+
+// DaemonClient reads the state of the nodes from the daemons, through the
+// auth proxy of their metrics server.
+type DaemonClient struct {
+	Client client.Client
+	// HTTP authenticates to the auth proxy, which has a self-signed
+	// certificate.
+	HTTP      *http.Client
+	Namespace string
+	Selector  labels.Selector
+	Port      int
+}
+
+// EgressStates returns the egress rules of every node that runs a daemon,
+// and the errors of the daemons that could not be read.
+func (d *DaemonClient) EgressStates(ctx context.Context) (map[string]providers.EgressState, map[string]error, error) {
+	var pods corev1.PodList
+	if err := d.Client.List(ctx, &pods, client.InNamespace(d.Namespace), client.MatchingLabelsSelector{Selector: d.Selector}); err != nil {
+		return nil, nil, err
+	}
+	states := make(map[string]providers.EgressState)
+	errs := make(map[string]error)
+	for _, pod := range pods.Items {
+		if pod.Spec.NodeName == "" || pod.Status.PodIP == "" {
+			continue
+		}
+		var state providers.EgressState
+		if err := d.get(ctx, &pod, EgressRulesPath, &state); err != nil {
+			errs[pod.Spec.NodeName] = err
+			continue
+		}
+		states[pod.Spec.NodeName] = state
+	}
+	return states, errs, nil
+}
+
+// get decodes the JSON served by the daemon at path into v.
+func (d *DaemonClient) get(ctx context.Context, pod *corev1.Pod, path string, v interface{}) error {
+	url := "https://" + net.JoinHostPort(pod.Status.PodIP, strconv.Itoa(d.Port)) + path
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := d.HTTP.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+const testProviderID = "azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/node-0"
+
+// testDoctorPod returns a running pod of node-0 with podIP, requesting
+// externalIP. It is marked associated and has the finalizers of podIP when
+// associated is set.
+func testDoctorPod(name string, podIP string, externalIP string, associated bool) *corev1.Pod {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        name,
+			Annotations: map[string]string{externalIPAnnotation: externalIP},
+		},
+		Spec: corev1.PodSpec{NodeName: "node-0"},
+		Status: corev1.PodStatus{
+			Phase:  corev1.PodRunning,
+			PodIP:  podIP,
+			PodIPs: []corev1.PodIP{{IP: podIP}},
+		},
+	}
+	if associated {
+		pod.Annotations[associatedPodIPAnnotation] = podIP
+		pod.Finalizers = testFinalizers(podIP)
+	}
+	return pod
+}
+
+// withPod applies change to the pod, e.g. to move it to another node.
+func withPod(pod *corev1.Pod, change func(*corev1.Pod)) *corev1.Pod {
+	change(pod)
+	return pod
+}
+
+// attached returns an external IP attached to the private IP of node-0.
+func attached(address string, privateIP string) providers.ExternalIP {
+	return providers.ExternalIP{
+		Name:    address,
+		Address: address,
+		Holder:  providers.Holder{ID: "ipconfig-" + privateIP, PrivateIP: privateIP, ProviderID: testProviderID},
+	}
+}
+
+func TestDoctorAudit(t *testing.T) {
+	deleted := metav1.NewTime(time.Now().Add(-2 * stuckTerminationPeriod))
+	tests := []struct {
+		name        string
+		pods        []*corev1.Pod
+		externalIPs []providers.ExternalIP
+		// egress are the pod IPs with egress rules on node-0.
+		egress map[string]string
+		want   []Finding
+	}{
+		{
+			name:        "consistent",
+			pods:        []*corev1.Pod{testDoctorPod("web", "10.240.0.10", "20.10.0.1", true)},
+			externalIPs: []providers.ExternalIP{attached("20.10.0.1", "10.240.0.10")},
+			egress:      map[string]string{"10.240.0.10": "default/web"},
+		},
+		{
+			name:        "not associated yet",
+			pods:        []*corev1.Pod{testDoctorPod("web", "10.240.0.10", "20.10.0.1", false)},
+			externalIPs: []providers.ExternalIP{{Name: "20.10.0.1", Address: "20.10.0.1"}},
+			want: []Finding{
+				{SeverityWarning, "pending", "pod/default/web", "external IP 20.10.0.1 is not associated with pod IP 10.240.0.10 yet"},
+			},
+		},
+		{
+			name:        "still attached to the previous holder",
+			pods:        []*corev1.Pod{testDoctorPod("web", "10.240.0.10", "20.10.0.1", false)},
+			externalIPs: []providers.ExternalIP{attached("20.10.0.1", "10.240.0.9")},
+			want: []Finding{
+				{SeverityWarning, "pending", "pod/default/web", "external IP 20.10.0.1 is still attached to ipconfig-10.240.0.9 (private IP 10.240.0.9)"},
+			},
+		},
+		{
+			name:        "not attached",
+			pods:        []*corev1.Pod{testDoctorPod("web", "10.240.0.10", "20.10.0.1", true)},
+			externalIPs: []providers.ExternalIP{{Name: "20.10.0.1", Address: "20.10.0.1"}},
+			egress:      map[string]string{"10.240.0.10": "default/web"},
+			want: []Finding{
+				{SeverityError, "not-attached", "pod/default/web", "external IP 20.10.0.1 is not attached, but the pod is marked associated"},
+			},
+		},
+		{
+			name:        "wrong IP configuration",
+			pods:        []*corev1.Pod{testDoctorPod("web", "10.240.0.10", "20.10.0.1", true)},
+			externalIPs: []providers.ExternalIP{attached("20.10.0.1", "10.240.0.9")},
+			egress:      map[string]string{"10.240.0.10": "default/web"},
+			want: []Finding{
+				{SeverityError, "wrong-ipconfig", "pod/default/web", "external IP 20.10.0.1 is attached to ipconfig-10.240.0.9 (private IP 10.240.0.9) instead of pod IP 10.240.0.10"},
+			},
+		},
+		{
+			name: "unknown external IP",
+			pods: []*corev1.Pod{testDoctorPod("web", "10.240.0.10", "20.10.0.1", false)},
+			want: []Finding{
+				{SeverityError, "unknown-ip", "pod/default/web", "external IP 20.10.0.1 is not a public IP of the resource group"},
+			},
+		},
+		{
+			name:        "missing SNAT rule",
+			pods:        []*corev1.Pod{testDoctorPod("web", "10.240.0.10", "20.10.0.1", true)},
+			externalIPs: []providers.ExternalIP{attached("20.10.0.1", "10.240.0.10")},
+			egress:      map[string]string{},
+			want: []Finding{
+				{SeverityError, "missing-snat", "pod/default/web", "node node-0 has no egress rule for pod IP 10.240.0.10"},
+			},
+		},
+		{
+			name: "stale SNAT rule",
+			pods: []*corev1.Pod{withPod(testDoctorPod("web", "10.240.0.10", "20.10.0.1", false), func(pod *corev1.Pod) {
+				pod.Status.Phase = corev1.PodSucceeded
+			})},
+			externalIPs: []providers.ExternalIP{{Name: "20.10.0.1", Address: "20.10.0.1"}},
+			egress:      map[string]string{"10.240.0.10": "default/web"},
+			want: []Finding{
+				{SeverityError, "stale-snat", "node/node-0", "egress rule for pod IP 10.240.0.10 of pod default/web, which no longer requests an external IP on the node"},
+			},
+		},
+		{
+			name: "finalizers of a deleted node",
+			pods: []*corev1.Pod{withPod(testDoctorPod("web", "10.240.0.10", "20.10.0.1", true), func(pod *corev1.Pod) {
+				pod.Spec.NodeName = "node-1"
+			})},
+			externalIPs: []providers.ExternalIP{attached("20.10.0.1", "10.240.0.10")},
+			want: []Finding{
+				{SeverityError, "stale-finalizer", "pod/default/web", "node node-1 no longer exists, but the pod still has finalizers"},
+			},
+		},
+		{
+			name: "finalizer of a previous pod IP",
+			pods: []*corev1.Pod{withPod(testDoctorPod("web", "10.240.0.11", "20.10.0.1", false), func(pod *corev1.Pod) {
+				pod.Finalizers = testFinalizers("10.240.0.10")
+			})},
+			externalIPs: []providers.ExternalIP{{Name: "20.10.0.1", Address: "20.10.0.1"}},
+			want: []Finding{
+				{SeverityWarning, "pending", "pod/default/web", "external IP 20.10.0.1 is not associated with pod IP 10.240.0.11 yet"},
+				{SeverityWarning, "stale-finalizer", "pod/default/web", "finalizer for pod IP 10.240.0.10, which the pod no longer has"},
+			},
+		},
+		{
+			name: "stuck terminating",
+			pods: []*corev1.Pod{withPod(testDoctorPod("web", "10.240.0.10", "20.10.0.1", false), func(pod *corev1.Pod) {
+				pod.DeletionTimestamp = &deleted
+				pod.Finalizers = []string{finalizerPrefix + "-10.240.0.10"}
+			})},
+			externalIPs: []providers.ExternalIP{{Name: "20.10.0.1", Address: "20.10.0.1"}},
+			want: []Finding{
+				{SeverityWarning, "stuck-finalizer", "pod/default/web", "terminating since " + deleted.UTC().Format(time.RFC3339) + " with finalizers [" + finalizerPrefix + "-10.240.0.10]"},
+			},
+		},
+		{
+			name: "requested by several pods",
+			pods: []*corev1.Pod{
+				testDoctorPod("web", "10.240.0.10", "20.10.0.1", true),
+				testDoctorPod("api", "10.240.0.11", "20.10.0.1", false),
+			},
+			externalIPs: []providers.ExternalIP{attached("20.10.0.1", "10.240.0.10")},
+			egress:      map[string]string{"10.240.0.10": "default/web"},
+			want: []Finding{
+				{SeverityWarning, "duplicate-claim", "externalip/20.10.0.1", "requested by pods default/api, default/web"},
+				{SeverityWarning, "pending", "pod/default/api", "external IP 20.10.0.1 is still attached to ipconfig-10.240.0.10 (private IP 10.240.0.10)"},
+			},
+		},
+		{
+			name:        "orphaned external IP",
+			externalIPs: []providers.ExternalIP{attached("20.10.0.1", "10.240.0.10")},
+			want: []Finding{
+				{SeverityWarning, "orphaned-ip", "externalip/20.10.0.1", "attached to pod IP 10.240.0.10 on node node-0, but no pod requests it"},
+			},
+		},
+		{
+			name: "external IP of the primary IP of a node",
+			externalIPs: []providers.ExternalIP{{Name: "20.10.0.1", Address: "20.10.0.1", Holder: providers.Holder{
+				ID: "ipconfig-10.240.0.4", PrivateIP: "10.240.0.4", Primary: true, ProviderID: testProviderID,
+			}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node-0"},
+				Spec:       corev1.NodeSpec{ProviderID: testProviderID},
+			}
+			a := &doctorAudit{
+				pods:        tt.pods,
+				nodes:       map[string]*corev1.Node{"node-0": node},
+				providerIDs: map[string]string{strings.ToLower(testProviderID): "node-0"},
+				externalIPs: make(map[string]providers.ExternalIP),
+				egress:      make(map[string]providers.EgressState),
+			}
+			for _, ip := range tt.externalIPs {
+				a.externalIPs[ip.Address] = ip
+			}
+			if tt.egress != nil {
+				a.egress["node-0"] = providers.EgressState{Node: "node-0", Pods: tt.egress}
+			}
+
+			a.audit()
+			if !reflect.DeepEqual(a.report.Findings, tt.want) {
+				t.Errorf("findings = %+v, want %+v", a.report.Findings, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+// DefaultEgressDriftCheckPeriod is how often the daemon compares the egress
+// rules of its node with the desired ones.
+const DefaultEgressDriftCheckPeriod = 30 * time.Second
+
+// egressDriftWatcher periodically repairs the egress rules of the node that
+// other agents, e.g. kube-proxy, the CNI or hardening scripts, flushed or
+// reordered. It counts the repairs and records them as node events.
+type egressDriftWatcher struct {
+	reader client.Reader
+	// pods reads the pods of the node from the cache of the daemon.
+	pods       client.Reader
+	reconciler *PodAssociater
+	associater providers.EgressRules
+	recorder   record.EventRecorder
+	node       string
+	period     time.Duration
+	log        logr.Logger
+
+	// adopted is set once the pods of the node were all reconciled, after
+	// which the rules of the pod IPs no pod claims are removed.
+	adopted bool
+}
+
+func newEgressDriftWatcher(reader client.Reader, pods client.Reader, reconciler *PodAssociater, associater providers.EgressRules, recorder record.EventRecorder, node string, period time.Duration) *egressDriftWatcher {
+	return &egressDriftWatcher{
+		reader:     reader,
+		pods:       pods,
+		reconciler: reconciler,
+		associater: associater,
+		recorder:   recorder,
+		node:       node,
+		period:     period,
+		log:        ctrl.Log.WithName("egress-drift"),
+	}
+}
+
+// Start implements manager.Runnable.
+func (w *egressDriftWatcher) Start(ctx context.Context) error {
+	ticker := time.NewTicker(w.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		if err := w.adopt(ctx); err != nil {
+			w.log.Error(err, "error adopting the egress rules of the pods")
+		}
+		drifts, err := w.associater.RepairEgressRules(ctx)
+		if err != nil {
+			w.log.Error(err, "error repairing the egress rules")
+		}
+		w.report(ctx, drifts)
+	}
+}
+
+// adopt gives the pod IPs the pods of the node claim, through their
+// associatedpodip annotation or their finalizers, to the associater, so their
+// rules are never removed. The rules of the other pod IPs are only removed
+// once every claiming pod was reconciled since the daemon started, since the
+// daemon only knows the rules it added itself.
+func (w *egressDriftWatcher) adopt(ctx context.Context) error {
+	var pods corev1.PodList
+	if err := w.pods.List(ctx, &pods); err != nil {
+		return err
+	}
+	claimed := make(map[string]string)
+	var keys []string
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Spec.NodeName != w.node {
+			continue
+		}
+		ips := claimedPodIPs(pod)
+		if len(ips) == 0 {
+			continue
+		}
+		keys = append(keys, namespacedName(pod))
+		for _, ip := range ips {
+			claimed[ip] = namespacedName(pod)
+		}
+	}
+	if !w.adopted && !w.reconciler.reconciledAll(keys) {
+		return nil
+	}
+	w.adopted = true
+	return w.associater.AdoptEgressRules(claimed)
+}
+
+// claimedPodIPs returns the pod IPs the pod holds an external IP for, or may
+// still have egress rules for: the associated ones and the ones of its
+// finalizers.
+func claimedPodIPs(pod *corev1.Pod) []string {
+	var ips []string
+	if associated := parseAssociatedPodIP(pod); associated != "" {
+		ips = strings.Split(associated, ",")
+	}
+	ips = append(ips, parseFinalizers(pod)...)
+	ips = append(ips, parseDissociaters(pod)...)
+	for i, ip := range ips {
+		ips[i] = normalizeIP(ip)
+	}
+	return ips
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every daemon
+// repairs its own node.
+func (w *egressDriftWatcher) NeedLeaderElection() bool {
+	return false
+}
+
+// report counts the repaired drifts and records them as an event on the
+// node.
+func (w *egressDriftWatcher) report(ctx context.Context, drifts []providers.EgressDrift) {
+	if len(drifts) == 0 {
+		return
+	}
+	messages := make([]string, len(drifts))
+	for i, d := range drifts {
+		egressRuleRepairs.WithLabelValues(w.node, d.Kind).Inc()
+		messages[i] = d.Message
+	}
+	w.log.Info("repaired the egress rules", "drifts", messages)
+
+	var node corev1.Node
+	if err := w.reader.Get(ctx, client.ObjectKey{Name: w.node}, &node); err != nil {
+		w.log.Error(err, "error getting the node to record the repair", "node", w.node)
+		return
+	}
+	w.recorder.Event(&node, corev1.EventTypeWarning, eventEgressRulesRepaired, fmt.Sprintf("Repaired the egress rules: %s", strings.Join(messages, "; ")))
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	fakeclient "sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+// adoptedEgressRules records the pod IPs given to AdoptEgressRules.
+type adoptedEgressRules struct {
+	providers.EgressRules
+	claimed   map[string]string
+	adoptions int
+}
+
+func (e *adoptedEgressRules) AdoptEgressRules(claimed map[string]string) error {
+	e.claimed = claimed
+	e.adoptions++
+	return nil
+}
+
+func TestEgressDriftAdopt(t *testing.T) {
+	ctx := context.Background()
+	web := testDoctorPod("web", "10.240.0.10", "20.10.0.1", true)
+	api := withPod(testDoctorPod("api", "10.240.0.11", "20.10.0.2", false), func(pod *corev1.Pod) {
+		pod.Finalizers = testFinalizers("10.240.0.9")
+	})
+	other := withPod(testDoctorPod("other", "10.240.1.10", "20.10.0.3", true), func(pod *corev1.Pod) {
+		pod.Spec.NodeName = "node-1"
+	})
+	unassociated := testDoctorPod("unassociated", "10.240.0.12", "20.10.0.4", false)
+	c := fakeclient.NewClientBuilder().WithObjects(web, api, other, unassociated).Build()
+	reconciler := newPodAssociater(nil, c, nil, nil, nil, DefaultBackoff, DefaultNodeNotReadyTimeout, DefaultHolderCheckInterval)
+	egress := &adoptedEgressRules{}
+	w := newEgressDriftWatcher(c, c, &reconciler, egress, nil, "node-0", time.Second)
+
+	reconciler.markReconciled(types.NamespacedName{Namespace: "default", Name: "web"})
+	if err := w.adopt(ctx); err != nil {
+		t.Fatalf("adopt: %v", err)
+	}
+	if egress.adoptions != 0 {
+		t.Errorf("adopted the rules before pod default/api was reconciled")
+	}
+
+	reconciler.markReconciled(types.NamespacedName{Namespace: "default", Name: "api"})
+	if err := w.adopt(ctx); err != nil {
+		t.Fatalf("adopt: %v", err)
+	}
+	want := map[string]string{"10.240.0.10": "default/web", "10.240.0.9": "default/api"}
+	if egress.adoptions != 1 || !reflect.DeepEqual(egress.claimed, want) {
+		t.Errorf("adopted %d times the claims %v, want once %v", egress.adoptions, egress.claimed, want)
+	}
+
+	// The pods are not awaited again once the rules were adopted.
+	reconciler.forget(types.NamespacedName{Namespace: "default", Name: "web"})
+	if err := w.adopt(ctx); err != nil {
+		t.Fatalf("adopt: %v", err)
+	}
+	if egress.adoptions != 2 {
+		t.Errorf("adopted %d times, want the claims updated on every check", egress.adoptions)
+	}
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+// EgressRulesPath is the path of the daemon metrics server that serves the
+// egress rules of its node, as a providers.EgressState. It is protected by
+// the auth proxy of the metrics server.
+const EgressRulesPath = "/egress-rules"
+
+//+kubebuilder:rbac:urls=/egress-rules,verbs=get
+
+// egressRulesHandler serves the egress rules programmed on the node.
+func egressRulesHandler(associater providers.EgressRules) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		state, err := associater.EgressState()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		state.Node = os.Getenv("NODE_NAME")
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(state); err != nil {
+			log.Log.Error(err, "error writing the egress rules")
+		}
+	})
+}
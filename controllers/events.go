@@ -0,0 +1,66 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+// Reasons of the events recorded on pods.
+const (
+	eventAssociating     = "Associating"
+	eventAssociated      = "Associated"
+	eventRetryingIPInUse = "RetryingIPInUse"
+	eventStuck           = "Stuck"
+	eventLost            = "ExternalIPLost"
+	eventHandedOff       = "HandedOff"
+	eventNodeGone        = "NodeGone"
+	eventDissociated     = "Dissociated"
+	eventFinalized       = "Finalized"
+	eventReleased        = "Released"
+	eventProviderError   = "ProviderError"
+)
+
+// Reasons of the events recorded on nodes.
+const (
+	eventEgressRulesRepaired = "EgressRulesRepaired"
+)
+
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
+
+// recordProviderError records a ProviderError event on the pod, with the
+// provider error code when there is one.
+func recordProviderError(recorder record.EventRecorder, pod *corev1.Pod, action string, err error) {
+	if code := providers.ErrorCode(err); code != "" {
+		recorder.Eventf(pod, corev1.EventTypeWarning, eventProviderError, "Error %s, code %s: %v", action, code, err)
+		return
+	}
+	recorder.Eventf(pod, corev1.EventTypeWarning, eventProviderError, "Error %s: %v", action, err)
+}
+
+// describeIPs formats the IPs of a pod for an event message.
+func describeIPs(ips []string) string {
+	if len(ips) == 1 {
+		return ips[0]
+	}
+	return fmt.Sprintf("%v", ips)
+}
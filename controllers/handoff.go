@@ -0,0 +1,149 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+// DefaultNodeNotReadyTimeout is how long the node of the pod holding an
+// external IP may be NotReady before the IP is handed off to another pod.
+const DefaultNodeNotReadyTimeout = 2 * time.Minute
+
+// handoffRetryDelay is the delay before associating the external IP again
+// once it was detached from its previous holder.
+const handoffRetryDelay = time.Second
+
+// handoff detaches the external IP from its holder when the holder is a pod
+// IP that no longer belongs to a legitimate pod: the pod is gone, terminating
+// or no longer requests the IP, or its node has been NotReady for longer than
+// the timeout. It returns whether the IP was detached.
+func (r *PodAssociater) handoff(ctx context.Context, pod *corev1.Pod, externalIP string) (bool, error) {
+	holder, err := r.associater.Holder(ctx, externalIP)
+	if err != nil {
+		return false, err
+	}
+	reason, err := r.handoffReason(ctx, pod, externalIP, holder)
+	if err != nil || reason == "" {
+		return false, err
+	}
+
+	r.logger(ctx).Info("detaching external IP from its previous holder", "pod.Name", pod.Name, "externalIP", externalIP, "holder", holder.ID, "reason", reason)
+	released, err := r.associater.Release(ctx, externalIP, holder.ID)
+	if err != nil {
+		r.recordProviderError(pod, fmt.Sprintf("detaching external IP %s from %s", externalIP, holder.ID), err)
+		return false, err
+	}
+	if !released {
+		return false, nil
+	}
+	r.recorder.Eventf(pod, corev1.EventTypeNormal, eventHandedOff, "Detached external IP %s from %s: %s", externalIP, holder.ID, reason)
+	return true, nil
+}
+
+// handoffReason returns why the external IP can be taken from its holder, or
+// an empty string when the holder is legitimate or unknown.
+func (r *PodAssociater) handoffReason(ctx context.Context, pod *corev1.Pod, externalIP string, holder providers.Holder) (string, error) {
+	if holder.PrivateIP == "" || holder.Primary || holder.ProviderID == "" {
+		return "", nil
+	}
+	for _, podIP := range parsePodIPs(pod) {
+		if sameIP(podIP, holder.PrivateIP) {
+			return "", nil
+		}
+	}
+
+	var nodes corev1.NodeList
+	if err := (*r.client).List(ctx, &nodes); err != nil {
+		return "", err
+	}
+	var node *corev1.Node
+	for i := range nodes.Items {
+		if strings.EqualFold(nodes.Items[i].Spec.ProviderID, holder.ProviderID) {
+			node = &nodes.Items[i]
+			break
+		}
+	}
+	// Machines that are not nodes of the cluster are left alone.
+	if node == nil {
+		return "", nil
+	}
+
+	// The cache only has the pods of this node. Read the pods of the other
+	// node from the watch cache of the API server rather than from etcd.
+	var pods corev1.PodList
+	if err := r.reader.List(ctx, &pods, &client.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("spec.nodeName", node.Name),
+		Raw:           &metav1.ListOptions{ResourceVersion: "0"},
+	}); err != nil {
+		return "", err
+	}
+	var previous *corev1.Pod
+	for i := range pods.Items {
+		p := &pods.Items[i]
+		if p.Spec.HostNetwork || p.Status.Phase == corev1.PodSucceeded || p.Status.Phase == corev1.PodFailed {
+			continue
+		}
+		for _, podIP := range parsePodIPs(p) {
+			if sameIP(podIP, holder.PrivateIP) {
+				previous = p
+			}
+		}
+	}
+
+	switch {
+	case previous == nil:
+		return fmt.Sprintf("pod IP %s no longer belongs to a pod on node %s", holder.PrivateIP, node.Name), nil
+	case !previous.DeletionTimestamp.IsZero():
+		return fmt.Sprintf("pod %s is terminating", namespacedName(previous)), nil
+	case !containsIP(parseExternalIPs(previous), externalIP) || releaseRequested(previous):
+		return fmt.Sprintf("pod %s no longer requests the external IP", namespacedName(previous)), nil
+	}
+	if since, notReady := nodeNotReadySince(node); notReady && r.nodeNotReadyTimeout >= 0 && time.Since(since) > r.nodeNotReadyTimeout {
+		return fmt.Sprintf("node %s of pod %s is NotReady since %s", node.Name, namespacedName(previous), since.UTC().Format(time.RFC3339)), nil
+	}
+	return "", nil
+}
+
+// nodeNotReadySince returns when the node became NotReady, or unknown.
+func nodeNotReadySince(node *corev1.Node) (time.Time, bool) {
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			return c.LastTransitionTime.Time, c.Status != corev1.ConditionTrue
+		}
+	}
+	return time.Time{}, false
+}
+
+func containsIP(ips []string, ip string) bool {
+	for _, i := range ips {
+		if sameIP(i, ip) {
+			return true
+		}
+	}
+	return false
+}
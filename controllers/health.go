@@ -0,0 +1,39 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"net/http"
+
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+// addEgressRulesChecks makes the daemon live while it can read the egress
+// rules of its node, and ready while they match the desired state. The
+// checks do not change the rules, the egress drift watcher repairs them.
+func addEgressRulesChecks(mgr ctrl.Manager, associater providers.EgressRules) error {
+	if err := mgr.AddHealthzCheck("egress-rules", func(req *http.Request) error {
+		return associater.CheckEgressBackend(req.Context())
+	}); err != nil {
+		return err
+	}
+	return mgr.AddReadyzCheck("egress-rules", func(req *http.Request) error {
+		return associater.CheckEgressRules(req.Context())
+	})
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+// DefaultLocalNetworksResyncPeriod is how often the local networks are
+// updated with the pod CIDRs of the nodes.
+const DefaultLocalNetworksResyncPeriod = 5 * time.Minute
+
+// configuredLocalNetworks returns the configured local networks and service
+// CIDRs, or the networks listed in the LOCAL_NETWORKS and SERVICE_CIDRS env
+// vars when they are not empty. The service CIDRs cannot be read from the API
+// server, so they have to be configured.
+func configuredLocalNetworks(localNetworks, serviceCIDRs []string) []string {
+	if env := parseNetworks(os.Getenv("LOCAL_NETWORKS")); len(env) > 0 {
+		localNetworks = env
+	}
+	if env := parseNetworks(os.Getenv("SERVICE_CIDRS")); len(env) > 0 {
+		serviceCIDRs = env
+	}
+	return append(append([]string{}, localNetworks...), serviceCIDRs...)
+}
+
+// parseNetworks splits a list of networks separated by commas, semicolons or
+// spaces.
+func parseNetworks(s string) []string {
+	return strings.FieldsFunc(s, func(c rune) bool {
+		return c == ',' || c == ';' || c == ' ' || c == '\t' || c == '\n'
+	})
+}
+
+// localNetworkWatcher periodically updates the local networks of the node
+// with the configured networks and the pod CIDRs of the cluster nodes. The
+// provider adds the networks it discovers itself, and only reprograms the
+// node when they changed.
+type localNetworkWatcher struct {
+	reader     client.Reader
+	associater providers.Associater
+	configured []string
+	period     time.Duration
+	log        logr.Logger
+}
+
+func newLocalNetworkWatcher(reader client.Reader, associater providers.Associater, configured []string, period time.Duration) *localNetworkWatcher {
+	return &localNetworkWatcher{
+		reader:     reader,
+		associater: associater,
+		configured: configured,
+		period:     period,
+		log:        ctrl.Log.WithName("local-networks"),
+	}
+}
+
+// Start implements manager.Runnable.
+func (w *localNetworkWatcher) Start(ctx context.Context) error {
+	ticker := time.NewTicker(w.period)
+	defer ticker.Stop()
+	for {
+		w.update(ctx)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable, every daemon
+// updates its own node.
+func (w *localNetworkWatcher) NeedLeaderElection() bool {
+	return false
+}
+
+func (w *localNetworkWatcher) update(ctx context.Context) {
+	podCIDRs, err := w.podCIDRs(ctx)
+	if err != nil {
+		w.log.Error(err, "error listing the pod CIDRs of the nodes")
+		return
+	}
+	localNetworks := append(append([]string{}, w.configured...), podCIDRs...)
+	if err := w.associater.SetLocalNetworks(ctx, localNetworks); err != nil {
+		w.log.Error(err, "error setting local networks", "localNetworks", localNetworks)
+	}
+}
+
+// podCIDRs returns the pod CIDRs allocated to the nodes, which together make
+// up the cluster pod CIDRs. The nodes are read from the cache, which the
+// handoff shares.
+func (w *localNetworkWatcher) podCIDRs(ctx context.Context) ([]string, error) {
+	var nodes corev1.NodeList
+	if err := w.reader.List(ctx, &nodes); err != nil {
+		return nil, err
+	}
+	var podCIDRs []string
+	for _, node := range nodes.Items {
+		if len(node.Spec.PodCIDRs) > 0 {
+			podCIDRs = append(podCIDRs, node.Spec.PodCIDRs...)
+		} else if node.Spec.PodCIDR != "" {
+			podCIDRs = append(podCIDRs, node.Spec.PodCIDR)
+		}
+	}
+	return podCIDRs, nil
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Reasons of the association retries metric.
+const (
+	retryReasonIPInUse       = "ip_in_use"
+	retryReasonProviderError = "provider_error"
+)
+
+var (
+	associationLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "podexternalip_association_latency_seconds",
+		Help:    "Time from the daemon seeing the IP of a pod assigned to the pod being first associated with its external IP.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	})
+
+	associationRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "podexternalip_association_retries_total",
+		Help: "Number of association attempts that are retried by reason.",
+	}, []string{"reason"})
+
+	associationsPerNode = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "podexternalip_associations",
+		Help: "Number of pods associated with their external IP by node.",
+	}, []string{"node"})
+
+	egressRuleRepairs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "podexternalip_egress_rule_repairs_total",
+		Help: "Number of drifts of the node egress rules that were repaired, by node and kind of drift.",
+	}, []string{"node", "kind"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(associationLatency, associationRetries, associationsPerNode, egressRuleRepairs)
+}
+
+// seenPodIPs is when the daemon first saw the pod IPs of a pod.
+type seenPodIPs struct {
+	podIPs string
+	time   time.Time
+}
+
+// seePodIPs records when the pod IPs of a pod that is not associated are
+// first seen. The pod does not record when its IPs were assigned, and its
+// start time is set before its network is set up, so the latency is measured
+// from the first reconcile with the pod IPs, which follows their assignment
+// closely.
+func (r *PodAssociater) seePodIPs(pod *corev1.Pod, podIPs string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if seen, ok := r.seen[namespacedName(pod)]; !ok || seen.podIPs != podIPs {
+		r.seen[namespacedName(pod)] = seenPodIPs{podIPs: podIPs, time: time.Now()}
+	}
+}
+
+// observeAssociationLatency records the time since the pod IPs of an
+// associated pod were seen when first is set, and forgets them. It is only
+// set on the first association of a pod, not when the pod is associated
+// again, e.g. after a restart of the daemon or a new pod IP.
+func (r *PodAssociater) observeAssociationLatency(pod *corev1.Pod, first bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seen, ok := r.seen[namespacedName(pod)]
+	delete(r.seen, namespacedName(pod))
+	if ok && first {
+		associationLatency.Observe(time.Since(seen.time).Seconds())
+	}
+}
+
+// forgetSeenPodIPs forgets when the pod IPs of a pod that is being deleted
+// were seen, since it will not be associated anymore.
+func (r *PodAssociater) forgetSeenPodIPs(pod *corev1.Pod) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.seen, namespacedName(pod))
+}
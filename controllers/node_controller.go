@@ -0,0 +1,173 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	"github.com/yingeli/pod-external-ip-operator/pkg/tracing"
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+// podNodeNameField indexes the pods by the name of their node.
+const podNodeNameField = "spec.nodeName"
+
+// DefaultNodeMachineCheckPeriod is how often the machine of a NotReady node
+// is checked.
+const DefaultNodeMachineCheckPeriod = time.Minute
+
+// NodeReconciler releases the external IPs of the pods of the nodes that are
+// deleted, or whose machine no longer exists, and removes their dissociater
+// finalizers. There is no daemon left on those nodes to dissociate the pods.
+type NodeReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// MachineCheckPeriod is how often the machine of a NotReady node is
+	// checked, DefaultNodeMachineCheckPeriod when zero.
+	MachineCheckPeriod time.Duration
+
+	// Providers finalize the external IPs of the pods and check the
+	// machines of the nodes.
+	Providers Providers
+
+	provider providers.Finalizer
+	log      logr.Logger
+}
+
+//+kubebuilder:rbac:groups=core,resources=nodes,verbs=get;list;watch
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;update;patch
+
+// Reconcile releases the pods of a node that is gone. The machine of a node
+// is only checked while the node is NotReady.
+func (r *NodeReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	var reason string
+	var node corev1.Node
+	if err := r.Get(ctx, req.NamespacedName, &node); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+		reason = fmt.Sprintf("node %s was deleted", req.Name)
+	} else {
+		if _, notReady := nodeNotReadySince(&node); !notReady {
+			return ctrl.Result{}, nil
+		}
+		exists, err := r.provider.MachineExists(ctx, &node)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if exists {
+			return ctrl.Result{RequeueAfter: r.MachineCheckPeriod}, nil
+		}
+		reason = fmt.Sprintf("the machine of node %s no longer exists", node.Name)
+	}
+
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods, client.MatchingFields{podNodeNameField: req.Name}); err != nil {
+		return ctrl.Result{}, err
+	}
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if len(parseFinalizers(pod)) == 0 && len(parseDissociaters(pod)) == 0 {
+			continue
+		}
+		if err := r.release(ctx, pod, reason); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+	return ctrl.Result{}, nil
+}
+
+// release finalizes the associations of a pod of a node that is gone, and
+// removes its dissociater finalizers.
+func (r *NodeReconciler) release(ctx context.Context, pod *corev1.Pod, reason string) (err error) {
+	ctx, span := tracing.Start(ctx, "NodeReconciler.release", attribute.String("pod", namespacedName(pod)), attribute.String("node", pod.Spec.NodeName))
+	defer func() { tracing.End(span, err) }()
+
+	finalizers := parseFinalizers(pod)
+	original := pod.DeepCopy()
+	if err := finalize(ctx, r.provider, pod); err != nil {
+		recordProviderError(r.Recorder, pod, "finalizing the pod of a node that is gone", err)
+		return err
+	}
+	removeDissociater(pod)
+	removeAssociatedPodIP(pod)
+	if err := r.Patch(ctx, pod, client.StrategicMergeFrom(original)); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	tracing.Logger(ctx, r.log).Info("released pod of a node that is gone", "pod", namespacedName(pod), "reason", reason)
+	if len(finalizers) > 0 {
+		r.Recorder.Eventf(pod, corev1.EventTypeNormal, eventNodeGone, "Released external IP %s from pod IP %s: %s", parseExternalIP(pod), describeIPs(finalizers), reason)
+	} else {
+		r.Recorder.Eventf(pod, corev1.EventTypeNormal, eventNodeGone, "Removed the dissociater finalizers: %s", reason)
+	}
+	return nil
+}
+
+// podToNode enqueues the node of the terminating pods that have finalizers,
+// so the pods of nodes that were deleted while the controller was down are
+// released too.
+func podToNode(obj client.Object) []reconcile.Request {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || pod.Spec.NodeName == "" || pod.DeletionTimestamp.IsZero() {
+		return nil
+	}
+	if len(parseFinalizers(pod)) == 0 && len(parseDissociaters(pod)) == 0 {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: pod.Spec.NodeName}}}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *NodeReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	provider := newProviderFinalizer(mgr.GetClient(), r.Providers)
+	if err := provider.Initialize(context.Background()); err != nil {
+		return err
+	}
+	r.provider = provider
+	r.log = ctrl.Log.WithName("node-reconciler")
+	if r.MachineCheckPeriod == 0 {
+		r.MachineCheckPeriod = DefaultNodeMachineCheckPeriod
+	}
+
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &corev1.Pod{}, podNodeNameField, func(obj client.Object) []string {
+		return []string{obj.(*corev1.Pod).Spec.NodeName}
+	}); err != nil {
+		return err
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Node{}).
+		Watches(&source.Kind{Type: &corev1.Pod{}}, handler.EnqueueRequestsFromMapFunc(podToNode)).
+		Complete(r)
+}
@@ -21,17 +21,20 @@ import (
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/log"
-
-	"github.com/yingeli/pod-external-ip-operator/providers/azurecni"
 )
 
 // PodReconciler reconciles a Pod object
 type PodReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+
+	// Providers finalize the external IPs of the pods.
+	Providers Providers
 
 	// yingeli
 	finalizer PodFinalizer
@@ -67,11 +70,11 @@ func (r *PodReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.R
 // SetupWithManager sets up the controller with the Manager.
 func (r *PodReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	// yingeli
-	provider := azurecni.NewFinalizer()
+	provider := newProviderFinalizer(mgr.GetClient(), r.Providers)
 	if err := provider.Initialize(context.Background()); err != nil {
 		return err
 	}
-	r.finalizer = newPodFinalizer(&r.Client, &provider)
+	r.finalizer = newPodFinalizer(&r.Client, provider, r.Recorder)
 
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&corev1.Pod{}).
@@ -17,24 +17,138 @@ limitations under the License.
 package controllers
 
 import (
+	"fmt"
+	"net"
+	"sort"
 	"strings"
 
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilnet "k8s.io/utils/net"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 )
 
 const (
 	externalIPAnnotation      = "podexternalip.yglab.eu.org/externalip"
 	associatedPodIPAnnotation = "podexternalip.yglab.eu.org/associatedpodip"
+	// releaseAnnotation asks the daemon to release the external IP of a
+	// running pod, so it can be moved to another pod.
+	releaseAnnotation = "podexternalip.yglab.eu.org/release"
 
 	finalizerPrefix   = "azurecni.podexternalip.yglab.eu.org/finalizer"
 	dissociaterPrefix = "azurecni.podexternalip.yglab.eu.org/dissociater"
+
+	// externalIPCondition is the pod condition, and readiness gate, that is
+	// true while the pod egresses from its external IP.
+	externalIPCondition corev1.PodConditionType = "podexternalip.yglab.eu.org/associated"
 )
 
 func parseExternalIP(pod *corev1.Pod) string {
 	return pod.Annotations[externalIPAnnotation]
 }
 
+// parseExternalIPs returns the external IPs requested by the pod. A
+// dual-stack pod may request one IPv4 and one IPv6 address, separated by a
+// comma.
+func parseExternalIPs(pod *corev1.Pod) []string {
+	var ips []string
+	for _, ip := range strings.Split(parseExternalIP(pod), ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// parsePodIPs returns the IPs allocated to the pod, one per IP family.
+func parsePodIPs(pod *corev1.Pod) []string {
+	var ips []string
+	for _, ip := range pod.Status.PodIPs {
+		ips = append(ips, ip.IP)
+	}
+	if len(ips) == 0 && pod.Status.PodIP != "" {
+		ips = append(ips, pod.Status.PodIP)
+	}
+	return ips
+}
+
+// association pairs a pod IP with the external IP of the same IP family.
+type association struct {
+	localIP    string
+	externalIP string
+}
+
+// parseAssociations pairs every external IP requested by the pod with the pod
+// IP of the same IP family. External IPs without a matching pod IP are
+// returned in unmatched.
+func parseAssociations(pod *corev1.Pod) (associations []association, unmatched []string) {
+	podIPs := parsePodIPs(pod)
+	for _, externalIP := range parseExternalIPs(pod) {
+		localIP := matchIPFamily(podIPs, externalIP)
+		if localIP == "" {
+			unmatched = append(unmatched, externalIP)
+			continue
+		}
+		associations = append(associations, association{localIP: localIP, externalIP: externalIP})
+	}
+	return associations, unmatched
+}
+
+// matchIPFamily returns the first of ips of the same IP family as ip.
+func matchIPFamily(ips []string, ip string) string {
+	for _, candidate := range ips {
+		if utilnet.IsIPv6String(candidate) == utilnet.IsIPv6String(ip) {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// sameIPs reports whether a and b hold the same IPs, in any order.
+func sameIPs(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sameIP compares two IP addresses, which may be written differently when
+// they are IPv6 addresses.
+func sameIP(a string, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return a == b
+	}
+	return ipA.Equal(ipB)
+}
+
+// joinPodIPs formats the pod IPs the way the downward API exposes
+// status.podIPs, which is the value of the associatedpodip annotation.
+func joinPodIPs(podIPs []string) string {
+	return strings.Join(podIPs, ",")
+}
+
+// releaseRequested tells whether the pod was asked to release its external
+// IP.
+func releaseRequested(pod *corev1.Pod) bool {
+	return pod.Annotations[releaseAnnotation] != ""
+}
+
+// holdsExternalIP tells whether finalizers refer to the external IP of the
+// pod, which then cannot be changed.
+func holdsExternalIP(pod *corev1.Pod) bool {
+	return len(parseFinalizers(pod)) > 0 || len(parseDissociaters(pod)) > 0
+}
+
 func parseAssociatedPodIP(pod *corev1.Pod) string {
 	return pod.Annotations[associatedPodIPAnnotation]
 }
@@ -47,32 +161,100 @@ func removeAssociatedPodIP(pod *corev1.Pod) {
 	delete(pod.Annotations, associatedPodIPAnnotation)
 }
 
-func parseFinalizer(pod *corev1.Pod) string {
+func hasReadinessGate(pod *corev1.Pod) bool {
+	for _, gate := range pod.Spec.ReadinessGates {
+		if gate.ConditionType == externalIPCondition {
+			return true
+		}
+	}
+	return false
+}
+
+func addReadinessGate(pod *corev1.Pod) {
+	pod.Spec.ReadinessGates = append(pod.Spec.ReadinessGates, corev1.PodReadinessGate{ConditionType: externalIPCondition})
+}
+
+// setExternalIPCondition sets the external IP condition of the pod, and
+// reports whether it changed.
+func setExternalIPCondition(pod *corev1.Pod, status corev1.ConditionStatus, reason string, message string) bool {
+	condition := corev1.PodCondition{
+		Type:               externalIPCondition,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: metav1.Now(),
+	}
+	for i, c := range pod.Status.Conditions {
+		if c.Type != externalIPCondition {
+			continue
+		}
+		if c.Status == status && c.Reason == reason && c.Message == message {
+			return false
+		}
+		if c.Status == status {
+			condition.LastTransitionTime = c.LastTransitionTime
+		}
+		pod.Status.Conditions[i] = condition
+		return true
+	}
+	pod.Status.Conditions = append(pod.Status.Conditions, condition)
+	return true
+}
+
+func parseFinalizers(pod *corev1.Pod) []string {
+	var ips []string
 	for _, f := range pod.GetFinalizers() {
 		if strings.HasPrefix(f, finalizerPrefix) {
-			return f[len(finalizerPrefix)+1:]
+			ips = append(ips, decodeFinalizerIP(f[len(finalizerPrefix)+1:]))
 		}
 	}
-	return ""
+	return ips
 }
 
-func parseDissociater(pod *corev1.Pod) string {
+func parseDissociaters(pod *corev1.Pod) []string {
+	var ips []string
 	for _, f := range pod.GetFinalizers() {
 		if strings.HasPrefix(f, dissociaterPrefix) {
-			return f[len(dissociaterPrefix)+1:]
+			ips = append(ips, decodeFinalizerIP(f[len(dissociaterPrefix)+1:]))
 		}
 	}
-	return ""
+	return ips
 }
 
 func addFinalizer(pod *corev1.Pod, localIP string) {
 	//removeFinalizer(pod)
-	controllerutil.AddFinalizer(pod, finalizerPrefix+"-"+localIP)
+	controllerutil.AddFinalizer(pod, finalizerPrefix+"-"+encodeFinalizerIP(localIP))
 }
 
 func addDissociater(pod *corev1.Pod, localIP string) {
 	//removeDissociater(pod)
-	controllerutil.AddFinalizer(pod, dissociaterPrefix+"-"+localIP)
+	controllerutil.AddFinalizer(pod, dissociaterPrefix+"-"+encodeFinalizerIP(localIP))
+}
+
+// encodeFinalizerIP encodes an IP for a finalizer name, which cannot contain
+// the colons of an IPv6 address. IPv6 addresses are written in full with
+// dashes between the groups, IPv4 addresses are kept as they are.
+func encodeFinalizerIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || parsed.To4() != nil {
+		return ip
+	}
+	groups := make([]string, 8)
+	for i := range groups {
+		groups[i] = fmt.Sprintf("%02x%02x", parsed[2*i], parsed[2*i+1])
+	}
+	return strings.Join(groups, "-")
+}
+
+func decodeFinalizerIP(s string) string {
+	if !strings.Contains(s, "-") {
+		return s
+	}
+	ip := net.ParseIP(strings.ReplaceAll(s, "-", ":"))
+	if ip == nil {
+		return s
+	}
+	return ip.String()
 }
 
 func removeFinalizer(pod *corev1.Pod) {
@@ -105,3 +287,101 @@ func containsPrefix(slice []string, s string) bool {
 func namespacedName(pod *corev1.Pod) string {
 	return pod.Namespace + "/" + pod.Name
 }
+
+// The helpers below are exported for the kubectl plugin, so it reads and
+// writes pods the way the controllers do.
+
+// ExternalIPs returns the external IPs requested by the pod.
+func ExternalIPs(pod *corev1.Pod) []string {
+	return parseExternalIPs(pod)
+}
+
+// PodIPs returns the IPs allocated to the pod.
+func PodIPs(pod *corev1.Pod) []string {
+	return parsePodIPs(pod)
+}
+
+// RequestsExternalIP tells whether the pod requests the external IP.
+func RequestsExternalIP(pod *corev1.Pod, externalIP string) bool {
+	return containsIP(parseExternalIPs(pod), externalIP)
+}
+
+// SetExternalIP requests the external IP for the pod, and cancels a release
+// of its previous external IP.
+func SetExternalIP(pod *corev1.Pod, externalIP string) {
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[externalIPAnnotation] = externalIP
+	delete(pod.Annotations, releaseAnnotation)
+}
+
+// RequestRelease asks the daemon to release the external IP of the pod.
+func RequestRelease(pod *corev1.Pod) {
+	if pod.Annotations == nil {
+		pod.Annotations = make(map[string]string)
+	}
+	pod.Annotations[releaseAnnotation] = "true"
+}
+
+// ReleaseRequested tells whether the pod was asked to release its external
+// IP.
+func ReleaseRequested(pod *corev1.Pod) bool {
+	return releaseRequested(pod)
+}
+
+// HoldsExternalIP tells whether the pod still holds its external IP, i.e.
+// whether its finalizers refer to the IP.
+func HoldsExternalIP(pod *corev1.Pod) bool {
+	return holdsExternalIP(pod)
+}
+
+// HeldPodIPs returns the pod IPs the finalizers of the pod refer to.
+func HeldPodIPs(pod *corev1.Pod) []string {
+	ips := parseFinalizers(pod)
+	for _, ip := range parseDissociaters(pod) {
+		if !containsIP(ips, ip) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// IsAssociated tells whether the pod egresses from its external IPs.
+func IsAssociated(pod *corev1.Pod) bool {
+	podIPs := parsePodIPs(pod)
+	return len(podIPs) > 0 && parseAssociatedPodIP(pod) == joinPodIPs(podIPs)
+}
+
+// ExternalIPCondition returns the external IP condition of the pod, or nil
+// when the daemon did not set it yet.
+func ExternalIPCondition(pod *corev1.Pod) *corev1.PodCondition {
+	for i := range pod.Status.Conditions {
+		if pod.Status.Conditions[i].Type == externalIPCondition {
+			return &pod.Status.Conditions[i]
+		}
+	}
+	return nil
+}
+
+// ExternalIPState summarizes the state of the external IP of the pod:
+// Releasing or Released, Terminating, Pending until the pod has an IP,
+// Associated, or the reason of its external IP condition.
+func ExternalIPState(pod *corev1.Pod) string {
+	switch {
+	case releaseRequested(pod) && holdsExternalIP(pod):
+		return "Releasing"
+	case releaseRequested(pod):
+		return "Released"
+	case !pod.DeletionTimestamp.IsZero():
+		return "Terminating"
+	case len(parsePodIPs(pod)) == 0:
+		return "Pending"
+	case IsAssociated(pod):
+		return "Associated"
+	}
+	if c := ExternalIPCondition(pod); c != nil && c.Reason != "" {
+		return c.Reason
+	}
+	return "Associating"
+}
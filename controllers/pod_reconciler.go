@@ -18,6 +18,8 @@ package controllers
 
 import (
 	"context"
+	"fmt"
+	"sync"
 	"time"
 
 	corev1 "k8s.io/api/core/v1"
@@ -25,28 +27,67 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/attribute"
+	"k8s.io/client-go/tools/record"
 
+	"github.com/yingeli/pod-external-ip-operator/pkg/tracing"
 	"github.com/yingeli/pod-external-ip-operator/providers"
 )
 
 type PodAssociater struct {
-	client     *client.Client
-	associater providers.Associater
-	finalizer  providers.Finalizer
-	log        logr.Logger
-	assoMap    map[string]string
+	client              *client.Client
+	reader              client.Reader
+	associater          providers.Associater
+	finalizer           providers.Finalizer
+	recorder            record.EventRecorder
+	backoff             *podBackoff
+	nodeNotReadyTimeout time.Duration
+	holderCheck         time.Duration
+	log                 logr.Logger
+
+	// holdersMu guards the holders of the external IPs, read at holdersRead
+	// for the pods of the node and shared by their holder checks.
+	holdersMu   sync.Mutex
+	holders     map[string]providers.Holder
+	holdersRead time.Time
+
+	// mu guards the state below, which the debug endpoints read.
+	mu             sync.Mutex
+	assoMap        map[string]string
+	providerErrors map[string]ProviderErrorState
+	resyncs        map[string]bool
+	// seen is when the pod IPs of the pods that are not associated yet were
+	// first seen, for the association latency.
+	seen map[string]seenPodIPs
+	// reconciled are the pods reconciled since the daemon started, so the
+	// egress rules of the others are not removed before they are.
+	reconciled map[string]bool
 }
 
-func newPodAssociater(client *client.Client, associater providers.Associater, finalizer providers.Finalizer) PodAssociater {
+func newPodAssociater(client *client.Client, reader client.Reader, associater providers.Associater, finalizer providers.Finalizer, recorder record.EventRecorder, backoff Backoff, nodeNotReadyTimeout time.Duration, holderCheck time.Duration) PodAssociater {
 	return PodAssociater{
-		client:     client,
-		associater: associater,
-		finalizer:  finalizer,
-		log:        ctrl.Log.WithName("pod-associater"),
-		assoMap:    make(map[string]string),
+		client:              client,
+		reader:              reader,
+		associater:          associater,
+		finalizer:           finalizer,
+		recorder:            recorder,
+		backoff:             newPodBackoff(backoff),
+		nodeNotReadyTimeout: nodeNotReadyTimeout,
+		holderCheck:         holderCheck,
+		log:                 ctrl.Log.WithName("pod-associater"),
+		assoMap:             make(map[string]string),
+		providerErrors:      make(map[string]ProviderErrorState),
+		resyncs:             make(map[string]bool),
+		seen:                make(map[string]seenPodIPs),
+		reconciled:          make(map[string]bool),
 	}
 }
 
+// logger returns the associater logger annotated with the trace of ctx.
+func (r *PodAssociater) logger(ctx context.Context) logr.Logger {
+	return tracing.Logger(ctx, r.log)
+}
+
 func (r *PodAssociater) setup(localNetworks []string) error {
 	ctx := context.Background()
 	if err := r.associater.Initialize(ctx, localNetworks); err != nil {
@@ -55,21 +96,31 @@ func (r *PodAssociater) setup(localNetworks []string) error {
 	return r.finalizer.Initialize(ctx)
 }
 
-func (r *PodAssociater) reconcile(ctx context.Context, pod *corev1.Pod) (ctrl.Result, error) {
+func (r *PodAssociater) reconcile(ctx context.Context, pod *corev1.Pod) (result ctrl.Result, err error) {
+	if !pod.ObjectMeta.DeletionTimestamp.IsZero() {
+		r.forgetSeenPodIPs(pod)
+	}
 	externalIP := parseExternalIP(pod)
 	if externalIP == "" {
 		return ctrl.Result{}, nil
 	}
 
+	ctx, span := tracing.Start(ctx, "PodAssociater.reconcile", attribute.String("pod", pod.Namespace+"/"+pod.Name), attribute.String("externalIP", externalIP))
+	defer func() { tracing.End(span, err) }()
+
 	podIP := pod.Status.PodIP
+	if pod.ObjectMeta.DeletionTimestamp.IsZero() && releaseRequested(pod) {
+		return ctrl.Result{}, r.release(ctx, pod, externalIP)
+	}
 	if pod.ObjectMeta.DeletionTimestamp.IsZero() && podIP != "" {
-		if retry, err := r.associateOrUpdate(ctx, pod, externalIP); retry {
-			result := ctrl.Result{
-				Requeue:      true,
-				RequeueAfter: time.Second * 5,
+		if retryAfter, err := r.associateOrUpdate(ctx, pod); retryAfter > 0 && err == nil {
+			if r.associatedPodIPs(pod) == "" {
+				r.logger(ctx).Info("retry associate external IP", "externalIP", externalIP, "after", retryAfter)
 			}
-			r.log.Info("retry associate external IP in 5 seconds", "externalIP", externalIP)
-			return result, nil
+			return ctrl.Result{
+				Requeue:      true,
+				RequeueAfter: retryAfter,
+			}, nil
 		} else {
 			return ctrl.Result{}, err
 		}
@@ -78,85 +129,326 @@ func (r *PodAssociater) reconcile(ctx context.Context, pod *corev1.Pod) (ctrl.Re
 	}
 }
 
-func (r *PodAssociater) associateOrUpdate(ctx context.Context, pod *corev1.Pod, externalIP string) (bool, error) {
-	podIP := pod.Status.PodIP
-	if podIP == r.assoMap[namespacedName(pod)] {
-		return false, nil
+func (r *PodAssociater) associateOrUpdate(ctx context.Context, pod *corev1.Pod) (time.Duration, error) {
+	podIPs := joinPodIPs(parsePodIPs(pod))
+	if resync := r.takeResync(pod); podIPs == r.associatedPodIPs(pod) && !resync {
+		return r.checkHolder(ctx, pod)
 	}
 
-	delete(r.assoMap, namespacedName(pod))
+	r.setAssociated(pod, "")
+	r.seePodIPs(pod, podIPs)
+
+	denied, err := checkExternalIPPolicies(ctx, *r.client, pod)
+	if err != nil {
+		return 0, err
+	}
+	if denied != "" {
+		r.logger(ctx).Info("refusing to associate pod with external IP", "pod.Name", pod.Name, "reason", denied)
+		return 0, r.setCondition(ctx, pod, corev1.ConditionFalse, "PolicyDenied", denied)
+	}
+
+	associations, unmatched := parseAssociations(pod)
+	for _, externalIP := range unmatched {
+		r.logger(ctx).Info("pod has no IP of the external IP family", "pod.Name", pod.Name, "externalIP", externalIP)
+	}
+	if len(associations) == 0 {
+		return 0, r.setCondition(ctx, pod, corev1.ConditionFalse, "NoPodIPOfFamily", "pod has no IP of the external IP family")
+	}
+	var localIPs []string
+	for _, a := range associations {
+		localIPs = append(localIPs, a.localIP)
+	}
 
 	associatedPodIP := parseAssociatedPodIP(pod)
-	if podIP != associatedPodIP {
+	if podIPs != associatedPodIP {
 		removeAssociatedPodIP(pod)
 		if err := (*r.client).Update(ctx, pod); err != nil {
-			return false, err
+			return 0, err
+		}
+	}
+	// A retry keeps the ExternalIPInUse or Stuck condition, and the holder
+	// it names, until the association succeeds.
+	if !retryingIPInUse(pod) {
+		if err := r.setCondition(ctx, pod, corev1.ConditionFalse, "Associating", ""); err != nil {
+			return 0, err
 		}
 	}
 
 	original := pod.DeepCopy()
-	if podIP != parseDissociater(pod) {
-		if err := dissociate(ctx, r.associater, pod, externalIP); err != nil {
-			return false, err
+	if dissociaters := parseDissociaters(pod); !sameIPs(localIPs, dissociaters) {
+		if err := dissociate(ctx, r.associater, pod); err != nil {
+			r.recordProviderError(pod, "dissociating the previous pod IPs", err)
+			return 0, err
+		}
+		r.logger(ctx).Info("dissociated pod with external IP", "pod.Name", pod.Name, "externalIP", parseExternalIP(pod))
+		if len(dissociaters) > 0 {
+			r.recorder.Eventf(pod, corev1.EventTypeNormal, eventDissociated, "Dissociated previous pod IP %s from external IP %s", describeIPs(dissociaters), parseExternalIP(pod))
+		}
+		for _, localIP := range localIPs {
+			addDissociater(pod, localIP)
 		}
-		r.log.Info("dissociated pod with external IP", "pod.Name", pod.Name, "externalIP", externalIP)
-		addDissociater(pod, podIP)
 	}
 
-	if podIP != parseFinalizer(pod) {
-		if err := finalize(ctx, r.finalizer, pod, externalIP); err != nil {
-			return false, err
+	if finalizers := parseFinalizers(pod); !sameIPs(localIPs, finalizers) {
+		if err := finalize(ctx, r.finalizer, pod); err != nil {
+			r.recordProviderError(pod, "finalizing the previous pod IPs", err)
+			return 0, err
+		}
+		r.logger(ctx).Info("finalized pod with external IP", "pod.Name", pod.Name, "externalIP", parseExternalIP(pod))
+		if len(finalizers) > 0 {
+			r.recorder.Eventf(pod, corev1.EventTypeNormal, eventFinalized, "Released external IP %s from previous pod IP %s", parseExternalIP(pod), describeIPs(finalizers))
+		}
+		for _, localIP := range localIPs {
+			addFinalizer(pod, localIP)
 		}
-		r.log.Info("finalized pod with external IP", "pod.Name", pod.Name, "externalIP", externalIP)
-		addFinalizer(pod, podIP)
 	}
 	if err := (*r.client).Patch(ctx, pod, client.StrategicMergeFrom(original)); err != nil {
-		return false, err
+		return 0, err
 	}
 
-	if retry, err := r.associater.Associate(ctx, pod, podIP, externalIP); err != nil || retry {
-		return retry, err
+	for _, a := range associations {
+		r.recorder.Eventf(pod, corev1.EventTypeNormal, eventAssociating, "Associating pod IP %s with external IP %s", a.localIP, a.externalIP)
+		retry, err := r.associater.Associate(ctx, pod, a.localIP, a.externalIP)
+		if err != nil {
+			r.recordProviderError(pod, fmt.Sprintf("associating pod IP %s with external IP %s", a.localIP, a.externalIP), err)
+			associationRetries.WithLabelValues(retryReasonProviderError).Inc()
+			if err := r.setCondition(ctx, pod, corev1.ConditionFalse, "AssociationFailed", err.Error()); err != nil {
+				r.logger(ctx).Error(err, "error setting pod condition", "pod.Name", pod.Name)
+			}
+			return 0, err
+		}
+		if retry {
+			associationRetries.WithLabelValues(retryReasonIPInUse).Inc()
+			if handedOff, err := r.handoff(ctx, pod, a.externalIP); err != nil {
+				r.logger(ctx).Error(err, "error handing off external IP", "pod.Name", pod.Name, "externalIP", a.externalIP)
+			} else if handedOff {
+				return handoffRetryDelay, nil
+			}
+			retryAfter, attempts := r.backoff.next(namespacedName(pod))
+			if r.backoff.exhausted(attempts) {
+				if attempts == r.backoff.Budget {
+					return retryAfter, r.markStuck(ctx, pod, a.externalIP, attempts)
+				}
+				return retryAfter, nil
+			}
+			r.recorder.Eventf(pod, corev1.EventTypeWarning, eventRetryingIPInUse, "External IP %s is in use by another network interface, retrying in %v", a.externalIP, retryAfter.Round(time.Second))
+			message := fmt.Sprintf("external IP %s is in use", a.externalIP)
+			return retryAfter, r.setCondition(ctx, pod, corev1.ConditionFalse, reasonExternalIPInUse, message)
+		}
 	}
 
+	// The holders read before are outdated now.
+	r.forgetHolders()
+
 	original = pod.DeepCopy()
-	setAssociatedPodIP(pod, podIP)
+	setAssociatedPodIP(pod, podIPs)
 	if err := (*r.client).Patch(ctx, pod, client.StrategicMergeFrom(original)); err != nil {
-		return false, err
+		return 0, err
+	}
+	r.logger(ctx).Info("associated pod with external IP", "pod.Name", pod.Name, "externalIP", parseExternalIP(pod))
+	r.recorder.Eventf(pod, corev1.EventTypeNormal, eventAssociated, "Associated pod IP %s with external IP %s", describeIPs(localIPs), parseExternalIP(pod))
+	r.setAssociated(pod, podIPs)
+	r.backoff.reset(namespacedName(pod))
+	r.observeAssociationLatency(pod, associatedPodIP == "")
+
+	return 0, r.setCondition(ctx, pod, corev1.ConditionTrue, "Associated", "")
+}
+
+// checkHolder checks that the provider still associates the external IPs of
+// an associated pod with its IPs, since they can be moved to another network
+// interface behind the back of the daemon. It forgets the association of a
+// pod that lost them, so it is associated again after a retry delay, and
+// otherwise checks again after the holder check interval. The holders are
+// read once per interval for all the pods of the node.
+func (r *PodAssociater) checkHolder(ctx context.Context, pod *corev1.Pod) (time.Duration, error) {
+	holders, err := r.nodeHolders(ctx, pod.Spec.NodeName)
+	if err != nil {
+		// The association is not known to be lost, keep the condition
+		// and check again later.
+		r.recordProviderError(pod, "looking up the holders of the external IPs", err)
+		return r.holderCheck, nil
+	}
+	associations, _ := parseAssociations(pod)
+	for _, a := range associations {
+		h := holders[normalizeIP(a.externalIP)]
+		if sameIP(h.PrivateIP, a.localIP) {
+			continue
+		}
+
+		holder := h.ID
+		if holder == "" {
+			holder = "no resource"
+		}
+		r.logger(ctx).Info("pod lost its external IP", "pod.Name", pod.Name, "externalIP", a.externalIP, "holder", holder)
+		r.recorder.Eventf(pod, corev1.EventTypeWarning, eventLost, "External IP %s is associated with %s instead of pod IP %s", a.externalIP, holder, a.localIP)
+		r.setAssociated(pod, "")
+		retryAfter, _ := r.backoff.next(namespacedName(pod))
+		message := fmt.Sprintf("external IP %s is associated with %s", a.externalIP, holder)
+		return retryAfter, r.setCondition(ctx, pod, corev1.ConditionFalse, reasonNotHolder, message)
+	}
+	return r.holderCheck, r.setCondition(ctx, pod, corev1.ConditionTrue, "Associated", "")
+}
+
+// DefaultHolderCheckInterval is the delay between the checks of the holder of
+// the external IPs of an associated pod.
+const DefaultHolderCheckInterval = 5 * time.Minute
+
+// nodeHolders returns the holders of the external IPs by normalized address,
+// which are read from the provider for the pods of the node at most once per
+// holder check interval.
+func (r *PodAssociater) nodeHolders(ctx context.Context, node string) (map[string]providers.Holder, error) {
+	r.holdersMu.Lock()
+	defer r.holdersMu.Unlock()
+	if r.holders != nil && time.Since(r.holdersRead) < r.holderCheck {
+		return r.holders, nil
 	}
-	r.log.Info("associated pod with external IP", "pod.Name", pod.Name, "externalIP", externalIP)
-	r.assoMap[namespacedName(pod)] = podIP
+	holders, err := r.associater.Holders(ctx, node)
+	if err != nil {
+		return nil, err
+	}
+	r.holders = make(map[string]providers.Holder, len(holders))
+	for externalIP, holder := range holders {
+		r.holders[normalizeIP(externalIP)] = holder
+	}
+	r.holdersRead = time.Now()
+	return r.holders, nil
+}
 
-	return false, nil
+// forgetHolders makes the next holder check read the holders again.
+func (r *PodAssociater) forgetHolders() {
+	r.holdersMu.Lock()
+	defer r.holdersMu.Unlock()
+	r.holders = nil
+}
+
+// markStuck marks a pod whose external IP is still in use after the retry
+// budget, naming the resource that holds it. The association keeps being
+// retried at the maximum interval.
+func (r *PodAssociater) markStuck(ctx context.Context, pod *corev1.Pod, externalIP string, attempts int) error {
+	h, err := r.associater.Holder(ctx, externalIP)
+	if err != nil {
+		r.logger(ctx).Error(err, "error looking up the holder of the external IP", "externalIP", externalIP)
+	}
+	holder := h.ID
+	if holder == "" {
+		holder = "an unknown resource"
+	}
+	r.logger(ctx).Info("pod is stuck waiting for its external IP", "pod.Name", pod.Name, "externalIP", externalIP, "holder", holder, "attempts", attempts)
+	r.recorder.Eventf(pod, corev1.EventTypeWarning, eventStuck, "External IP %s is still in use by %s after %d retries", externalIP, holder, attempts)
+	message := fmt.Sprintf("external IP %s is in use by %s", externalIP, holder)
+	return r.setCondition(ctx, pod, corev1.ConditionFalse, reasonStuck, message)
+}
+
+// Reasons of the external IP condition of the pods whose external IP is in
+// use by another network interface.
+const (
+	reasonExternalIPInUse = "ExternalIPInUse"
+	reasonStuck           = "Stuck"
+	reasonNotHolder       = "NotHolder"
+)
+
+// retryingIPInUse tells whether the association of the pod is being retried
+// because its external IP is in use.
+func retryingIPInUse(pod *corev1.Pod) bool {
+	c := ExternalIPCondition(pod)
+	if c == nil || c.Status != corev1.ConditionFalse {
+		return false
+	}
+	return c.Reason == reasonExternalIPInUse || c.Reason == reasonStuck || c.Reason == reasonNotHolder
+}
+
+// setCondition sets the external IP condition of a pod that has it as a
+// readiness gate, so the pod is only ready while it egresses from its
+// external IP.
+func (r *PodAssociater) setCondition(ctx context.Context, pod *corev1.Pod, status corev1.ConditionStatus, reason string, message string) error {
+	if !hasReadinessGate(pod) {
+		return nil
+	}
+	original := pod.DeepCopy()
+	if !setExternalIPCondition(pod, status, reason, message) {
+		return nil
+	}
+	return (*r.client).Status().Patch(ctx, pod, client.StrategicMergeFrom(original))
 }
 
 func (r *PodAssociater) dissociate(ctx context.Context, pod *corev1.Pod, externalIP string) error {
-	delete(r.assoMap, namespacedName(pod))
+	r.setAssociated(pod, "")
+	r.observeAssociationLatency(pod, false)
+	r.backoff.reset(namespacedName(pod))
+	r.forgetProviderError(pod)
+	if err := r.setCondition(ctx, pod, corev1.ConditionFalse, "Dissociated", ""); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	dissociaters := parseDissociaters(pod)
 	original := pod.DeepCopy()
-	if err := dissociate(ctx, r.associater, pod, externalIP); err != nil {
+	if err := dissociate(ctx, r.associater, pod); err != nil {
+		r.recordProviderError(pod, "dissociating the pod", err)
 		return err
 	}
 	if err := (*r.client).Patch(ctx, pod, client.StrategicMergeFrom(original)); err != nil {
 		return client.IgnoreNotFound(err)
 	}
-	r.log.Info("dissociated pod with external IP", "pod.Name", pod.Name, "externalIP", externalIP)
+	r.logger(ctx).Info("dissociated pod with external IP", "pod.Name", pod.Name, "externalIP", externalIP)
+	if len(dissociaters) > 0 {
+		r.recorder.Eventf(pod, corev1.EventTypeNormal, eventDissociated, "Dissociated pod IP %s from external IP %s", describeIPs(dissociaters), externalIP)
+	}
 	return nil
 }
 
+// release detaches the external IP from a running pod that was asked to
+// release it, and removes the finalizers and the associatedpodip annotation,
+// so the IP can be moved to another pod.
+func (r *PodAssociater) release(ctx context.Context, pod *corev1.Pod, externalIP string) error {
+	r.setAssociated(pod, "")
+	r.observeAssociationLatency(pod, false)
+	r.backoff.reset(namespacedName(pod))
+	if !holdsExternalIP(pod) && parseAssociatedPodIP(pod) == "" {
+		return client.IgnoreNotFound(r.setCondition(ctx, pod, corev1.ConditionFalse, "Released", ""))
+	}
+
+	finalizers := parseFinalizers(pod)
+	original := pod.DeepCopy()
+	if err := dissociate(ctx, r.associater, pod); err != nil {
+		r.recordProviderError(pod, "dissociating the pod", err)
+		return err
+	}
+	if err := finalize(ctx, r.finalizer, pod); err != nil {
+		r.recordProviderError(pod, "releasing the external IP", err)
+		return err
+	}
+	removeAssociatedPodIP(pod)
+	if err := (*r.client).Patch(ctx, pod, client.StrategicMergeFrom(original)); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	r.logger(ctx).Info("released external IP", "pod.Name", pod.Name, "externalIP", externalIP)
+	if len(finalizers) > 0 {
+		r.recorder.Eventf(pod, corev1.EventTypeNormal, eventReleased, "Released external IP %s from pod IP %s on request", externalIP, describeIPs(finalizers))
+	}
+	return client.IgnoreNotFound(r.setCondition(ctx, pod, corev1.ConditionFalse, "Released", ""))
+}
+
 type PodFinalizer struct {
 	client   *client.Client
 	provider providers.Finalizer
+	recorder record.EventRecorder
 	log      logr.Logger
 }
 
-func newPodFinalizer(client *client.Client, provider providers.Finalizer) PodFinalizer {
+func newPodFinalizer(client *client.Client, provider providers.Finalizer, recorder record.EventRecorder) PodFinalizer {
 	return PodFinalizer{
 		client:   client,
 		provider: provider,
+		recorder: recorder,
 		log:      ctrl.Log.WithName("pod-associater"),
 	}
 }
 
-func (r *PodFinalizer) reconcile(ctx context.Context, pod *corev1.Pod) error {
+// logger returns the finalizer logger annotated with the trace of ctx.
+func (r *PodFinalizer) logger(ctx context.Context) logr.Logger {
+	return tracing.Logger(ctx, r.log)
+}
+
+func (r *PodFinalizer) reconcile(ctx context.Context, pod *corev1.Pod) (err error) {
 	if pod.ObjectMeta.DeletionTimestamp.IsZero() && pod.Status.PodIP != "" {
 		return nil
 	}
@@ -166,33 +458,49 @@ func (r *PodFinalizer) reconcile(ctx context.Context, pod *corev1.Pod) error {
 		return nil
 	}
 
+	ctx, span := tracing.Start(ctx, "PodFinalizer.reconcile", attribute.String("pod", pod.Namespace+"/"+pod.Name), attribute.String("externalIP", externalIP))
+	defer func() { tracing.End(span, err) }()
+
+	finalizers := parseFinalizers(pod)
 	original := pod.DeepCopy()
-	if err := finalize(ctx, r.provider, pod, externalIP); err != nil {
+	if err := finalize(ctx, r.provider, pod); err != nil {
+		recordProviderError(r.recorder, pod, "finalizing the pod", err)
 		return client.IgnoreNotFound(err)
 	}
 	if err := (*r.client).Patch(ctx, pod, client.StrategicMergeFrom(original)); err != nil {
 		return err
 	}
-	r.log.Info("finalized pod with external IP", "pod.Name", pod.Name, "externalIP", externalIP)
+	r.logger(ctx).Info("finalized pod with external IP", "pod.Name", pod.Name, "externalIP", externalIP)
+	if len(finalizers) > 0 {
+		r.recorder.Eventf(pod, corev1.EventTypeNormal, eventFinalized, "Released external IP %s from pod IP %s", externalIP, describeIPs(finalizers))
+	}
 	return nil
 }
 
-func dissociate(ctx context.Context, provider providers.Associater, pod *corev1.Pod, externalIP string) error {
-	localIP := parseDissociater(pod)
-	if localIP != "" {
-		if err := provider.Dissociate(ctx, pod, localIP, externalIP); err != nil {
-			return err
+// dissociate dissociates every pod IP recorded in the dissociater finalizers
+// from the external IP of the same IP family, and removes the finalizers.
+func dissociate(ctx context.Context, provider providers.Associater, pod *corev1.Pod) error {
+	externalIPs := parseExternalIPs(pod)
+	for _, localIP := range parseDissociaters(pod) {
+		if externalIP := matchIPFamily(externalIPs, localIP); externalIP != "" {
+			if err := provider.Dissociate(ctx, pod, localIP, externalIP); err != nil {
+				return err
+			}
 		}
 	}
 	removeDissociater(pod)
 	return nil
 }
 
-func finalize(ctx context.Context, provider providers.Finalizer, pod *corev1.Pod, externalIP string) error {
-	localIP := parseFinalizer(pod)
-	if localIP != "" {
-		if err := provider.Finalize(ctx, pod, localIP, externalIP); err != nil {
-			return err
+// finalize finalizes every pod IP recorded in the finalizers with the
+// external IP of the same IP family, and removes the finalizers.
+func finalize(ctx context.Context, provider providers.Finalizer, pod *corev1.Pod) error {
+	externalIPs := parseExternalIPs(pod)
+	for _, localIP := range parseFinalizers(pod) {
+		if externalIP := matchIPFamily(externalIPs, localIP); externalIP != "" {
+			if err := provider.Finalize(ctx, pod, localIP, externalIP); err != nil {
+				return err
+			}
 		}
 	}
 	removeFinalizer(pod)
@@ -0,0 +1,334 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/yingeli/pod-external-ip-operator/providers"
+	"github.com/yingeli/pod-external-ip-operator/providers/fake"
+)
+
+const (
+	testExternalIP = "20.10.0.1"
+	testPodIP      = "10.240.0.10"
+	testNewPodIP   = "10.240.0.11"
+)
+
+// testFinalizers returns the finalizers the daemon adds for a pod IP.
+func testFinalizers(podIP string) []string {
+	return []string{dissociaterPrefix + "-" + podIP, finalizerPrefix + "-" + podIP}
+}
+
+var _ = Describe("Pod external IP", func() {
+	var (
+		ctx        context.Context
+		provider   *fake.Provider
+		recorder   *record.FakeRecorder
+		associater PodAssociater
+		finalizer  PodFinalizer
+		pod        *corev1.Pod
+	)
+
+	// getPod reads the pod back from the API server.
+	getPod := func() *corev1.Pod {
+		var current corev1.Pod
+		ExpectWithOffset(1, k8sClient.Get(ctx, client.ObjectKeyFromObject(pod), &current)).To(Succeed())
+		return &current
+	}
+
+	setPodIP := func(podIP string) {
+		current := getPod()
+		current.Status.PodIP = podIP
+		current.Status.PodIPs = []corev1.PodIP{{IP: podIP}}
+		ExpectWithOffset(1, k8sClient.Status().Update(ctx, current)).To(Succeed())
+	}
+
+	associate := func() (time.Duration, error) {
+		result, err := associater.reconcile(ctx, getPod())
+		return result.RequeueAfter, err
+	}
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		provider = fake.New()
+		recorder = record.NewFakeRecorder(100)
+		backoff := Backoff{Initial: time.Second, Max: 4 * time.Second, Budget: 3}
+		associater = newPodAssociater(&k8sClient, k8sClient, provider.NewAssociater(), provider.NewFinalizer(), recorder, backoff, DefaultNodeNotReadyTimeout, DefaultHolderCheckInterval)
+		Expect(associater.setup([]string{"10.0.0.0/16"})).To(Succeed())
+		finalizer = newPodFinalizer(&k8sClient, provider.NewFinalizer(), recorder)
+
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "external-ip-"}}
+		Expect(k8sClient.Create(ctx, namespace)).To(Succeed())
+		pod = &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   namespace.Name,
+				Name:        "web",
+				Annotations: map[string]string{externalIPAnnotation: testExternalIP},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "web", Image: "nginx"}},
+			},
+		}
+		Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+		setPodIP(testPodIP)
+		provider.ResetCalls()
+	})
+
+	Context("in the daemon", func() {
+		It("associates a pod once it has a pod IP", func() {
+			Expect(associate()).To(BeZero())
+
+			current := getPod()
+			Expect(current.Annotations).To(Equal(map[string]string{
+				externalIPAnnotation:      testExternalIP,
+				associatedPodIPAnnotation: testPodIP,
+			}))
+			Expect(current.Finalizers).To(ConsistOf(testFinalizers(testPodIP)))
+			Expect(provider.Calls(fake.MethodAssociate, fake.MethodDissociate, fake.MethodFinalize)).To(Equal([]fake.Call{
+				{Method: fake.MethodAssociate, Pod: pod.Namespace + "/web", LocalIP: testPodIP, ExternalIP: testExternalIP},
+			}))
+			Expect(provider.Associations()).To(Equal(map[string]string{testExternalIP: testPodIP}))
+		})
+
+		It("only checks the holder of the external IP of an associated pod", func() {
+			Expect(associate()).To(BeZero())
+			provider.ResetCalls()
+
+			Expect(associate()).To(Equal(DefaultHolderCheckInterval))
+			Expect(provider.Calls()).To(Equal([]fake.Call{
+				{Method: fake.MethodHolders},
+			}))
+		})
+
+		It("reads the holders once per interval for the checks of the pods", func() {
+			Expect(associate()).To(BeZero())
+			provider.ResetCalls()
+
+			Expect(associate()).To(Equal(DefaultHolderCheckInterval))
+			Expect(associate()).To(Equal(DefaultHolderCheckInterval))
+			Expect(provider.Calls()).To(Equal([]fake.Call{
+				{Method: fake.MethodHolders},
+			}))
+		})
+
+		It("associates again a pod that lost its external IP", func() {
+			Expect(associate()).To(BeZero())
+			provider.SetInUse(testExternalIP, "10.240.1.5")
+
+			retryAfter, err := associate()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(retryAfter).To(BeNumerically(">", 0))
+			Expect(retryAfter).To(BeNumerically("<=", time.Second))
+
+			holder, err := provider.NewAssociater().Holder(ctx, testExternalIP)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(provider.NewAssociater().Release(ctx, testExternalIP, holder.ID)).To(BeTrue())
+
+			Expect(associate()).To(BeZero())
+			Expect(getPod().Annotations).To(HaveKeyWithValue(associatedPodIPAnnotation, testPodIP))
+			Expect(provider.Associations()).To(Equal(map[string]string{testExternalIP: testPodIP}))
+		})
+
+		It("moves the external IP to the new pod IP", func() {
+			Expect(associate()).To(BeZero())
+			setPodIP(testNewPodIP)
+			provider.ResetCalls()
+
+			Expect(associate()).To(BeZero())
+
+			current := getPod()
+			Expect(current.Annotations).To(Equal(map[string]string{
+				externalIPAnnotation:      testExternalIP,
+				associatedPodIPAnnotation: testNewPodIP,
+			}))
+			Expect(current.Finalizers).To(ConsistOf(testFinalizers(testNewPodIP)))
+			Expect(provider.Calls(fake.MethodAssociate, fake.MethodDissociate, fake.MethodFinalize)).To(Equal([]fake.Call{
+				{Method: fake.MethodDissociate, Pod: pod.Namespace + "/web", LocalIP: testPodIP, ExternalIP: testExternalIP},
+				{Method: fake.MethodFinalize, Pod: pod.Namespace + "/web", LocalIP: testPodIP, ExternalIP: testExternalIP},
+				{Method: fake.MethodAssociate, Pod: pod.Namespace + "/web", LocalIP: testNewPodIP, ExternalIP: testExternalIP},
+			}))
+			Expect(provider.Associations()).To(Equal(map[string]string{testExternalIP: testNewPodIP}))
+		})
+
+		It("dissociates a deleted pod and leaves its finalizer to the controller", func() {
+			Expect(associate()).To(BeZero())
+			Expect(k8sClient.Delete(ctx, getPod())).To(Succeed())
+			provider.ResetCalls()
+
+			Expect(associate()).To(BeZero())
+
+			current := getPod()
+			Expect(current.DeletionTimestamp).NotTo(BeNil())
+			Expect(current.Finalizers).To(Equal([]string{finalizerPrefix + "-" + testPodIP}))
+			Expect(provider.Calls()).To(Equal([]fake.Call{
+				{Method: fake.MethodDissociate, Pod: pod.Namespace + "/web", LocalIP: testPodIP, ExternalIP: testExternalIP},
+			}))
+			Expect(provider.Associations()).To(BeEmpty())
+		})
+
+		It("forgets the seen pod IPs of a pod deleted before it was associated", func() {
+			provider.SetInUse(testExternalIP, "10.240.1.5")
+			Expect(associate()).To(BeNumerically(">", 0))
+			Expect(associater.seen).To(HaveKey(pod.Namespace + "/web"))
+
+			Expect(k8sClient.Delete(ctx, getPod())).To(Succeed())
+			Expect(associate()).To(BeZero())
+			Expect(associater.seen).To(BeEmpty())
+		})
+
+		It("fails on a conflict and associates on the retry", func() {
+			stale := getPod()
+			current := getPod()
+			current.Labels = map[string]string{"app": "web"}
+			Expect(k8sClient.Update(ctx, current)).To(Succeed())
+
+			_, err := associater.reconcile(ctx, stale)
+			Expect(apierrors.IsConflict(err)).To(BeTrue(), "error: %v", err)
+			Expect(provider.Calls(fake.MethodAssociate)).To(BeEmpty())
+			Expect(getPod().Finalizers).To(BeEmpty())
+
+			Expect(associate()).To(BeZero())
+			current = getPod()
+			Expect(current.Annotations).To(HaveKeyWithValue(associatedPodIPAnnotation, testPodIP))
+			Expect(current.Finalizers).To(ConsistOf(testFinalizers(testPodIP)))
+			Expect(provider.Associations()).To(Equal(map[string]string{testExternalIP: testPodIP}))
+		})
+
+		It("retries while the external IP is in use", func() {
+			provider.SetInUse(testExternalIP, "10.240.1.5")
+
+			retryAfter, err := associate()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(retryAfter).To(BeNumerically(">", 0))
+			Expect(retryAfter).To(BeNumerically("<=", time.Second))
+
+			current := getPod()
+			Expect(current.Annotations).To(Equal(map[string]string{externalIPAnnotation: testExternalIP}))
+			Expect(current.Finalizers).To(ConsistOf(testFinalizers(testPodIP)))
+			Expect(provider.Associations()).To(Equal(map[string]string{testExternalIP: "10.240.1.5"}))
+
+			holder, err := provider.NewAssociater().Holder(ctx, testExternalIP)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(provider.NewAssociater().Release(ctx, testExternalIP, holder.ID)).To(BeTrue())
+
+			Expect(associate()).To(BeZero())
+			Expect(getPod().Annotations).To(HaveKeyWithValue(associatedPodIPAnnotation, testPodIP))
+			Expect(provider.Associations()).To(Equal(map[string]string{testExternalIP: testPodIP}))
+		})
+
+		It("keeps the Stuck condition while over the retry budget", func() {
+			pod = &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace:   pod.Namespace,
+					Name:        "gated",
+					Annotations: map[string]string{externalIPAnnotation: testExternalIP},
+				},
+				Spec: corev1.PodSpec{
+					Containers:     []corev1.Container{{Name: "web", Image: "nginx"}},
+					ReadinessGates: []corev1.PodReadinessGate{{ConditionType: externalIPCondition}},
+				},
+			}
+			Expect(k8sClient.Create(ctx, pod)).To(Succeed())
+			setPodIP(testNewPodIP)
+			provider.SetInUse(testExternalIP, "10.240.1.5")
+			holder, err := provider.NewAssociater().Holder(ctx, testExternalIP)
+			Expect(err).NotTo(HaveOccurred())
+
+			// The budget of 3 retries marks the pod Stuck on the third one.
+			for i := 1; i <= 5; i++ {
+				retryAfter, err := associate()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(retryAfter).To(BeNumerically(">", 0))
+				condition := ExternalIPCondition(getPod())
+				Expect(condition).NotTo(BeNil())
+				if i < 3 {
+					Expect(condition.Reason).To(Equal(reasonExternalIPInUse))
+				} else {
+					Expect(condition.Reason).To(Equal(reasonStuck))
+					Expect(condition.Message).To(ContainSubstring(holder.ID))
+				}
+			}
+		})
+
+		It("returns throttling errors and associates on the retry", func() {
+			provider.InjectThrottled(fake.MethodAssociate)
+
+			_, err := associate()
+			Expect(err).To(HaveOccurred())
+			Expect(providers.ErrorCode(err)).To(Equal(fake.CodeThrottled))
+			current := getPod()
+			Expect(current.Annotations).To(Equal(map[string]string{externalIPAnnotation: testExternalIP}))
+			Expect(current.Finalizers).To(ConsistOf(testFinalizers(testPodIP)))
+			Expect(provider.Associations()).To(BeEmpty())
+
+			Expect(associate()).To(BeZero())
+			Expect(getPod().Annotations).To(HaveKeyWithValue(associatedPodIPAnnotation, testPodIP))
+			Expect(provider.Associations()).To(Equal(map[string]string{testExternalIP: testPodIP}))
+		})
+	})
+
+	Context("in the controller", func() {
+		BeforeEach(func() {
+			Expect(associate()).To(BeZero())
+			provider.ResetCalls()
+		})
+
+		It("ignores running pods", func() {
+			Expect(finalizer.reconcile(ctx, getPod())).To(Succeed())
+			Expect(provider.Calls()).To(BeEmpty())
+			Expect(getPod().Finalizers).To(ConsistOf(testFinalizers(testPodIP)))
+		})
+
+		It("releases the external IP and removes the finalizer of a deleted pod", func() {
+			Expect(k8sClient.Delete(ctx, getPod())).To(Succeed())
+			Expect(associate()).To(BeZero())
+			provider.ResetCalls()
+
+			Expect(finalizer.reconcile(ctx, getPod())).To(Succeed())
+
+			Expect(provider.Calls()).To(Equal([]fake.Call{
+				{Method: fake.MethodFinalize, Pod: pod.Namespace + "/web", LocalIP: testPodIP, ExternalIP: testExternalIP},
+			}))
+			err := k8sClient.Get(ctx, client.ObjectKeyFromObject(pod), &corev1.Pod{})
+			Expect(apierrors.IsNotFound(err)).To(BeTrue(), "error: %v", err)
+		})
+
+		It("keeps the finalizer while the provider fails", func() {
+			Expect(k8sClient.Delete(ctx, getPod())).To(Succeed())
+			Expect(associate()).To(BeZero())
+			provider.InjectNotFound(fake.MethodFinalize)
+
+			err := finalizer.reconcile(ctx, getPod())
+			Expect(providers.ErrorCode(err)).To(Equal(fake.CodeNotFound))
+			Expect(getPod().Finalizers).To(Equal([]string{finalizerPrefix + "-" + testPodIP}))
+
+			Expect(finalizer.reconcile(ctx, getPod())).To(Succeed())
+			err = k8sClient.Get(ctx, client.ObjectKeyFromObject(pod), &corev1.Pod{})
+			Expect(apierrors.IsNotFound(err)).To(BeTrue(), "error: %v", err)
+		})
+	})
+})
@@ -0,0 +1,83 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+//+kubebuilder:webhook:path=/validate-v1-pod,mutating=false,failurePolicy=fail,groups="",resources=pods,verbs=create;update,versions=v1,name=vpod.kb.io,sideEffects=none,admissionReviewVersions=v1
+
+// PodValidator rejects pods requesting external IPs they are not allowed to
+// use by the ExternalIPPolicies, and changes of the external IPs of scheduled
+// pods.
+type PodValidator struct {
+	Client  client.Client
+	decoder *admission.Decoder
+}
+
+// Handle implements admission.Handler.
+func (v *PodValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	pod := &corev1.Pod{}
+	if err := v.decoder.Decode(req, pod); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	// Only a new external IP is checked, so pods admitted before a policy
+	// changed can still be updated, e.g. to remove their finalizers.
+	if req.Operation == admissionv1.Update {
+		old := &corev1.Pod{}
+		if err := v.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		if parseExternalIP(old) == parseExternalIP(pod) {
+			return admission.Allowed("")
+		}
+		// Once the pod is scheduled, the daemon may associate the old
+		// external IP at any time and its finalizers refer to it, so it
+		// cannot change until the pod was asked to release it and did.
+		if old.Spec.NodeName != "" && (!releaseRequested(old) || holdsExternalIP(old)) {
+			return admission.Denied(fmt.Sprintf("annotation %s cannot be changed once the pod is scheduled until it released its external IP, set the %s annotation and wait for the release, or recreate the pod to change it", externalIPAnnotation, releaseAnnotation))
+		}
+	}
+
+	if parseExternalIP(pod) == "" {
+		return admission.Allowed("")
+	}
+
+	denied, err := checkExternalIPPolicies(ctx, v.Client, pod)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	if denied != "" {
+		return admission.Denied(denied)
+	}
+	return admission.Allowed("")
+}
+
+// InjectDecoder implements admission.DecoderInjector.
+func (v *PodValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
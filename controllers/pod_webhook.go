@@ -19,21 +19,41 @@ package controllers
 import (
 	"context"
 	"encoding/json"
-
+	"fmt"
 	"net/http"
+	"path"
 
+	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	configv1alpha1 "github.com/yingeli/pod-external-ip-operator/api/config/v1alpha1"
 )
 
 //+kubebuilder:webhook:path=/mutate-v1-pod,mutating=true,failurePolicy=fail,groups="",resources=pods,verbs=create;update,versions=v1,name=mpod.kb.io,sideEffects=none,admissionReviewVersions=v1
 //+kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch;create;update;patch;delete
 
+const (
+	// InjectionModeInitContainer injects an init container that holds the pod
+	// until it is associated with its external IP.
+	InjectionModeInitContainer = configv1alpha1.InjectionModeInitContainer
+	// InjectionModeReadinessGate adds a readiness gate on the external IP
+	// condition, which the daemon sets while the pod is associated.
+	InjectionModeReadinessGate = configv1alpha1.InjectionModeReadinessGate
+)
+
 // podAnnotator annotates Pods
 type PodWebhook struct {
-	Client  client.Client
-	decoder *admission.Decoder
+	Client client.Client
+	// InjectionMode is how pods wait for their external IP, either
+	// InjectionModeInitContainer, the default, or InjectionModeReadinessGate.
+	InjectionMode string
+	// InitContainer is the template of the init container injected in
+	// InjectionModeInitContainer, defaulted and validated by the operator
+	// config.
+	InitContainer configv1alpha1.InitContainerConfig
+	decoder       *admission.Decoder
 }
 
 // PodAnnotator adds an annotation to every incoming pods.
@@ -45,7 +65,15 @@ func (a *PodWebhook) Handle(ctx context.Context, req admission.Request) admissio
 		return admission.Errored(http.StatusBadRequest, err)
 	}
 
-	if parseExternalIP(pod) != "" {
+	if parseExternalIP(pod) != "" && a.InjectionMode == InjectionModeReadinessGate {
+		// The readiness gates of a pod cannot be changed after it is created.
+		if req.Operation == admissionv1.Create && !hasReadinessGate(pod) {
+			addReadinessGate(pod)
+		}
+	} else if parseExternalIP(pod) != "" && req.Operation == admissionv1.Create {
+		// The init containers of a pod cannot be changed either, so a pod
+		// that gets an external IP once running egresses from it as soon as
+		// it is associated.
 		found := false
 		for _, ic := range pod.Spec.InitContainers {
 			if ic.Name == "init-external-ip" {
@@ -54,7 +82,9 @@ func (a *PodWebhook) Handle(ctx context.Context, req admission.Request) admissio
 			}
 		}
 		if !found {
-			inject(pod)
+			if err := inject(pod, a.InitContainer); err != nil {
+				return admission.Denied(err.Error())
+			}
 		}
 	}
 
@@ -66,39 +96,47 @@ func (a *PodWebhook) Handle(ctx context.Context, req admission.Request) admissio
 	return admission.PatchResponseFromRaw(req.Object.Raw, marshaledPod)
 }
 
-func inject(pod *corev1.Pod) {
-	//arg := "while ! grep -q 'podexternalip.yglab.eu.org/associatedpodip=\"'$POD_IP'\"' /etc/podinfo/annotations; do echo \"POD_IP=\"$POD_IP; cat /etc/podinfo/annotations; sleep 5; done;"
-	//arg := "while true; do cat /etc/podinfo/annotations; echo \"POD_IP=\"$POD_IP; sleep 5; done;"
-	arg := "while ! grep -q 'podexternalip.yglab.eu.org/associatedpodip=\"'$POD_IP'\"' /etc/podinfo/annotations; do sleep 1; done;"
+// inject adds the init container of the template, and the downward API
+// volume it reads the pod annotations from.
+func inject(pod *corev1.Pod, template configv1alpha1.InitContainerConfig) error {
+	for _, v := range pod.Spec.Volumes {
+		if v.Name == template.VolumeName {
+			return fmt.Errorf("pod volume %s collides with the injected volume, set initContainer.volumeName in the operator config", v.Name)
+		}
+	}
+
 	init := corev1.Container{
-		Name:  "init-external-ip",
-		Image: "k8s.gcr.io/busybox",
+		Name:            "init-external-ip",
+		Image:           template.Image,
+		ImagePullPolicy: template.ImagePullPolicy,
 		Command: []string{
 			"sh",
 			"-c",
 		},
-		Args: []string{arg},
+		Args:            []string{waitScript(template)},
+		Resources:       template.Resources,
+		SecurityContext: template.SecurityContext.DeepCopy(),
 		Env: []corev1.EnvVar{
 			{
-				Name: "POD_IP",
+				Name: "POD_IPS",
 				ValueFrom: &corev1.EnvVarSource{
 					FieldRef: &corev1.ObjectFieldSelector{
-						FieldPath: "status.podIP",
+						FieldPath: "status.podIPs",
 					},
 				},
 			},
 		},
 		VolumeMounts: []corev1.VolumeMount{
 			{
-				Name:      "podinfo",
-				MountPath: "/etc/podinfo",
+				Name:      template.VolumeName,
+				MountPath: template.MountPath,
 			},
 		},
 	}
 	pod.Spec.InitContainers = append(pod.Spec.InitContainers, init)
 
 	volume := corev1.Volume{
-		Name: "podinfo",
+		Name: template.VolumeName,
 		VolumeSource: corev1.VolumeSource{
 			DownwardAPI: &corev1.DownwardAPIVolumeSource{
 				Items: []corev1.DownwardAPIVolumeFile{
@@ -113,6 +151,27 @@ func inject(pod *corev1.Pod) {
 		},
 	}
 	pod.Spec.Volumes = append(pod.Spec.Volumes, volume)
+	return nil
+}
+
+// waitScript polls the annotations file until the associatedpodip annotation
+// holds the pod IPs. When the timeout of the template expires, it exits with
+// success or failure according to the failure policy.
+func waitScript(template configv1alpha1.InitContainerConfig) string {
+	annotations := path.Join(template.MountPath, "annotations")
+	wait := fmt.Sprintf("grep -q '%s=\"'$POD_IPS'\"' %s", associatedPodIPAnnotation, annotations)
+	timeout := int64(template.Timeout.Seconds())
+	if timeout <= 0 {
+		return fmt.Sprintf("while ! %s; do sleep 1; done;", wait)
+	}
+	status := 1
+	if template.FailurePolicy == configv1alpha1.FailurePolicyIgnore {
+		status = 0
+	}
+	return fmt.Sprintf("deadline=$(($(date +%%s) + %d)); "+
+		"while ! %s; do "+
+		"if [ $(date +%%s) -ge $deadline ]; then echo 'timed out waiting for the external IP'; exit %d; fi; "+
+		"sleep 1; done;", timeout, wait, status)
 }
 
 // PodWebhook implements admission.DecoderInjector.
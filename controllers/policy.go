@@ -0,0 +1,107 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	podexternalipv1alpha1 "github.com/yingeli/pod-external-ip-operator/api/v1alpha1"
+)
+
+//+kubebuilder:rbac:groups=podexternalip.yglab.eu.org,resources=externalippolicies,verbs=get;list;watch
+
+// checkExternalIPPolicies returns a message naming the external IPs of the
+// pod that no ExternalIPPolicy allows for its namespace or service account,
+// or an empty string if they are allowed. All external IPs are allowed while
+// there is no policy.
+func checkExternalIPPolicies(ctx context.Context, c client.Reader, pod *corev1.Pod) (string, error) {
+	var policies podexternalipv1alpha1.ExternalIPPolicyList
+	if err := c.List(ctx, &policies); err != nil {
+		return "", fmt.Errorf("error listing external IP policies: %v", err)
+	}
+	return checkPolicies(policies.Items, pod), nil
+}
+
+func checkPolicies(policies []podexternalipv1alpha1.ExternalIPPolicy, pod *corev1.Pod) string {
+	if len(policies) == 0 {
+		return ""
+	}
+	var denied []string
+	for _, externalIP := range parseExternalIPs(pod) {
+		allowed := false
+		for i := range policies {
+			if policyAppliesTo(&policies[i], pod) && policyAllows(&policies[i], externalIP) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			denied = append(denied, externalIP)
+		}
+	}
+	if len(denied) > 0 {
+		return fmt.Sprintf("external IP %s is not allowed for namespace %s or service account %s by any ExternalIPPolicy",
+			strings.Join(denied, ","), pod.Namespace, podServiceAccount(pod))
+	}
+	return ""
+}
+
+func policyAppliesTo(policy *podexternalipv1alpha1.ExternalIPPolicy, pod *corev1.Pod) bool {
+	for _, ns := range policy.Spec.Namespaces {
+		if ns == pod.Namespace {
+			return true
+		}
+	}
+	for _, sa := range policy.Spec.ServiceAccounts {
+		if sa == podServiceAccount(pod) {
+			return true
+		}
+	}
+	return false
+}
+
+func policyAllows(policy *podexternalipv1alpha1.ExternalIPPolicy, externalIP string) bool {
+	ip := net.ParseIP(externalIP)
+	if ip == nil {
+		return false
+	}
+	for _, allowed := range policy.Spec.ExternalIPs {
+		if _, ipNet, err := net.ParseCIDR(allowed); err == nil {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		} else if ip.Equal(net.ParseIP(allowed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// podServiceAccount returns the service account of the pod as namespace/name.
+func podServiceAccount(pod *corev1.Pod) string {
+	name := pod.Spec.ServiceAccountName
+	if name == "" {
+		name = "default"
+	}
+	return pod.Namespace + "/" + name
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	podexternalipv1alpha1 "github.com/yingeli/pod-external-ip-operator/api/v1alpha1"
+)
+
+func TestPolicyAllows(t *testing.T) {
+	policy := &podexternalipv1alpha1.ExternalIPPolicy{
+		Spec: podexternalipv1alpha1.ExternalIPPolicySpec{
+			ExternalIPs: []string{"20.10.0.1", "20.20.0.0/24", "2001:db8::1", "2001:db8:1::/64", "not-an-ip"},
+		},
+	}
+	tests := []struct {
+		externalIP string
+		want       bool
+	}{
+		{externalIP: "20.10.0.1", want: true},
+		{externalIP: "20.10.0.2", want: false},
+		{externalIP: "20.20.0.255", want: true},
+		{externalIP: "20.20.1.0", want: false},
+		{externalIP: "2001:db8:0::1", want: true},
+		{externalIP: "2001:db8:1::abcd", want: true},
+		{externalIP: "2001:db8:2::1", want: false},
+		{externalIP: "not-an-ip", want: false},
+		{externalIP: "", want: false},
+	}
+	for _, tt := range tests {
+		if got := policyAllows(policy, tt.externalIP); got != tt.want {
+			t.Errorf("policyAllows(%q) = %v, want %v", tt.externalIP, got, tt.want)
+		}
+	}
+}
+
+func TestCheckPolicies(t *testing.T) {
+	policies := []podexternalipv1alpha1.ExternalIPPolicy{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "web"},
+			Spec: podexternalipv1alpha1.ExternalIPPolicySpec{
+				Namespaces:  []string{"web"},
+				ExternalIPs: []string{"20.10.0.0/24"},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "crawler"},
+			Spec: podexternalipv1alpha1.ExternalIPPolicySpec{
+				ServiceAccounts: []string{"jobs/crawler"},
+				ExternalIPs:     []string{"20.20.0.1", "2001:db8::1"},
+			},
+		},
+	}
+	pod := func(namespace string, serviceAccount string, externalIP string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   namespace,
+				Name:        "pod",
+				Annotations: map[string]string{externalIPAnnotation: externalIP},
+			},
+			Spec: corev1.PodSpec{ServiceAccountName: serviceAccount},
+		}
+	}
+	tests := []struct {
+		name     string
+		policies []podexternalipv1alpha1.ExternalIPPolicy
+		pod      *corev1.Pod
+		want     string
+	}{
+		{
+			name: "no policy",
+			pod:  pod("web", "", "20.30.0.1"),
+			want: "",
+		},
+		{
+			name:     "allowed for the namespace",
+			policies: policies,
+			pod:      pod("web", "", "20.10.0.1"),
+			want:     "",
+		},
+		{
+			name:     "allowed for the service account",
+			policies: policies,
+			pod:      pod("jobs", "crawler", "20.20.0.1"),
+			want:     "",
+		},
+		{
+			name:     "dual-stack allowed",
+			policies: policies,
+			pod:      pod("jobs", "crawler", "20.20.0.1,2001:db8::1"),
+			want:     "",
+		},
+		{
+			name:     "allowed for another namespace",
+			policies: policies,
+			pod:      pod("jobs", "crawler", "20.10.0.1"),
+			want:     "external IP 20.10.0.1 is not allowed for namespace jobs or service account jobs/crawler by any ExternalIPPolicy",
+		},
+		{
+			name:     "allowed for another service account",
+			policies: policies,
+			pod:      pod("jobs", "", "20.20.0.1"),
+			want:     "external IP 20.20.0.1 is not allowed for namespace jobs or service account jobs/default by any ExternalIPPolicy",
+		},
+		{
+			name:     "one of the dual-stack IPs denied",
+			policies: policies,
+			pod:      pod("web", "", "20.10.0.1,2001:db8::1"),
+			want:     "external IP 2001:db8::1 is not allowed for namespace web or service account web/default by any ExternalIPPolicy",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkPolicies(tt.policies, tt.pod); got != tt.want {
+				t.Errorf("checkPolicies() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	podexternalipv1alpha1 "github.com/yingeli/pod-external-ip-operator/api/v1alpha1"
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+// Providers are the providers the operator is configured with.
+type Providers struct {
+	// Default is the name of the provider of the external IPs that no
+	// PodExternalIP or ExternalIPPolicy assigns to another provider.
+	Default string
+	// ByName are the providers by name, including the default one.
+	ByName map[string]providers.Provider
+}
+
+// names returns the names of the providers, sorted.
+func (p Providers) names() []string {
+	names := make([]string, 0, len(p.ByName))
+	for name := range p.ByName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// providerSelector picks the provider of an external IP: the provider of the
+// PodExternalIP of the IP if it names one, otherwise the provider of the first
+// ExternalIPPolicy, by name, that allows the IP and names one, otherwise the
+// default provider. The objects are only read when several providers are
+// configured.
+type providerSelector struct {
+	reader      client.Reader
+	defaultName string
+	names       []string
+}
+
+func (s *providerSelector) providerOf(ctx context.Context, externalIP string) (string, error) {
+	if len(s.names) == 1 {
+		return s.defaultName, nil
+	}
+
+	var pips podexternalipv1alpha1.PodExternalIPList
+	if err := s.reader.List(ctx, &pips); err != nil {
+		return "", fmt.Errorf("error listing PodExternalIPs: %v", err)
+	}
+	for _, pip := range pips.Items {
+		if pip.Spec.Provider != "" && normalizeIP(pip.Spec.IP) == normalizeIP(externalIP) {
+			return pip.Spec.Provider, nil
+		}
+	}
+
+	var policies podexternalipv1alpha1.ExternalIPPolicyList
+	if err := s.reader.List(ctx, &policies); err != nil {
+		return "", fmt.Errorf("error listing external IP policies: %v", err)
+	}
+	sort.Slice(policies.Items, func(i, j int) bool { return policies.Items[i].Name < policies.Items[j].Name })
+	for i := range policies.Items {
+		policy := &policies.Items[i]
+		if policy.Spec.Provider != "" && policyAllows(policy, externalIP) {
+			return policy.Spec.Provider, nil
+		}
+	}
+	return s.defaultName, nil
+}
+
+// providerAssociater associates every external IP with the associater of its
+// provider.
+type providerAssociater struct {
+	selector    *providerSelector
+	associaters map[string]providers.Associater
+}
+
+func newProviderAssociater(reader client.Reader, p Providers) *providerAssociater {
+	a := &providerAssociater{
+		selector:    &providerSelector{reader: reader, defaultName: p.Default, names: p.names()},
+		associaters: make(map[string]providers.Associater),
+	}
+	for name, provider := range p.ByName {
+		a.associaters[name] = provider.NewAssociater()
+	}
+	return a
+}
+
+func (a *providerAssociater) associater(ctx context.Context, externalIP string) (providers.Associater, error) {
+	name, err := a.selector.providerOf(ctx, externalIP)
+	if err != nil {
+		return nil, err
+	}
+	associater, ok := a.associaters[name]
+	if !ok {
+		return nil, fmt.Errorf("provider %q of external IP %s is not configured", name, externalIP)
+	}
+	return associater, nil
+}
+
+func (a *providerAssociater) Initialize(ctx context.Context, localNetworks []string) error {
+	for _, name := range a.selector.names {
+		if err := a.associaters[name].Initialize(ctx, localNetworks); err != nil {
+			return fmt.Errorf("error initializing provider %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (a *providerAssociater) SetLocalNetworks(ctx context.Context, localNetworks []string) error {
+	for _, name := range a.selector.names {
+		if err := a.associaters[name].SetLocalNetworks(ctx, localNetworks); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *providerAssociater) Associate(ctx context.Context, pod *corev1.Pod, localIP string, externalIP string) (bool, error) {
+	associater, err := a.associater(ctx, externalIP)
+	if err != nil {
+		return false, err
+	}
+	return associater.Associate(ctx, pod, localIP, externalIP)
+}
+
+func (a *providerAssociater) Dissociate(ctx context.Context, pod *corev1.Pod, localIP string, externalIP string) error {
+	associater, err := a.associater(ctx, externalIP)
+	if err != nil {
+		return err
+	}
+	return associater.Dissociate(ctx, pod, localIP, externalIP)
+}
+
+func (a *providerAssociater) Holder(ctx context.Context, externalIP string) (providers.Holder, error) {
+	associater, err := a.associater(ctx, externalIP)
+	if err != nil {
+		return providers.Holder{}, err
+	}
+	return associater.Holder(ctx, externalIP)
+}
+
+// Holders merges the holders of the external IPs of every provider.
+func (a *providerAssociater) Holders(ctx context.Context, node string) (map[string]providers.Holder, error) {
+	holders := make(map[string]providers.Holder)
+	for _, name := range a.selector.names {
+		h, err := a.associaters[name].Holders(ctx, node)
+		if err != nil {
+			return nil, err
+		}
+		for externalIP, holder := range h {
+			holders[externalIP] = holder
+		}
+	}
+	return holders, nil
+}
+
+func (a *providerAssociater) Release(ctx context.Context, externalIP string, holderID string) (bool, error) {
+	associater, err := a.associater(ctx, externalIP)
+	if err != nil {
+		return false, err
+	}
+	return associater.Release(ctx, externalIP, holderID)
+}
+
+// egressRules returns the first associater that programs the egress rules of
+// the node, or nil when none does.
+func (a *providerAssociater) egressRules() providers.EgressRules {
+	for _, name := range a.selector.names {
+		if associater, ok := a.associaters[name].(providers.EgressRules); ok {
+			return associater
+		}
+	}
+	return nil
+}
+
+// providerFinalizer finalizes every external IP with the finalizer of its
+// provider. The machines are checked by the default provider.
+type providerFinalizer struct {
+	selector   *providerSelector
+	finalizers map[string]providers.Finalizer
+}
+
+func newProviderFinalizer(reader client.Reader, p Providers) *providerFinalizer {
+	f := &providerFinalizer{
+		selector:   &providerSelector{reader: reader, defaultName: p.Default, names: p.names()},
+		finalizers: make(map[string]providers.Finalizer),
+	}
+	for name, provider := range p.ByName {
+		f.finalizers[name] = provider.NewFinalizer()
+	}
+	return f
+}
+
+func (f *providerFinalizer) Initialize(ctx context.Context) error {
+	for _, name := range f.selector.names {
+		if err := f.finalizers[name].Initialize(ctx); err != nil {
+			return fmt.Errorf("error initializing provider %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (f *providerFinalizer) Finalize(ctx context.Context, pod *corev1.Pod, localIP string, externalIP string) error {
+	name, err := f.selector.providerOf(ctx, externalIP)
+	if err != nil {
+		return err
+	}
+	finalizer, ok := f.finalizers[name]
+	if !ok {
+		return fmt.Errorf("provider %q of external IP %s is not configured", name, externalIP)
+	}
+	return finalizer.Finalize(ctx, pod, localIP, externalIP)
+}
+
+func (f *providerFinalizer) MachineExists(ctx context.Context, node *corev1.Node) (bool, error) {
+	return f.finalizers[f.selector.defaultName].MachineExists(ctx, node)
+}
+
+// addProviderChecks makes the daemon ready only while the checks of the
+// providers pass. The controller manager does not register them, since it
+// also serves the webhooks, which must not stop admitting pods while the
+// cloud provider is unreachable.
+func addProviderChecks(mgr ctrl.Manager, p Providers) error {
+	for _, name := range p.names() {
+		checker, ok := p.ByName[name].(providers.Checker)
+		if !ok {
+			continue
+		}
+		checks := checker.Checks()
+		checkNames := make([]string, 0, len(checks))
+		for checkName := range checks {
+			checkNames = append(checkNames, checkName)
+		}
+		sort.Strings(checkNames)
+		for _, checkName := range checkNames {
+			check := checks[checkName]
+			if len(p.ByName) > 1 {
+				checkName = name + "-" + checkName
+			}
+			if err := mgr.AddReadyzCheck(checkName, func(req *http.Request) error {
+				return check(req.Context())
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
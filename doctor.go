@@ -0,0 +1,183 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log/zap"
+
+	"github.com/yingeli/pod-external-ip-operator/controllers"
+)
+
+// runDoctor runs the doctor subcommand, which reports the inconsistencies
+// between the pods, the public IPs and the egress rules of the nodes. It
+// exits with 1 when it finds errors. The external IPs are listed from the
+// providers of the operator config file given with --config.
+func runDoctor(args []string) int {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	var configFile, output, namespace, daemonSelector, daemonCAFile, daemonServerName string
+	fs.StringVar(&configFile, "config", "",
+		"The operator config file the providers are read from. Omit this flag to use the default providers.")
+	var daemonPort int
+	var daemonTimeout time.Duration
+	fs.StringVar(&output, "output", "table",
+		"The output format, table or json.")
+	fs.StringVar(&namespace, "namespace", "pod-external-ip",
+		"The namespace of the daemons.")
+	fs.StringVar(&daemonSelector, "daemon-selector", "control-plane=daemon-manager",
+		"The label selector of the daemon pods.")
+	fs.IntVar(&daemonPort, "daemon-port", 8444,
+		"The port of the auth proxy of the daemons.")
+	fs.DurationVar(&daemonTimeout, "daemon-timeout", 10*time.Second,
+		"The timeout of the requests to the daemons, after which the egress rules of their node are reported unreadable.")
+	fs.StringVar(&daemonCAFile, "daemon-ca-file", "/tmp/k8s-daemon-metrics/ca.crt",
+		"The CA of the serving certificate of the auth proxy of the daemons.")
+	fs.StringVar(&daemonServerName, "daemon-server-name", "",
+		"The name the serving certificate of the auth proxy of the daemons is verified for. Defaults to daemon-metrics.<namespace>.svc.")
+	opts := zap.Options{
+		Development: true,
+	}
+	opts.BindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	if output != "table" && output != "json" {
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", output)
+		return 2
+	}
+	selector, err := labels.Parse(daemonSelector)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid daemon selector: %v\n", err)
+		return 2
+	}
+	if daemonServerName == "" {
+		daemonServerName = "daemon-metrics." + namespace + ".svc"
+	}
+
+	providerSet, err := loadProviders(configFile)
+	if err != nil {
+		setupLog.Error(err, "unable to create providers")
+		return 1
+	}
+	daemons := daemonOptions{
+		namespace:  namespace,
+		selector:   selector,
+		port:       daemonPort,
+		timeout:    daemonTimeout,
+		caFile:     daemonCAFile,
+		serverName: daemonServerName,
+	}
+	report, err := doctor(ctrl.SetupSignalHandler(), providerSet, daemons)
+	if err != nil {
+		setupLog.Error(err, "doctor failed")
+		return 1
+	}
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = printDoctorReport(report)
+	}
+	if err != nil {
+		setupLog.Error(err, "unable to print the report")
+		return 1
+	}
+	if report.Errors() > 0 {
+		return 1
+	}
+	return 0
+}
+
+// daemonOptions tell how the doctor reaches the auth proxy of the daemons.
+type daemonOptions struct {
+	namespace  string
+	selector   labels.Selector
+	port       int
+	timeout    time.Duration
+	caFile     string
+	serverName string
+}
+
+func doctor(ctx context.Context, providerSet controllers.Providers, daemons daemonOptions) (*controllers.DoctorReport, error) {
+	config := ctrl.GetConfigOrDie()
+	c, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+	transport, err := daemonTransport(config, daemons.caFile, daemons.serverName)
+	if err != nil {
+		return nil, err
+	}
+	d := controllers.Doctor{
+		Client:    c,
+		Providers: providerSet,
+		Daemons: &controllers.DaemonClient{
+			Client:    c,
+			HTTP:      &http.Client{Transport: transport, Timeout: daemons.timeout},
+			Namespace: daemons.namespace,
+			Selector:  daemons.selector,
+			Port:      daemons.port,
+		},
+	}
+	return d.Run(ctx)
+}
+
+// daemonTransport authenticates to the auth proxy of the daemons with the
+// token of config only, and verifies their certificate against caFile. The
+// daemons are reached by the IP of their node, so the certificate is verified
+// for serverName. The API server cannot proxy the requests, since it does not
+// pass the token on.
+func daemonTransport(config *rest.Config, caFile string, serverName string) (http.RoundTripper, error) {
+	if config.BearerToken == "" && config.BearerTokenFile == "" && config.AuthProvider == nil && config.ExecProvider == nil {
+		return nil, fmt.Errorf("the auth proxy of the daemons only accepts tokens, which the kubeconfig does not provide, run the doctor in the controller manager")
+	}
+	return rest.TransportFor(&rest.Config{
+		BearerToken:     config.BearerToken,
+		BearerTokenFile: config.BearerTokenFile,
+		AuthProvider:    config.AuthProvider,
+		ExecProvider:    config.ExecProvider,
+		TLSClientConfig: rest.TLSClientConfig{CAFile: caFile, ServerName: serverName},
+	})
+}
+
+func printDoctorReport(report *controllers.DoctorReport) error {
+	fmt.Printf("audited %d pods, %d external IPs and %d nodes\n", report.Pods, report.ExternalIPs, report.Nodes)
+	if len(report.Findings) == 0 {
+		fmt.Println("no inconsistencies found")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "SEVERITY\tKIND\tOBJECT\tMESSAGE")
+	for _, f := range report.Findings {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", f.Severity, f.Kind, f.Object, f.Message)
+	}
+	return w.Flush()
+}
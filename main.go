@@ -17,8 +17,12 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
 	"os"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -35,8 +39,12 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	configv1alpha1 "github.com/yingeli/pod-external-ip-operator/api/config/v1alpha1"
 	podexternalipv1alpha1 "github.com/yingeli/pod-external-ip-operator/api/v1alpha1"
 	"github.com/yingeli/pod-external-ip-operator/controllers"
+	"github.com/yingeli/pod-external-ip-operator/pkg/tracing"
+	"github.com/yingeli/pod-external-ip-operator/providers"
+	"github.com/yingeli/pod-external-ip-operator/providers/azurecni"
 	//+kubebuilder:scaffold:imports
 )
 
@@ -49,21 +57,145 @@ func init() {
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
 
 	utilruntime.Must(podexternalipv1alpha1.AddToScheme(scheme))
+	utilruntime.Must(configv1alpha1.AddToScheme(scheme))
 	//+kubebuilder:scaffold:scheme
 }
 
 func main() {
+	if len(os.Args) >= 2 && os.Args[1] == "cleanup" {
+		os.Exit(runCleanup(os.Args[2:]))
+	}
+	if len(os.Args) >= 2 && os.Args[1] == "doctor" {
+		os.Exit(runDoctor(os.Args[2:]))
+	}
+
 	runningDaemon := false
 	if len(os.Args) >= 2 && os.Args[1] == "daemon" {
 		runningDaemon = true
 	}
 
-	options, err := getOptions(runningDaemon)
+	var egressBackend string
+	flag.StringVar(&egressBackend, "egress-backend", azurecni.EgressBackendAuto,
+		"The daemon backend for egress rules of the azurecni provider: iptables, nftables or auto to detect it from the node. Fails when azurecni is not configured.")
+	var injectionMode string
+	flag.StringVar(&injectionMode, "injection-mode", controllers.InjectionModeInitContainer,
+		"How the pod webhook makes pods wait for their external IP: init-container or readiness-gate.")
+	backoff := controllers.DefaultBackoff
+	flag.DurationVar(&backoff.Initial, "ip-in-use-backoff", backoff.Initial,
+		"The daemon delay before retrying to associate an external IP that is in use. It doubles on each retry.")
+	flag.DurationVar(&backoff.Max, "ip-in-use-max-backoff", backoff.Max,
+		"The maximum daemon delay between the retries to associate an external IP that is in use.")
+	flag.IntVar(&backoff.Budget, "ip-in-use-retry-budget", backoff.Budget,
+		"The number of retries after which the daemon marks a pod whose external IP is in use as Stuck, 0 to never mark it.")
+	var nodeNotReadyTimeout time.Duration
+	flag.DurationVar(&nodeNotReadyTimeout, "handoff-node-not-ready-timeout", controllers.DefaultNodeNotReadyTimeout,
+		"How long the node of the pod holding an external IP may be NotReady before the daemon detaches the IP for another pod. Negative to never detach it.")
+	var egressDriftCheckPeriod time.Duration
+	flag.DurationVar(&egressDriftCheckPeriod, "egress-drift-check-period", controllers.DefaultEgressDriftCheckPeriod,
+		"How often the daemon compares the egress rules of its node with the desired ones and repairs them. Negative to never repair them, the readiness probe still checks them.")
+	var holderCheckPeriod time.Duration
+	flag.DurationVar(&holderCheckPeriod, "holder-check-period", controllers.DefaultHolderCheckInterval,
+		"How often the daemon checks that the external IPs of its associated pods are still attached to them.")
+	var debugEndpoints bool
+	flag.BoolVar(&debugEndpoints, "enable-debug-endpoints", false,
+		"Serve the daemon state at /debug/state and force reconciles at /debug/resync?pod=namespace/name on the metrics server.")
+	traceConfig := tracing.Config{ServiceName: "pod-external-ip-controller"}
+	if runningDaemon {
+		traceConfig.ServiceName = "pod-external-ip-daemon"
+	}
+	flag.StringVar(&traceConfig.Exporter, "trace-exporter", tracing.ExporterNone,
+		"The exporter of the traces: none, otlp or stdout.")
+	flag.StringVar(&traceConfig.Endpoint, "trace-endpoint", "",
+		"The host:port of the OTLP/HTTP collector. Defaults to OTEL_EXPORTER_OTLP_ENDPOINT or localhost:4318.")
+	flag.BoolVar(&traceConfig.Insecure, "trace-insecure", false,
+		"Disable TLS to the OTLP collector.")
+	flag.StringVar(&traceConfig.File, "trace-file", "",
+		"The file the stdout trace exporter writes to instead of stdout.")
+
+	operatorConfig := configv1alpha1.OperatorConfig{}
+	options, err := getOptions(runningDaemon, &operatorConfig)
 	if err != nil {
 		setupLog.Error(err, "unable to get options")
 		os.Exit(1)
 	}
 
+	// The flags that are set override the config file.
+	set := setFlags()
+	retry := &operatorConfig.Retry
+	if set["egress-backend"] {
+		if err := setEgressBackend(&operatorConfig, egressBackend); err != nil {
+			setupLog.Error(err, "invalid configuration")
+			os.Exit(1)
+		}
+	}
+	if set["injection-mode"] {
+		operatorConfig.InjectionMode = injectionMode
+	}
+	if set["ip-in-use-backoff"] {
+		retry.IPInUseBackoff.Duration = backoff.Initial
+	}
+	if set["ip-in-use-max-backoff"] {
+		retry.IPInUseMaxBackoff.Duration = backoff.Max
+	}
+	if set["ip-in-use-retry-budget"] {
+		budget := int32(backoff.Budget)
+		retry.IPInUseRetryBudget = &budget
+	}
+	if set["handoff-node-not-ready-timeout"] {
+		retry.HandoffNodeNotReadyTimeout.Duration = nodeNotReadyTimeout
+	}
+	if set["egress-drift-check-period"] {
+		operatorConfig.Intervals.EgressDriftCheck.Duration = egressDriftCheckPeriod
+	}
+	if set["holder-check-period"] {
+		operatorConfig.Intervals.HolderCheck.Duration = holderCheckPeriod
+	}
+	if set["enable-debug-endpoints"] {
+		operatorConfig.Debug.Endpoints = debugEndpoints
+	}
+	if set["trace-exporter"] {
+		operatorConfig.Tracing.Exporter = traceConfig.Exporter
+	}
+	if set["trace-endpoint"] {
+		operatorConfig.Tracing.Endpoint = traceConfig.Endpoint
+	}
+	if set["trace-insecure"] {
+		operatorConfig.Tracing.Insecure = traceConfig.Insecure
+	}
+	if set["trace-file"] {
+		operatorConfig.Tracing.File = traceConfig.File
+	}
+	if err := operatorConfig.Validate(); err != nil {
+		setupLog.Error(err, "invalid configuration")
+		os.Exit(1)
+	}
+
+	backoff = controllers.DefaultBackoff
+	if retry.IPInUseBackoff.Duration > 0 {
+		backoff.Initial = retry.IPInUseBackoff.Duration
+	}
+	if retry.IPInUseMaxBackoff.Duration > 0 {
+		backoff.Max = retry.IPInUseMaxBackoff.Duration
+	}
+	if retry.IPInUseRetryBudget != nil {
+		backoff.Budget = int(*retry.IPInUseRetryBudget)
+	}
+	traceConfig.Exporter = operatorConfig.Tracing.Exporter
+	traceConfig.Endpoint = operatorConfig.Tracing.Endpoint
+	traceConfig.Insecure = operatorConfig.Tracing.Insecure
+	traceConfig.File = operatorConfig.Tracing.File
+	providerSet, err := newProviders(&operatorConfig)
+	if err != nil {
+		setupLog.Error(err, "unable to create providers")
+		os.Exit(1)
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), traceConfig)
+	if err != nil {
+		setupLog.Error(err, "unable to set up tracing")
+		os.Exit(1)
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), options)
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
@@ -72,35 +204,70 @@ func main() {
 
 	if runningDaemon {
 		if err = (&controllers.DaemonPodReconciler{
-			Client: mgr.GetClient(),
-			Scheme: mgr.GetScheme(),
+			Client:                    mgr.GetClient(),
+			Scheme:                    mgr.GetScheme(),
+			Providers:                 providerSet,
+			Recorder:                  mgr.GetEventRecorderFor("pod-external-ip-daemon"),
+			Backoff:                   backoff,
+			NodeNotReadyTimeout:       retry.HandoffNodeNotReadyTimeout.Duration,
+			EgressDriftCheckPeriod:    operatorConfig.Intervals.EgressDriftCheck.Duration,
+			HolderCheckPeriod:         operatorConfig.Intervals.HolderCheck.Duration,
+			DebugEndpoints:            operatorConfig.Debug.Endpoints,
+			LocalNetworks:             operatorConfig.LocalNetworks,
+			ServiceCIDRs:              operatorConfig.ServiceCIDRs,
+			LocalNetworksResyncPeriod: operatorConfig.Intervals.LocalNetworksResync.Duration,
 		}).SetupWithManager(mgr); err != nil {
 			setupLog.Error(err, "unable to create controller", "controller", "Pod")
 			os.Exit(1)
 		}
 	} else {
 		if err = (&controllers.PodReconciler{
-			Client: mgr.GetClient(),
-			Scheme: mgr.GetScheme(),
+			Client:    mgr.GetClient(),
+			Scheme:    mgr.GetScheme(),
+			Recorder:  mgr.GetEventRecorderFor("pod-external-ip-controller"),
+			Providers: providerSet,
 		}).SetupWithManager(mgr); err != nil {
 			setupLog.Error(err, "unable to create controller", "controller", "Pod")
 			os.Exit(1)
 		}
 
+		if err = (&controllers.NodeReconciler{
+			Client:             mgr.GetClient(),
+			Scheme:             mgr.GetScheme(),
+			Recorder:           mgr.GetEventRecorderFor("pod-external-ip-controller"),
+			MachineCheckPeriod: operatorConfig.Intervals.NodeMachineCheck.Duration,
+			Providers:          providerSet,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Node")
+			os.Exit(1)
+		}
+
 		if err = (&podexternalipv1alpha1.PodExternalIP{}).SetupWebhookWithManager(mgr); err != nil {
 			setupLog.Error(err, "unable to create webhook", "webhook", "PodExternalIP")
 			os.Exit(1)
 		}
 
+		if err = (&podexternalipv1alpha1.ExternalIPPolicy{}).SetupWebhookWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "ExternalIPPolicy")
+			os.Exit(1)
+		}
+
 		// Setup pod webhook
 		setupLog.Info("setting up webhook server")
 		hookServer := mgr.GetWebhookServer()
 
 		setupLog.Info("registering webhooks to the webhook server")
-		hookServer.Register("/mutate-v1-pod", &webhook.Admission{Handler: &controllers.PodWebhook{Client: mgr.GetClient()}})
+		hookServer.Register("/mutate-v1-pod", &webhook.Admission{Handler: &controllers.PodWebhook{
+			Client:        mgr.GetClient(),
+			InjectionMode: operatorConfig.InjectionMode,
+			InitContainer: operatorConfig.InitContainer,
+		}})
+		hookServer.Register("/validate-v1-pod", &webhook.Admission{Handler: &controllers.PodValidator{Client: mgr.GetClient()}})
 	}
 	//+kubebuilder:scaffold:builder
 
+	// The reconcilers add the checks of the Azure token, ARM and the egress
+	// rules, see controllers/health.go.
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -111,13 +278,24 @@ func main() {
 	}
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	err = mgr.Start(ctrl.SetupSignalHandler())
+	if err := shutdownTracing(context.Background()); err != nil {
+		setupLog.Error(err, "problem shutting down tracing")
+	}
+	if err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
 }
 
-func getOptions(runningDaemon bool) (options ctrl.Options, err error) {
+// getOptions parses the flags and, if the --config flag is set, the operator
+// config file into operatorConfig. Flags that are set override the file.
+func getOptions(runningDaemon bool, operatorConfig *configv1alpha1.OperatorConfig) (options ctrl.Options, err error) {
+	var configFile string
+	flag.StringVar(&configFile, "config", "",
+		"The controller will load its initial configuration from this file. "+
+			"Omit this flag to use the default configuration values. "+
+			"Command-line flags override configuration from this file.")
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
@@ -130,17 +308,42 @@ func getOptions(runningDaemon bool) (options ctrl.Options, err error) {
 		Development: true,
 	}
 	opts.BindFlags(flag.CommandLine)
-	flag.Parse()
+	// The daemon subcommand comes before its flags.
+	args := os.Args[1:]
+	if runningDaemon {
+		args = os.Args[2:]
+	}
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return options, err
+	}
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
-	options = ctrl.Options{
-		Scheme:                 scheme,
-		MetricsBindAddress:     metricsAddr,
-		Port:                   9443,
-		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "pod-external-ip-controller.yingeli.github.com",
+	options = ctrl.Options{Scheme: scheme}
+	if configFile != "" {
+		options, err = options.AndFrom(ctrl.ConfigFile().AtPath(configFile).OfKind(operatorConfig))
+		if err != nil {
+			return options, fmt.Errorf("unable to load the config file %s: %v", configFile, err)
+		}
+	} else {
+		operatorConfig.Default()
+	}
+
+	set := setFlags()
+	if set["metrics-bind-address"] || options.MetricsBindAddress == "" {
+		options.MetricsBindAddress = metricsAddr
+	}
+	if set["health-probe-bind-address"] || options.HealthProbeBindAddress == "" {
+		options.HealthProbeBindAddress = probeAddr
+	}
+	if set["leader-elect"] {
+		options.LeaderElection = enableLeaderElection
+	}
+	if options.Port == 0 {
+		options.Port = 9443
+	}
+	if options.LeaderElectionID == "" {
+		options.LeaderElectionID = "pod-external-ip-controller.yingeli.github.com"
 	}
 
 	if runningDaemon {
@@ -158,3 +361,74 @@ func getOptions(runningDaemon bool) (options ctrl.Options, err error) {
 
 	return options, nil
 }
+
+// setFlags returns the names of the flags that are set on the command line.
+func setFlags() map[string]bool {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+// newProviders creates the providers of the operator config from their
+// registered factories.
+func newProviders(operatorConfig *configv1alpha1.OperatorConfig) (controllers.Providers, error) {
+	p := controllers.Providers{
+		Default: operatorConfig.Provider.Name,
+		ByName:  make(map[string]providers.Provider),
+	}
+	for _, c := range append([]configv1alpha1.ProviderConfig{operatorConfig.Provider}, operatorConfig.Providers...) {
+		provider, err := providers.New(c.Name, c.Config.Raw)
+		if err != nil {
+			return p, err
+		}
+		p.ByName[c.Name] = provider
+	}
+	return p, nil
+}
+
+// loadProviders creates the providers of the operator config file, or of the
+// default config when configFile is empty, for the subcommands.
+func loadProviders(configFile string) (controllers.Providers, error) {
+	operatorConfig := configv1alpha1.OperatorConfig{}
+	if configFile != "" {
+		if _, err := ctrl.ConfigFile().AtPath(configFile).OfKind(&operatorConfig).Complete(); err != nil {
+			return controllers.Providers{}, fmt.Errorf("unable to load the config file %s: %v", configFile, err)
+		}
+	} else {
+		operatorConfig.Default()
+	}
+	return newProviders(&operatorConfig)
+}
+
+// setEgressBackend overrides the egress backend of the azurecni provider, the
+// only one with egress rules. It fails when azurecni is not configured, rather
+// than ignoring the flag.
+func setEgressBackend(operatorConfig *configv1alpha1.OperatorConfig, backend string) error {
+	if operatorConfig.Provider.Name == azurecni.Name {
+		return setProviderConfig(&operatorConfig.Provider, "egressBackend", backend)
+	}
+	for i := range operatorConfig.Providers {
+		if operatorConfig.Providers[i].Name == azurecni.Name {
+			return setProviderConfig(&operatorConfig.Providers[i], "egressBackend", backend)
+		}
+	}
+	return fmt.Errorf("--egress-backend is only supported by the %s provider, which is not configured", azurecni.Name)
+}
+
+// setProviderConfig sets a field of the config of a provider, to override it
+// with a flag.
+func setProviderConfig(c *configv1alpha1.ProviderConfig, field string, value interface{}) error {
+	fields := make(map[string]interface{})
+	if len(c.Config.Raw) > 0 {
+		if err := json.Unmarshal(c.Config.Raw, &fields); err != nil {
+			return fmt.Errorf("invalid config of provider %s: %v", c.Name, err)
+		}
+	}
+	fields[field] = value
+	raw, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	c.Config.Raw = raw
+	return nil
+}
@@ -0,0 +1,583 @@
+// Package armsim simulates the Azure Resource Manager endpoints the operator
+// uses: the network interfaces, public IPs and virtual machines of a resource
+// group, and the asynchronous operations that update network interfaces. It
+// lets the pkg/azure functions be tested without Azure, pointed at the
+// simulator with config.SetResourceManager.
+package armsim
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/adal"
+)
+
+// Token is the bearer token the simulator accepts.
+const Token = "armsim"
+
+const (
+	// CodePublicIPAddressInUse is returned when a network interface references
+	// a public IP allocated to an IP configuration of another one.
+	CodePublicIPAddressInUse = "PublicIPAddressInUse"
+	// CodePublicIPReferencedByMultipleIPConfigs is returned when two IP
+	// configurations of a network interface reference the same public IP.
+	CodePublicIPReferencedByMultipleIPConfigs = "PublicIPReferencedByMultipleIPConfigs"
+	// CodeResourceNotFound is returned for resources that do not exist.
+	CodeResourceNotFound = "ResourceNotFound"
+	// CodeAuthenticationFailed is returned for requests without the token.
+	CodeAuthenticationFailed = "AuthenticationFailed"
+)
+
+// Error is an error the simulator answers a request with.
+type Error struct {
+	// Status is the HTTP status code, http.StatusBadRequest when zero.
+	Status  int
+	Code    string
+	Message string
+}
+
+// Request is a request the simulator received.
+type Request struct {
+	Method string
+	Path   string
+}
+
+// Server is an Azure Resource Manager simulator for one resource group.
+type Server struct {
+	// URL is the base URL of the simulator.
+	URL string
+	// PageSize is the number of public IPs in a page of a list, all of them
+	// when zero.
+	PageSize int
+	// Polls is the number of times an asynchronous operation is reported in
+	// progress before it completes.
+	Polls int
+
+	subscription  string
+	resourceGroup string
+	server        *httptest.Server
+
+	mu         sync.Mutex
+	nics       map[string]*networkInterface
+	publicIPs  map[string]*publicIPAddress
+	vms        map[string]*virtualMachine
+	operations map[string]*operation
+	nextID     int
+	faults     []fault
+	failedOps  []Error
+	requests   []Request
+}
+
+type fault struct {
+	method       string
+	resourceType string
+	err          Error
+}
+
+type operation struct {
+	polls int
+	err   *Error
+}
+
+// New starts a simulator of the resource group of the subscription. Close
+// it when done.
+func New(subscription string, resourceGroup string) *Server {
+	s := &Server{
+		subscription:  subscription,
+		resourceGroup: resourceGroup,
+		nics:          make(map[string]*networkInterface),
+		publicIPs:     make(map[string]*publicIPAddress),
+		vms:           make(map[string]*virtualMachine),
+		operations:    make(map[string]*operation),
+	}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	s.URL = s.server.URL
+	return s
+}
+
+// Close shuts the simulator down.
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// Authorizer returns an authorizer that sends the token the simulator
+// accepts.
+func (s *Server) Authorizer() autorest.Authorizer {
+	return autorest.NewBearerAuthorizer(&adal.Token{AccessToken: Token})
+}
+
+// AddPublicIP adds a public IP with the given address, and returns its ID.
+func (s *Server) AddPublicIP(name string, address string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pip := &publicIPAddress{
+		ID:       s.resourceID("Microsoft.Network", "publicIPAddresses", name),
+		Name:     name,
+		Type:     "Microsoft.Network/publicIPAddresses",
+		Location: location,
+	}
+	pip.Properties.IPAddress = address
+	pip.Properties.PublicIPAllocationMethod = "Static"
+	pip.Properties.ProvisioningState = succeeded
+	s.publicIPs[strings.ToLower(name)] = pip
+	return pip.ID
+}
+
+// AddNIC adds a network interface with an IP configuration for each of the
+// private IPs, named ipconfig1, ipconfig2 and so on, the first one primary.
+// It returns the ID of the network interface.
+func (s *Server) AddNIC(name string, privateIPs ...string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	nic := &networkInterface{Name: name, Location: location}
+	nic.Properties.Primary = true
+	for i, ip := range privateIPs {
+		ipconfig := ipConfiguration{Name: fmt.Sprintf("ipconfig%d", i+1)}
+		ipconfig.Properties.PrivateIPAddress = ip
+		ipconfig.Properties.PrivateIPAllocationMethod = "Static"
+		ipconfig.Properties.Primary = i == 0
+		nic.Properties.IPConfigurations = append(nic.Properties.IPConfigurations, ipconfig)
+	}
+	s.putNIC(nic)
+	return nic.ID
+}
+
+// AddVM adds a running virtual machine with the network interfaces, the
+// first one primary, and returns its ID. Add the network interfaces first.
+func (s *Server) AddVM(name string, nics ...string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	vm := &virtualMachine{
+		ID:       s.resourceID("Microsoft.Compute", "virtualMachines", name),
+		Name:     name,
+		Type:     "Microsoft.Compute/virtualMachines",
+		Location: location,
+	}
+	for i, nic := range nics {
+		ref := networkInterfaceReference{ID: s.resourceID("Microsoft.Network", "networkInterfaces", nic)}
+		ref.Properties.Primary = i == 0
+		vm.Properties.NetworkProfile.NetworkInterfaces = append(vm.Properties.NetworkProfile.NetworkInterfaces, ref)
+		if n, ok := s.nics[strings.ToLower(nic)]; ok {
+			n.Properties.VirtualMachine = &subResource{ID: vm.ID}
+		}
+	}
+	vm.Properties.ProvisioningState = succeeded
+	vm.powerState = "running"
+	s.vms[strings.ToLower(name)] = vm
+	return vm.ID
+}
+
+// SetPowerState sets the power state of a virtual machine, e.g.
+// "deallocated".
+func (s *Server) SetPowerState(vm string, state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.vms[strings.ToLower(vm)]; ok {
+		v.powerState = state
+	}
+}
+
+// AssociatePublicIP allocates a public IP to the IP configuration of a
+// network interface that has the private IP, taking it from the IP
+// configuration it was allocated to.
+func (s *Server) AssociatePublicIP(nic string, privateIP string, publicIP string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, ok := s.nics[strings.ToLower(nic)]
+	pip, found := s.publicIPs[strings.ToLower(publicIP)]
+	if !ok || !found {
+		return
+	}
+	for i := range n.Properties.IPConfigurations {
+		ipconfig := &n.Properties.IPConfigurations[i]
+		if ipconfig.Properties.PrivateIPAddress == privateIP {
+			s.release(ipconfig)
+			if holder := pip.Properties.IPConfiguration; holder != nil {
+				s.releaseFrom(holder.ID)
+			}
+			ipconfig.Properties.PublicIPAddress = &subResource{ID: pip.ID}
+			pip.Properties.IPConfiguration = &subResource{ID: ipconfig.ID}
+		}
+	}
+}
+
+// AllocatedTo returns the ID of the IP configuration a public IP is
+// allocated to, or an empty string.
+func (s *Server) AllocatedTo(publicIP string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pip, ok := s.publicIPs[strings.ToLower(publicIP)]; ok && pip.Properties.IPConfiguration != nil {
+		return pip.Properties.IPConfiguration.ID
+	}
+	return ""
+}
+
+// FailNext makes the next request with the method for a resource of the type,
+// e.g. "networkInterfaces" or "ipConfigurations", fail with err.
+func (s *Server) FailNext(method string, resourceType string, err Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, fault{method: method, resourceType: resourceType, err: err})
+}
+
+// FailNextOperation makes the next asynchronous operation fail with err once
+// it completes. The resource is left as it was.
+func (s *Server) FailNextOperation(err Error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failedOps = append(s.failedOps, err)
+}
+
+// Requests returns the requests received so far with the method for the
+// resource type. Empty arguments match any method or resource type.
+func (s *Server) Requests(method string, resourceType string) []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var requests []Request
+	for _, r := range s.requests {
+		if (method == "" || r.Method == method) && (resourceType == "" || strings.Contains(r.Path, "/"+resourceType)) {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+// ResetRequests forgets the requests received so far.
+func (s *Server) ResetRequests() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = nil
+}
+
+const (
+	location   = "local"
+	succeeded  = "Succeeded"
+	updating   = "Updating"
+	inProgress = "InProgress"
+	failed     = "Failed"
+)
+
+func (s *Server) resourceID(namespace string, resourceType string, name string) string {
+	return fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/%s/%s/%s",
+		s.subscription, s.resourceGroup, namespace, resourceType, name)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, Request{Method: r.Method, Path: r.URL.Path})
+
+	if r.Header.Get("Authorization") != "Bearer "+Token {
+		writeError(w, Error{Status: http.StatusUnauthorized, Code: CodeAuthenticationFailed,
+			Message: "Authentication failed. The 'Authorization' header is missing or invalid."})
+		return
+	}
+
+	// /subscriptions/{sub}/resourceGroups/{rg}/providers/{namespace}/{type}/{name}[/{type}/{name}]
+	// /subscriptions/{sub}/providers/{namespace}/locations/{location}/operations/{id}
+	segments := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(segments) < 2 || !strings.EqualFold(segments[0], "subscriptions") || !strings.EqualFold(segments[1], s.subscription) {
+		writeError(w, Error{Status: http.StatusNotFound, Code: "SubscriptionNotFound",
+			Message: fmt.Sprintf("The subscription of %s could not be found.", r.URL.Path)})
+		return
+	}
+	segments = segments[2:]
+
+	if len(segments) == 6 && strings.EqualFold(segments[4], "operations") {
+		if s.fail(w, r.Method, "operations") {
+			return
+		}
+		s.serveOperation(w, r, segments[5])
+		return
+	}
+	if len(segments) < 5 || !strings.EqualFold(segments[0], "resourceGroups") || !strings.EqualFold(segments[1], s.resourceGroup) {
+		writeError(w, Error{Status: http.StatusNotFound, Code: "ResourceGroupNotFound",
+			Message: fmt.Sprintf("Resource group of %s could not be found.", r.URL.Path)})
+		return
+	}
+	segments = segments[3:]
+	resourceType := segments[1]
+	if len(segments) == 5 {
+		resourceType = segments[3]
+	}
+	if s.fail(w, r.Method, resourceType) {
+		return
+	}
+
+	switch {
+	case len(segments) == 2 && r.Method == http.MethodGet && resourceType == "publicIPAddresses":
+		s.listPublicIPs(w, r)
+	case len(segments) == 3 && r.Method == http.MethodGet && resourceType == "publicIPAddresses":
+		s.getPublicIP(w, segments[2])
+	case len(segments) == 3 && r.Method == http.MethodGet && resourceType == "networkInterfaces":
+		s.getNIC(w, segments[2])
+	case len(segments) == 3 && r.Method == http.MethodPut && resourceType == "networkInterfaces":
+		s.updateNIC(w, r, segments[2])
+	case len(segments) == 5 && r.Method == http.MethodGet && resourceType == "ipConfigurations":
+		s.getIPConfiguration(w, segments[2], segments[4])
+	case len(segments) == 3 && r.Method == http.MethodGet && resourceType == "virtualMachines":
+		s.getVM(w, r, segments[2])
+	default:
+		writeError(w, Error{Status: http.StatusNotImplemented, Code: "NotImplemented",
+			Message: fmt.Sprintf("%s %s is not simulated.", r.Method, r.URL.Path)})
+	}
+}
+
+// fail answers the request with the first fault set for it, if any.
+func (s *Server) fail(w http.ResponseWriter, method string, resourceType string) bool {
+	for i, f := range s.faults {
+		if f.method == method && strings.EqualFold(f.resourceType, resourceType) {
+			s.faults = append(s.faults[:i], s.faults[i+1:]...)
+			writeError(w, f.err)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) listPublicIPs(w http.ResponseWriter, r *http.Request) {
+	names := make([]string, 0, len(s.publicIPs))
+	for name := range s.publicIPs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	start, _ := strconv.Atoi(r.URL.Query().Get("$skiptoken"))
+	end := len(names)
+	if s.PageSize > 0 && start+s.PageSize < end {
+		end = start + s.PageSize
+	}
+	result := publicIPAddressList{Value: []*publicIPAddress{}}
+	for _, name := range names[min(start, len(names)):end] {
+		result.Value = append(result.Value, s.publicIPs[name])
+	}
+	if end < len(names) {
+		query := r.URL.Query()
+		query.Set("$skiptoken", strconv.Itoa(end))
+		result.NextLink = s.URL + r.URL.Path + "?" + query.Encode()
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+func (s *Server) getPublicIP(w http.ResponseWriter, name string) {
+	pip, ok := s.publicIPs[strings.ToLower(name)]
+	if !ok {
+		writeError(w, notFound("Microsoft.Network/publicIPAddresses", name, s.resourceGroup))
+		return
+	}
+	writeJSON(w, http.StatusOK, pip)
+}
+
+func (s *Server) getNIC(w http.ResponseWriter, name string) {
+	nic, ok := s.nics[strings.ToLower(name)]
+	if !ok {
+		writeError(w, notFound("Microsoft.Network/networkInterfaces", name, s.resourceGroup))
+		return
+	}
+	writeJSON(w, http.StatusOK, nic)
+}
+
+func (s *Server) getIPConfiguration(w http.ResponseWriter, nicName string, name string) {
+	if nic, ok := s.nics[strings.ToLower(nicName)]; ok {
+		for _, ipconfig := range nic.Properties.IPConfigurations {
+			if strings.EqualFold(ipconfig.Name, name) {
+				writeJSON(w, http.StatusOK, ipconfig)
+				return
+			}
+		}
+	}
+	writeError(w, notFound("Microsoft.Network/networkInterfaces/ipConfigurations", nicName+"/"+name, s.resourceGroup))
+}
+
+func (s *Server) getVM(w http.ResponseWriter, r *http.Request, name string) {
+	vm, ok := s.vms[strings.ToLower(name)]
+	if !ok {
+		writeError(w, notFound("Microsoft.Compute/virtualMachines", name, s.resourceGroup))
+		return
+	}
+	v := *vm
+	if strings.EqualFold(r.URL.Query().Get("$expand"), "instanceView") {
+		v.Properties.InstanceView = &instanceView{Statuses: []instanceViewStatus{
+			{Code: "ProvisioningState/succeeded"},
+			{Code: "PowerState/" + vm.powerState},
+		}}
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// updateNIC replaces a network interface the way ARM does, refusing public
+// IPs allocated elsewhere, and answers with an asynchronous operation.
+func (s *Server) updateNIC(w http.ResponseWriter, r *http.Request, name string) {
+	nic := &networkInterface{}
+	if err := json.NewDecoder(r.Body).Decode(nic); err != nil {
+		writeError(w, Error{Code: "InvalidRequestFormat", Message: err.Error()})
+		return
+	}
+	nic.Name = name
+	nic.ID = s.resourceID("Microsoft.Network", "networkInterfaces", name)
+
+	referenced := make(map[string]bool)
+	for i := range nic.Properties.IPConfigurations {
+		ipconfig := &nic.Properties.IPConfigurations[i]
+		ipconfigID := nic.ID + "/ipConfigurations/" + ipconfig.Name
+		if ipconfig.Properties.PublicIPAddress == nil {
+			continue
+		}
+		pipID := ipconfig.Properties.PublicIPAddress.ID
+		pip, ok := s.publicIPs[strings.ToLower(lastSegment(pipID))]
+		if !ok {
+			writeError(w, Error{Code: "InvalidResourceReference",
+				Message: fmt.Sprintf("Resource %s referenced by resource %s was not found.", pipID, ipconfigID)})
+			return
+		}
+		if referenced[pip.ID] {
+			writeError(w, Error{Code: CodePublicIPReferencedByMultipleIPConfigs,
+				Message: fmt.Sprintf("Public IP address %s is referenced by multiple ipconfigs in resource %s.", pip.ID, nic.ID)})
+			return
+		}
+		referenced[pip.ID] = true
+		if holder := pip.Properties.IPConfiguration; holder != nil && !strings.EqualFold(holder.ID, ipconfigID) {
+			writeError(w, Error{Code: CodePublicIPAddressInUse,
+				Message: fmt.Sprintf("Resource %s is referencing public IP address %s that is already allocated to resource %s.",
+					ipconfigID, pip.ID, holder.ID)})
+			return
+		}
+	}
+
+	op := &operation{polls: s.Polls}
+	status := http.StatusOK
+	if old, ok := s.nics[strings.ToLower(name)]; !ok {
+		status = http.StatusCreated
+	} else {
+		// Read-only properties are not sent back.
+		nic.Properties.Primary = old.Properties.Primary
+		nic.Properties.VirtualMachine = old.Properties.VirtualMachine
+	}
+	if len(s.failedOps) > 0 {
+		op.err = &s.failedOps[0]
+		s.failedOps = s.failedOps[1:]
+	} else {
+		if old, ok := s.nics[strings.ToLower(name)]; ok {
+			for i := range old.Properties.IPConfigurations {
+				s.release(&old.Properties.IPConfigurations[i])
+			}
+		}
+		s.putNIC(nic)
+	}
+
+	s.nextID++
+	id := strconv.Itoa(s.nextID)
+	s.operations[id] = op
+	w.Header().Set("Azure-AsyncOperation", fmt.Sprintf("%s/subscriptions/%s/providers/Microsoft.Network/locations/%s/operations/%s",
+		s.URL, s.subscription, location, id))
+	w.Header().Set("Retry-After", "0")
+	// The ARM SDK takes the operation as completed when the resource it is
+	// answered with has succeeded.
+	response := *nic
+	response.Properties.ProvisioningState = updating
+	writeJSON(w, status, response)
+}
+
+func (s *Server) serveOperation(w http.ResponseWriter, r *http.Request, id string) {
+	op, ok := s.operations[id]
+	if !ok || r.Method != http.MethodGet {
+		writeError(w, notFound("Microsoft.Network/locations/operations", id, s.resourceGroup))
+		return
+	}
+	result := operationStatus{Status: succeeded}
+	switch {
+	case op.polls > 0:
+		op.polls--
+		result.Status = inProgress
+		w.Header().Set("Retry-After", "0")
+	case op.err != nil:
+		result.Status = failed
+		result.Error = &errorDetail{Code: op.err.Code, Message: op.err.Message}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// putNIC stores a network interface, completing the IDs of its IP
+// configurations and allocating the public IPs they reference to them.
+func (s *Server) putNIC(nic *networkInterface) {
+	nic.ID = s.resourceID("Microsoft.Network", "networkInterfaces", nic.Name)
+	nic.Type = "Microsoft.Network/networkInterfaces"
+	nic.Properties.ProvisioningState = succeeded
+	for i := range nic.Properties.IPConfigurations {
+		ipconfig := &nic.Properties.IPConfigurations[i]
+		ipconfig.ID = nic.ID + "/ipConfigurations/" + ipconfig.Name
+		ipconfig.Type = "Microsoft.Network/networkInterfaces/ipConfigurations"
+		ipconfig.Properties.ProvisioningState = succeeded
+		if ref := ipconfig.Properties.PublicIPAddress; ref != nil {
+			pip := s.publicIPs[strings.ToLower(lastSegment(ref.ID))]
+			ipconfig.Properties.PublicIPAddress = &subResource{ID: pip.ID}
+			pip.Properties.IPConfiguration = &subResource{ID: ipconfig.ID}
+		}
+	}
+	s.nics[strings.ToLower(nic.Name)] = nic
+}
+
+// release frees the public IP allocated to the IP configuration.
+func (s *Server) release(ipconfig *ipConfiguration) {
+	if ref := ipconfig.Properties.PublicIPAddress; ref != nil {
+		if pip, ok := s.publicIPs[strings.ToLower(lastSegment(ref.ID))]; ok && pip.Properties.IPConfiguration != nil &&
+			strings.EqualFold(pip.Properties.IPConfiguration.ID, ipconfig.ID) {
+			pip.Properties.IPConfiguration = nil
+		}
+		ipconfig.Properties.PublicIPAddress = nil
+	}
+}
+
+// releaseFrom frees the public IP allocated to the IP configuration with the
+// ID.
+func (s *Server) releaseFrom(ipconfigID string) {
+	for _, nic := range s.nics {
+		for i := range nic.Properties.IPConfigurations {
+			if ipconfig := &nic.Properties.IPConfigurations[i]; strings.EqualFold(ipconfig.ID, ipconfigID) {
+				s.release(ipconfig)
+			}
+		}
+	}
+}
+
+func notFound(resourceType string, name string, resourceGroup string) Error {
+	return Error{Status: http.StatusNotFound, Code: CodeResourceNotFound,
+		Message: fmt.Sprintf("The Resource '%s/%s' under resource group '%s' was not found.", resourceType, name, resourceGroup)}
+}
+
+func writeError(w http.ResponseWriter, err Error) {
+	status := err.Status
+	if status == 0 {
+		status = http.StatusBadRequest
+	}
+	// The ARM SDK retries throttled requests until they succeed, after 30
+	// seconds unless it is told otherwise.
+	if status == http.StatusTooManyRequests {
+		w.Header().Set("Retry-After", "1")
+	}
+	writeJSON(w, status, errorResponse{Error: errorDetail{Code: err.Code, Message: err.Message}})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func lastSegment(id string) string {
+	return id[strings.LastIndex(id, "/")+1:]
+}
+
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
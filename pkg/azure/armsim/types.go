@@ -0,0 +1,99 @@
+package armsim
+
+// The wire format of the simulated resources. The types of the ARM SDK leave
+// the read-only properties out when they are marshalled, so they cannot be
+// used to answer requests.
+
+type subResource struct {
+	ID string `json:"id"`
+}
+
+type errorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type errorResponse struct {
+	Error errorDetail `json:"error"`
+}
+
+type operationStatus struct {
+	Status string       `json:"status"`
+	Error  *errorDetail `json:"error,omitempty"`
+}
+
+type publicIPAddress struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Location   string `json:"location"`
+	Properties struct {
+		IPAddress                string       `json:"ipAddress,omitempty"`
+		PublicIPAllocationMethod string       `json:"publicIPAllocationMethod,omitempty"`
+		IPConfiguration          *subResource `json:"ipConfiguration,omitempty"`
+		ProvisioningState        string       `json:"provisioningState,omitempty"`
+	} `json:"properties"`
+}
+
+type publicIPAddressList struct {
+	Value    []*publicIPAddress `json:"value"`
+	NextLink string             `json:"nextLink,omitempty"`
+}
+
+type ipConfiguration struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Type       string `json:"type,omitempty"`
+	Properties struct {
+		PrivateIPAddress          string       `json:"privateIPAddress,omitempty"`
+		PrivateIPAllocationMethod string       `json:"privateIPAllocationMethod,omitempty"`
+		Primary                   bool         `json:"primary"`
+		PublicIPAddress           *subResource `json:"publicIPAddress,omitempty"`
+		Subnet                    *subResource `json:"subnet,omitempty"`
+		ProvisioningState         string       `json:"provisioningState,omitempty"`
+	} `json:"properties"`
+}
+
+type networkInterface struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Location   string `json:"location"`
+	Properties struct {
+		Primary           bool              `json:"primary"`
+		VirtualMachine    *subResource      `json:"virtualMachine,omitempty"`
+		IPConfigurations  []ipConfiguration `json:"ipConfigurations"`
+		ProvisioningState string            `json:"provisioningState,omitempty"`
+	} `json:"properties"`
+}
+
+type networkInterfaceReference struct {
+	ID         string `json:"id"`
+	Properties struct {
+		Primary bool `json:"primary"`
+	} `json:"properties"`
+}
+
+type instanceViewStatus struct {
+	Code string `json:"code"`
+}
+
+type instanceView struct {
+	Statuses []instanceViewStatus `json:"statuses"`
+}
+
+type virtualMachine struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	Location   string `json:"location"`
+	Properties struct {
+		NetworkProfile struct {
+			NetworkInterfaces []networkInterfaceReference `json:"networkInterfaces"`
+		} `json:"networkProfile"`
+		InstanceView      *instanceView `json:"instanceView,omitempty"`
+		ProvisioningState string        `json:"provisioningState,omitempty"`
+	} `json:"properties"`
+
+	powerState string
+}
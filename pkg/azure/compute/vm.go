@@ -5,32 +5,42 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"regexp"
+	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/services/compute/mgmt/2019-07-01/compute"
+	aznetwork "github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-11-01/network"
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/azure"
 	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/config"
 	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/iam"
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/instrument"
 	"github.com/yingeli/pod-external-ip-operator/pkg/azure/network"
+	"github.com/yingeli/pod-external-ip-operator/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func getVMClient() compute.VirtualMachinesClient {
 	//vmClient := compute.NewVirtualMachinesClient(config.SubscriptionID())
 	vmClient := compute.NewVirtualMachinesClientWithBaseURI(
-		config.Environment().ResourceManagerEndpoint, config.SubscriptionID())
+		config.ResourceManagerEndpoint(), config.SubscriptionID())
 	a, _ := iam.GetResourceManagementAuthorizer()
 	vmClient.Authorizer = a
 	vmClient.AddToUserAgent(config.UserAgent())
+	vmClient.Sender = instrument.Sender()
 	return vmClient
 }
 
 func getVMExtensionsClient() compute.VirtualMachineExtensionsClient {
-	extClient := compute.NewVirtualMachineExtensionsClient(config.SubscriptionID())
+	extClient := compute.NewVirtualMachineExtensionsClientWithBaseURI(
+		config.ResourceManagerEndpoint(), config.SubscriptionID())
 	a, _ := iam.GetResourceManagementAuthorizer()
 	extClient.Authorizer = a
 	extClient.AddToUserAgent(config.UserAgent())
+	extClient.Sender = instrument.Sender()
 	return extClient
 }
 
@@ -104,7 +114,7 @@ func CreateVM(ctx context.Context, vmName, nicName, username, password, sshPubli
 		return vm, fmt.Errorf("cannot create vm: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, vmClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, vmClient.Client)
 	if err != nil {
 		return vm, fmt.Errorf("cannot get the vm create or update future response: %v", err)
 	}
@@ -118,6 +128,35 @@ func GetVM(ctx context.Context, vmName string) (compute.VirtualMachine, error) {
 	return vmClient.Get(ctx, config.GroupName(), vmName, compute.InstanceView)
 }
 
+// GetVMPowerState returns the power state of a VM, e.g. "running" or
+// "deallocated", and whether the VM exists.
+func GetVMPowerState(ctx context.Context, vmName string) (state string, found bool, err error) {
+	return GetVMPowerStateInGroup(ctx, config.GroupName(), vmName)
+}
+
+// GetVMPowerStateInGroup returns the power state of a VM of the given
+// resource group, and whether the VM exists.
+func GetVMPowerStateInGroup(ctx context.Context, groupName string, vmName string) (state string, found bool, err error) {
+	ctx, span := tracing.Start(ctx, "GetVMPowerState", attribute.String("group", groupName), attribute.String("vm", vmName))
+	defer func() { tracing.End(span, err) }()
+	vmClient := getVMClient()
+	vm, err := vmClient.Get(ctx, groupName, vmName, compute.InstanceView)
+	if err != nil {
+		if detailed, ok := err.(autorest.DetailedError); ok && detailed.StatusCode == http.StatusNotFound {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	if vm.InstanceView != nil && vm.InstanceView.Statuses != nil {
+		for _, status := range *vm.InstanceView.Statuses {
+			if code := to.String(status.Code); strings.HasPrefix(code, "PowerState/") {
+				return strings.TrimPrefix(code, "PowerState/"), true, nil
+			}
+		}
+	}
+	return "", true, nil
+}
+
 // UpdateVM modifies the VM resource by getting it, updating it locally, and
 // putting it back to the server.
 func UpdateVM(ctx context.Context, vmName string, tags map[string]*string) (vm compute.VirtualMachine, err error) {
@@ -138,7 +177,7 @@ func UpdateVM(ctx context.Context, vmName string, tags map[string]*string) (vm c
 		return vm, fmt.Errorf("cannot update vm: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, vmClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, vmClient.Client)
 	if err != nil {
 		return vm, fmt.Errorf("cannot get the vm create or update future response: %v", err)
 	}
@@ -154,7 +193,7 @@ func DeallocateVM(ctx context.Context, vmName string) (osr autorest.Response, er
 		return osr, fmt.Errorf("cannot deallocate vm: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, vmClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, vmClient.Client)
 	if err != nil {
 		return osr, fmt.Errorf("cannot get the vm deallocate future response: %v", err)
 	}
@@ -170,7 +209,7 @@ func StartVM(ctx context.Context, vmName string) (osr autorest.Response, err err
 		return osr, fmt.Errorf("cannot start vm: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, vmClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, vmClient.Client)
 	if err != nil {
 		return osr, fmt.Errorf("cannot get the vm start future response: %v", err)
 	}
@@ -186,7 +225,7 @@ func RestartVM(ctx context.Context, vmName string) (osr autorest.Response, err e
 		return osr, fmt.Errorf("cannot restart vm: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, vmClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, vmClient.Client)
 	if err != nil {
 		return osr, fmt.Errorf("cannot get the vm restart future response: %v", err)
 	}
@@ -203,7 +242,7 @@ func StopVM(ctx context.Context, vmName string) (osr autorest.Response, err erro
 		return osr, fmt.Errorf("cannot power off vm: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, vmClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, vmClient.Client)
 	if err != nil {
 		return osr, fmt.Errorf("cannot get the vm power off future response: %v", err)
 	}
@@ -211,58 +250,109 @@ func StopVM(ctx context.Context, vmName string) (osr autorest.Response, err erro
 	return future.Result(vmClient)
 }
 
-func AssociateVMPrivateIPWithPublicIP(ctx context.Context, vmName string, privateIPAddr string, publicIPAddr string) error {
-	pip, found, err := network.LookupPublicIP(ctx, publicIPAddr)
-	if err != nil {
-		return fmt.Errorf("LookupPublicIP error: %v", err)
-	}
-	if !found {
-		return fmt.Errorf("LookupPublicIP cannot find public ip %s", publicIPAddr)
-	}
-
+// getPrimaryNic returns the primary network interface of a VM
+func getPrimaryNic(ctx context.Context, vmName string) (nic aznetwork.Interface, err error) {
 	vm, err := GetVM(ctx, vmName)
 	if err != nil {
-		return fmt.Errorf("GetVM error: %v", err)
+		return nic, fmt.Errorf("GetVM error: %v", err)
 	}
 
 	for _, ni := range *vm.NetworkProfile.NetworkInterfaces {
 		resource, err := azure.ParseResourceID(*ni.ID)
 		if err != nil {
-			return fmt.Errorf("ParseResourceID error: %v", err)
+			return nic, fmt.Errorf("ParseResourceID error: %v", err)
 		}
 
 		nic, err := network.GetNic(ctx, resource.ResourceName)
 		if err != nil {
-			return fmt.Errorf("GetNic error: %v", err)
+			return nic, fmt.Errorf("GetNic error: %v", err)
 		}
 
 		if nic.Primary == nil || *nic.Primary {
-			return network.AssociateNicPrivateIPWithPublicIP(ctx, nic, privateIPAddr, pip)
+			return nic, nil
 		}
 	}
-	return fmt.Errorf("cannot find primary nic on VM %s", vmName)
+	return nic, fmt.Errorf("cannot find primary nic on VM %s", vmName)
 }
 
-func DissociateVMPrivateIPWithPublicIP(ctx context.Context, vmName string, privateIPAddr string, publicIPAddr string) error {
-	vm, err := GetVM(ctx, vmName)
+func AssociateVMPrivateIPWithPublicIP(ctx context.Context, vmName string, privateIPAddr string, publicIPAddr string) (err error) {
+	ctx, span := tracing.Start(ctx, "AssociateVMPrivateIPWithPublicIP", attribute.String("vm", vmName), attribute.String("privateIP", privateIPAddr), attribute.String("publicIP", publicIPAddr))
+	defer func() { tracing.End(span, err) }()
+	pip, found, err := network.LookupPublicIP(ctx, publicIPAddr)
 	if err != nil {
-		return fmt.Errorf("GetVM error: %v", err)
+		return fmt.Errorf("LookupPublicIP error: %v", err)
+	}
+	if !found {
+		return fmt.Errorf("LookupPublicIP cannot find public ip %s", publicIPAddr)
 	}
 
-	for _, ni := range *vm.NetworkProfile.NetworkInterfaces {
-		resource, err := azure.ParseResourceID(*ni.ID)
-		if err != nil {
-			return fmt.Errorf("ParseResourceID error: %v", err)
-		}
+	nic, err := getPrimaryNic(ctx, vmName)
+	if err != nil {
+		return err
+	}
+	return network.AssociateNicPrivateIPWithPublicIP(ctx, nic, privateIPAddr, pip)
+}
 
-		nic, err := network.GetNic(ctx, resource.ResourceName)
-		if err != nil {
-			return fmt.Errorf("GetNic error: %v", err)
-		}
+func DissociateVMPrivateIPWithPublicIP(ctx context.Context, vmName string, privateIPAddr string, publicIPAddr string) (err error) {
+	ctx, span := tracing.Start(ctx, "DissociateVMPrivateIPWithPublicIP", attribute.String("vm", vmName), attribute.String("privateIP", privateIPAddr), attribute.String("publicIP", publicIPAddr))
+	defer func() { tracing.End(span, err) }()
+	nic, err := getPrimaryNic(ctx, vmName)
+	if err != nil {
+		return err
+	}
+	return network.DissociateNicPrivateIPWithPublicIP(ctx, &nic, privateIPAddr, publicIPAddr)
+}
 
-		if nic.Primary == nil || *nic.Primary {
-			return network.DissociateNicPrivateIPWithPublicIP(ctx, &nic, privateIPAddr, publicIPAddr)
-		}
+// GetVMVirtualNetworkPrefixes returns the address prefixes of the virtual
+// networks the primary network interface of a VM is attached to.
+func GetVMVirtualNetworkPrefixes(ctx context.Context, vmName string) (prefixes []string, err error) {
+	ctx, span := tracing.Start(ctx, "GetVMVirtualNetworkPrefixes", attribute.String("vm", vmName))
+	defer func() { tracing.End(span, err) }()
+	nic, err := getPrimaryNic(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+	return network.GetNicVirtualNetworkPrefixes(ctx, nic)
+}
+
+// GetVMIPConfigurations returns the IP configurations of the primary network
+// interface of a VM.
+func GetVMIPConfigurations(ctx context.Context, vmName string) (ipconfigs []aznetwork.InterfaceIPConfiguration, err error) {
+	ctx, span := tracing.Start(ctx, "GetVMIPConfigurations", attribute.String("vm", vmName))
+	defer func() { tracing.End(span, err) }()
+	nic, err := getPrimaryNic(ctx, vmName)
+	if err != nil {
+		return nil, err
+	}
+	if nic.InterfacePropertiesFormat == nil || nic.IPConfigurations == nil {
+		return nil, nil
 	}
-	return fmt.Errorf("cannot find primary nic on VM %s", vmName)
+	return *nic.IPConfigurations, nil
+}
+
+// VMResource is the VM a node runs on.
+type VMResource struct {
+	SubscriptionID string
+	ResourceGroup  string
+	Name           string
+}
+
+// ParseVMProviderID parses the provider ID of a node that runs on a VM,
+// e.g. azure:///subscriptions/<id>/resourceGroups/<group>/providers/Microsoft.Compute/virtualMachines/<name>.
+// It fails for the other provider IDs, e.g. the ones of the instances of a
+// scale set.
+func ParseVMProviderID(providerID string) (resource VMResource, err error) {
+	const providerIDPatternText = `(?i)^azure:///subscriptions/([^/]+)/resourceGroups/([^/]+)/providers/Microsoft.Compute/virtualMachines/([^/]+)$`
+	providerIDPattern := regexp.MustCompile(providerIDPatternText)
+	match := providerIDPattern.FindStringSubmatch(providerID)
+
+	if len(match) != 4 {
+		return resource, fmt.Errorf("parsing failed for %s. Invalid VM provider ID format", providerID)
+	}
+
+	return VMResource{
+		SubscriptionID: match[1],
+		ResourceGroup:  match[2],
+		Name:           match[3],
+	}, nil
 }
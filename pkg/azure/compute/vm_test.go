@@ -0,0 +1,72 @@
+package compute
+
+import (
+	"context"
+	"testing"
+
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/armsim"
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/config"
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/iam"
+)
+
+func newSimulator(t *testing.T) *armsim.Server {
+	s := armsim.New("00000000-0000-0000-0000-000000000000", "rg")
+	config.SetGroup("AzurePublicCloud", "00000000-0000-0000-0000-000000000000", "rg")
+	config.SetResourceManagerEndpoint(s.URL)
+	iam.SetResourceManagementAuthorizer(s.Authorizer())
+	t.Cleanup(func() {
+		config.SetResourceManagerEndpoint("")
+		iam.SetResourceManagementAuthorizer(nil)
+		s.Close()
+	})
+	return s
+}
+
+func TestGetVMPowerState(t *testing.T) {
+	ctx := context.Background()
+	s := newSimulator(t)
+	s.AddNIC("vm-0-nic", "10.0.0.4")
+	s.AddVM("vm-0", "vm-0-nic")
+	s.AddNIC("vm-1-nic", "10.0.0.5")
+	s.AddVM("vm-1", "vm-1-nic")
+	s.SetPowerState("vm-1", "deallocated")
+
+	tests := []struct {
+		vm        string
+		wantState string
+		wantFound bool
+	}{
+		{vm: "vm-0", wantState: "running", wantFound: true},
+		{vm: "vm-1", wantState: "deallocated", wantFound: true},
+		{vm: "vm-2", wantState: "", wantFound: false},
+	}
+	for _, tt := range tests {
+		state, found, err := GetVMPowerState(ctx, tt.vm)
+		if err != nil || state != tt.wantState || found != tt.wantFound {
+			t.Errorf("GetVMPowerState(%q) = %q, %v, %v, want %q, %v, nil", tt.vm, state, found, err, tt.wantState, tt.wantFound)
+		}
+	}
+}
+
+func TestAssociateVMPrivateIPWithPublicIP(t *testing.T) {
+	ctx := context.Background()
+	s := newSimulator(t)
+	s.AddPublicIP("pip-1", "20.0.0.1")
+	nicID := s.AddNIC("vm-0-nic", "10.0.0.4", "10.0.0.5")
+	s.AddVM("vm-0", "vm-0-nic")
+	s.Polls = 1
+
+	if err := AssociateVMPrivateIPWithPublicIP(ctx, "vm-0", "10.0.0.5", "20.0.0.1"); err != nil {
+		t.Fatalf("AssociateVMPrivateIPWithPublicIP() = %v", err)
+	}
+	if got, want := s.AllocatedTo("pip-1"), nicID+"/ipConfigurations/ipconfig2"; got != want {
+		t.Errorf("public IP allocated to %q, want %q", got, want)
+	}
+
+	if err := DissociateVMPrivateIPWithPublicIP(ctx, "vm-0", "10.0.0.5", "20.0.0.1"); err != nil {
+		t.Fatalf("DissociateVMPrivateIPWithPublicIP() = %v", err)
+	}
+	if got := s.AllocatedTo("pip-1"); got != "" {
+		t.Errorf("public IP allocated to %q, want none", got)
+	}
+}
@@ -1,13 +1,51 @@
 package config
 
 import (
+	"context"
+
+	"github.com/Azure/go-autorest/autorest"
+
 	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/config"
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/iam"
 )
 
+var credentialsFile string
+
+// SetCredentialsFile makes ParseEnvironment read the credentials that are not
+// set in the environment from a file.
+func SetCredentialsFile(path string) {
+	credentialsFile = path
+}
+
 func ParseEnvironment() error {
-	return config.ParseEnvironment()
+	if err := config.ParseEnvironment(); err != nil {
+		return err
+	}
+	if credentialsFile != "" {
+		return config.ParseCredentialsFile(credentialsFile)
+	}
+	return nil
 }
 
 func SetGroup(cloud string, subscription string, group string) {
 	config.SetGroup(cloud, subscription, group)
 }
+
+// SetResourceManager sends the requests of the clients to the Azure Resource
+// Manager at baseURL, authorized by authorizer, instead of the one of the
+// cloud. Tests use it to run against a simulator.
+func SetResourceManager(baseURL string, authorizer autorest.Authorizer) {
+	config.SetResourceManagerEndpoint(baseURL)
+	iam.SetResourceManagementAuthorizer(authorizer)
+}
+
+// EnsureToken acquires the Azure Resource Manager token, or refreshes it
+// when it is about to expire.
+func EnsureToken(ctx context.Context) error {
+	return iam.EnsureResourceManagementToken(ctx)
+}
+
+// SubscriptionID returns the subscription the resources are looked up in.
+func SubscriptionID() string {
+	return config.SubscriptionID()
+}
@@ -8,6 +8,7 @@ import (
 
 type Metadata struct {
 	Compute Compute
+	Network Network
 }
 
 type Compute struct {
@@ -20,6 +21,40 @@ type Compute struct {
 	VmScaleSetName    string
 }
 
+type Network struct {
+	Interface []Interface
+}
+
+type Interface struct {
+	IPv4       IPAddresses
+	IPv6       IPAddresses
+	MacAddress string
+}
+
+type IPAddresses struct {
+	Subnet []Subnet
+}
+
+type Subnet struct {
+	Address string
+	Prefix  string
+}
+
+// SubnetPrefixes returns the prefixes of the subnets of all network
+// interfaces, e.g. 10.240.0.0/16.
+func (m Metadata) SubnetPrefixes() []string {
+	var prefixes []string
+	for _, ni := range m.Network.Interface {
+		subnets := append(ni.IPv4.Subnet, ni.IPv6.Subnet...)
+		for _, s := range subnets {
+			if s.Address != "" && s.Prefix != "" {
+				prefixes = append(prefixes, s.Address+"/"+s.Prefix)
+			}
+		}
+	}
+	return prefixes
+}
+
 func GetMetadata() (Metadata, error) {
 	var PTransport = &http.Transport{Proxy: nil}
 
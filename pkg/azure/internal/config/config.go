@@ -27,6 +27,7 @@ var (
 	baseGroupName          string
 	userAgent              string
 	environment            *azure.Environment
+	resourceManagerURL     string
 )
 
 // ClientID is the OAuth client ID.
@@ -119,6 +120,21 @@ func Environment() *azure.Environment {
 	return environment
 }
 
+// ResourceManagerEndpoint returns the base URL of Azure Resource Manager, the
+// one set by SetResourceManagerEndpoint or else the one of the current cloud.
+func ResourceManagerEndpoint() string {
+	if resourceManagerURL != "" {
+		return resourceManagerURL
+	}
+	return Environment().ResourceManagerEndpoint
+}
+
+// SetResourceManagerEndpoint overrides the base URL of Azure Resource Manager,
+// e.g. to send the requests to a simulator.
+func SetResourceManagerEndpoint(url string) {
+	resourceManagerURL = url
+}
+
 // GenerateGroupName leverages BaseGroupName() to return a more detailed name,
 // helping to avoid collisions.  It appends each of the `affixes` to
 // BaseGroupName() separated by dashes, and adds a 5-character random string.
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// credentialsFile is the subset of the azure.json file of the AKS nodes, or of
+// the cloud provider config, holding the service principal.
+type credentialsFile struct {
+	ClientID       string `json:"aadClientId"`
+	ClientSecret   string `json:"aadClientSecret"`
+	TenantID       string `json:"tenantId"`
+	SubscriptionID string `json:"subscriptionId"`
+}
+
+// ParseCredentialsFile reads the service principal from a credentials file.
+// The values already set by the environment take precedence.
+func ParseCredentialsFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var creds credentialsFile
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return fmt.Errorf("invalid credentials file %s: %v", path, err)
+	}
+
+	if clientID == "" {
+		clientID = creds.ClientID
+	}
+	if clientSecret == "" {
+		clientSecret = creds.ClientSecret
+	}
+	if tenantID == "" {
+		tenantID = creds.TenantID
+	}
+	if subscriptionID == "" {
+		subscriptionID = creds.SubscriptionID
+	}
+	return nil
+}
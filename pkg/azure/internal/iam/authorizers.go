@@ -6,6 +6,7 @@
 package iam
 
 import (
+	"context"
 	"fmt"
 	"net/url"
 	"strings"
@@ -64,6 +65,29 @@ func GetResourceManagementAuthorizer() (autorest.Authorizer, error) {
 	return armAuthorizer, err
 }
 
+// SetResourceManagementAuthorizer replaces the authorizer returned by
+// GetResourceManagementAuthorizer, or clears it when a is nil.
+func SetResourceManagementAuthorizer(a autorest.Authorizer) {
+	armAuthorizer = a
+}
+
+// EnsureResourceManagementToken acquires the token of the Azure Resource
+// Manager authorizer, or refreshes it when it is about to expire.
+func EnsureResourceManagementToken(ctx context.Context) error {
+	a, err := GetResourceManagementAuthorizer()
+	if err != nil {
+		return err
+	}
+	bearer, ok := a.(*autorest.BearerAuthorizer)
+	if !ok {
+		return nil
+	}
+	if refresher, ok := bearer.TokenProvider().(adal.RefresherWithContext); ok {
+		return refresher.EnsureFreshWithContext(ctx)
+	}
+	return nil
+}
+
 // GetBatchAuthorizer gets an OAuthTokenAuthorizer for Azure Batch.
 func GetBatchAuthorizer() (autorest.Authorizer, error) {
 	if batchAuthorizer != nil {
@@ -0,0 +1,95 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+// package instrument records metrics and traces of the requests sent to Azure
+// Resource Manager
+package instrument
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/prometheus/client_golang/prometheus"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	armRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "podexternalip_arm_requests_total",
+		Help: "Number of Azure Resource Manager requests by operation and status code.",
+	}, []string{"operation", "code"})
+
+	armRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "podexternalip_arm_request_duration_seconds",
+		Help:    "Latency of Azure Resource Manager requests by operation.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"operation"})
+
+	armThrottledRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "podexternalip_arm_throttled_requests_total",
+		Help: "Number of Azure Resource Manager requests throttled with status 429 by operation.",
+	}, []string{"operation"})
+)
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(armRequests, armRequestDuration, armThrottledRequests)
+}
+
+// Sender returns the default autorest sender, instrumented to count, time and
+// trace the requests. Long running operations are polled through the same
+// sender, so each poll is recorded as a request of the operations resource.
+func Sender() autorest.Sender {
+	return autorest.DecorateSender(autorest.CreateSender(), withMetrics(), withTracing())
+}
+
+func withMetrics() autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			operation := Operation(r)
+			start := time.Now()
+			resp, err := s.Do(r)
+			armRequestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+
+			code := "error"
+			if resp != nil {
+				code = strconv.Itoa(resp.StatusCode)
+				if resp.StatusCode == http.StatusTooManyRequests {
+					armThrottledRequests.WithLabelValues(operation).Inc()
+				}
+			}
+			armRequests.WithLabelValues(operation, code).Inc()
+			return resp, err
+		})
+	}
+}
+
+// Operation names a request by its method and the type of the resource it
+// targets, e.g. "PUT networkInterfaces", so the labels stay bounded.
+func Operation(r *http.Request) string {
+	return r.Method + " " + resourceType(r.URL.Path)
+}
+
+// resourceType returns the last resource type of an ARM resource path, which
+// alternates types and names after the provider namespace.
+func resourceType(path string) string {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		if strings.EqualFold(segments[i], "providers") && i+2 < len(segments) {
+			rest := segments[i+2:]
+			if len(rest)%2 == 0 {
+				// The path ends with a resource name.
+				return rest[len(rest)-2]
+			}
+			return rest[len(rest)-1]
+		}
+	}
+	if len(segments) > 0 {
+		return segments[len(segments)-1]
+	}
+	return ""
+}
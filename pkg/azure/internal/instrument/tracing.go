@@ -0,0 +1,51 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package instrument
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/yingeli/pod-external-ip-operator/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Future is a long running operation of the Azure SDK.
+type Future interface {
+	WaitForCompletionRef(ctx context.Context, client autorest.Client) error
+}
+
+// WaitForCompletion polls the long running operation until it completes, in a
+// span of its own so the polling time shows apart from the initial request.
+func WaitForCompletion(ctx context.Context, future Future, client autorest.Client) (err error) {
+	ctx, span := tracing.Start(ctx, "WaitForCompletion")
+	defer func() { tracing.End(span, err) }()
+	return future.WaitForCompletionRef(ctx, client)
+}
+
+func withTracing() autorest.SendDecorator {
+	return func(s autorest.Sender) autorest.Sender {
+		return autorest.SenderFunc(func(r *http.Request) (*http.Response, error) {
+			ctx, span := tracing.Start(r.Context(), Operation(r),
+				attribute.String("http.method", r.Method),
+				attribute.String("http.url", r.URL.Redacted()),
+			)
+			resp, err := s.Do(r.WithContext(ctx))
+			if err == nil && resp != nil {
+				span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+				if resp.StatusCode >= http.StatusBadRequest {
+					err = fmt.Errorf("status code %d", resp.StatusCode)
+					tracing.End(span, err)
+					return resp, nil
+				}
+			}
+			tracing.End(span, err)
+			return resp, err
+		})
+	}
+}
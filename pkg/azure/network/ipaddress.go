@@ -8,24 +8,30 @@ package network
 import (
 	"context"
 	"fmt"
+	"net"
+	"strings"
 
 	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-11-01/network"
 	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/config"
 	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/iam"
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/instrument"
+	"github.com/yingeli/pod-external-ip-operator/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func getIPClient() network.PublicIPAddressesClient {
 	ipClient := network.NewPublicIPAddressesClientWithBaseURI(
-		config.Environment().ResourceManagerEndpoint, config.SubscriptionID())
+		config.ResourceManagerEndpoint(), config.SubscriptionID())
 	auth, _ := iam.GetResourceManagementAuthorizer()
 	ipClient.Authorizer = auth
 	ipClient.AddToUserAgent(config.UserAgent())
+	ipClient.Sender = instrument.Sender()
 	return ipClient
 }
 
-// CreatePublicIP creates a new public IP
-func CreatePublicIP(ctx context.Context, ipName string) (ip network.PublicIPAddress, err error) {
+// CreatePublicIP creates a new public IP of the given IP version
+func CreatePublicIP(ctx context.Context, ipName string, version network.IPVersion) (ip network.PublicIPAddress, err error) {
 	ipClient := getIPClient()
 	future, err := ipClient.CreateOrUpdate(
 		ctx,
@@ -35,7 +41,7 @@ func CreatePublicIP(ctx context.Context, ipName string) (ip network.PublicIPAddr
 			Name:     to.StringPtr(ipName),
 			Location: to.StringPtr(config.Location()),
 			PublicIPAddressPropertiesFormat: &network.PublicIPAddressPropertiesFormat{
-				PublicIPAddressVersion:   network.IPv4,
+				PublicIPAddressVersion:   version,
 				PublicIPAllocationMethod: network.Static,
 			},
 		},
@@ -45,7 +51,7 @@ func CreatePublicIP(ctx context.Context, ipName string) (ip network.PublicIPAddr
 		return ip, fmt.Errorf("cannot create public ip address: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, ipClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, ipClient.Client)
 	if err != nil {
 		return ip, fmt.Errorf("cannot get public ip address create or update future response: %v", err)
 	}
@@ -71,15 +77,40 @@ func ListPublicIPs(ctx context.Context) (result network.PublicIPAddressListResul
 	return ipClient.List(ctx, config.GroupName())
 }
 
+// ListAllPublicIPs returns the public IPs of every page of the list.
+func ListAllPublicIPs(ctx context.Context) (ips []network.PublicIPAddress, err error) {
+	ctx, span := tracing.Start(ctx, "ListAllPublicIPs")
+	defer func() { tracing.End(span, err) }()
+	result, err := ListPublicIPs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pages := 0
+	defer func() { span.SetAttributes(attribute.Int("pages", pages)) }()
+	for result.NotDone() {
+		pages++
+		ips = append(ips, result.Values()...)
+		if err = result.NextWithContext(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return ips, nil
+}
+
 // LookupPublicIP lookup public IP by address
 func LookupPublicIP(ctx context.Context, address string) (ip network.PublicIPAddress, found bool, err error) {
+	ctx, span := tracing.Start(ctx, "LookupPublicIP", attribute.String("publicIP", address))
+	defer func() { tracing.End(span, err) }()
 	result, err := ListPublicIPs(ctx)
 	if err != nil {
 		return ip, false, err
 	}
+	pages := 0
+	defer func() { span.SetAttributes(attribute.Int("pages", pages)) }()
 	for result.NotDone() {
+		pages++
 		for _, ip := range result.Values() {
-			if *ip.IPAddress == address {
+			if ip.IPAddress != nil && sameIP(*ip.IPAddress, address) {
 				return ip, true, nil
 			}
 		}
@@ -91,7 +122,9 @@ func LookupPublicIP(ctx context.Context, address string) (ip network.PublicIPAdd
 	return ip, false, nil
 }
 
-func DissociatePublicIP(ctx context.Context, publicIPAddr string) error {
+func DissociatePublicIP(ctx context.Context, publicIPAddr string) (err error) {
+	ctx, span := tracing.Start(ctx, "DissociatePublicIP", attribute.String("publicIP", publicIPAddr))
+	defer func() { tracing.End(span, err) }()
 	pip, found, err := LookupPublicIP(ctx, publicIPAddr)
 	if err != nil {
 		return err
@@ -100,20 +133,77 @@ func DissociatePublicIP(ctx context.Context, publicIPAddr string) error {
 		return nil
 	}
 	if pip.IPConfiguration != nil {
-		r, err := ParseIPConfigurationID(*pip.IPConfiguration.ID)
-		if err != nil {
-			return fmt.Errorf("ParseIPConfigurationID error: %v", err)
-		}
+		return dissociateIPConfigurationPublicIP(ctx, *pip.IPConfiguration.ID)
+	}
+	return nil
+}
 
-		nic, err := GetNic(ctx, r.NicName)
-		if err != nil {
-			return fmt.Errorf("GetNic error: %v", err)
-		}
+// DissociatePublicIPFromIPConfiguration dissociates a public IP from the IP
+// configuration ipconfigID. It leaves the public IP alone when it is allocated
+// to another IP configuration, and returns whether it was dissociated.
+func DissociatePublicIPFromIPConfiguration(ctx context.Context, publicIPAddr string, ipconfigID string) (dissociated bool, err error) {
+	ctx, span := tracing.Start(ctx, "DissociatePublicIPFromIPConfiguration", attribute.String("publicIP", publicIPAddr), attribute.String("ipconfig", ipconfigID))
+	defer func() { tracing.End(span, err) }()
+	pip, found, err := LookupPublicIP(ctx, publicIPAddr)
+	if err != nil {
+		return false, err
+	}
+	if !found || pip.IPConfiguration == nil || !strings.EqualFold(to.String(pip.IPConfiguration.ID), ipconfigID) {
+		return false, nil
+	}
+	if err := dissociateIPConfigurationPublicIP(ctx, *pip.IPConfiguration.ID); err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-		err = DissociateNicPublicIP(ctx, &nic, *pip.IPConfiguration.ID)
-		if err != nil {
-			return fmt.Errorf("DissociateNicWithPublicIP error: %v", err)
-		}
+// DissociatePublicIPFromPrivateIP dissociates a public IP from the IP
+// configuration it is allocated to when that IP configuration has the given
+// private IP.
+func DissociatePublicIPFromPrivateIP(ctx context.Context, publicIPAddr string, privateIPAddr string) (err error) {
+	ctx, span := tracing.Start(ctx, "DissociatePublicIPFromPrivateIP", attribute.String("publicIP", publicIPAddr), attribute.String("privateIP", privateIPAddr))
+	defer func() { tracing.End(span, err) }()
+	pip, found, err := LookupPublicIP(ctx, publicIPAddr)
+	if err != nil {
+		return err
+	}
+	if !found || pip.IPConfiguration == nil || pip.IPConfiguration.ID == nil {
+		return nil
+	}
+	ipconfig, err := GetIPConfiguration(ctx, *pip.IPConfiguration.ID)
+	if err != nil {
+		return fmt.Errorf("GetIPConfiguration error: %v", err)
+	}
+	if ipconfig.InterfaceIPConfigurationPropertiesFormat == nil || ipconfig.PrivateIPAddress == nil || !sameIP(*ipconfig.PrivateIPAddress, privateIPAddr) {
+		return nil
+	}
+	return dissociateIPConfigurationPublicIP(ctx, *pip.IPConfiguration.ID)
+}
+
+func dissociateIPConfigurationPublicIP(ctx context.Context, ipconfigID string) error {
+	r, err := ParseIPConfigurationID(ipconfigID)
+	if err != nil {
+		return fmt.Errorf("ParseIPConfigurationID error: %v", err)
+	}
+
+	nic, err := GetNic(ctx, r.NicName)
+	if err != nil {
+		return fmt.Errorf("GetNic error: %v", err)
+	}
+
+	err = DissociateNicPublicIP(ctx, &nic, ipconfigID)
+	if err != nil {
+		return fmt.Errorf("DissociateNicWithPublicIP error: %v", err)
 	}
 	return nil
 }
+
+// sameIP compares two IP addresses, which may be written differently when
+// they are IPv6 addresses.
+func sameIP(a string, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return a == b
+	}
+	return ipA.Equal(ipB)
+}
@@ -0,0 +1,159 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/Azure/go-autorest/autorest/to"
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/armsim"
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/config"
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/iam"
+)
+
+const (
+	testSubscription  = "00000000-0000-0000-0000-000000000000"
+	testResourceGroup = "rg"
+)
+
+// newSimulator points the clients at an ARM simulator for the rest of the
+// test.
+func newSimulator(t *testing.T) *armsim.Server {
+	s := armsim.New(testSubscription, testResourceGroup)
+	config.SetGroup("AzurePublicCloud", testSubscription, testResourceGroup)
+	config.SetResourceManagerEndpoint(s.URL)
+	iam.SetResourceManagementAuthorizer(s.Authorizer())
+	t.Cleanup(func() {
+		config.SetResourceManagerEndpoint("")
+		iam.SetResourceManagementAuthorizer(nil)
+		s.Close()
+	})
+	return s
+}
+
+func TestLookupPublicIP(t *testing.T) {
+	ctx := context.Background()
+	s := newSimulator(t)
+	s.PageSize = 2
+	for i := 1; i <= 5; i++ {
+		s.AddPublicIP(fmt.Sprintf("pip-%d", i), fmt.Sprintf("20.0.0.%d", i))
+	}
+
+	tests := []struct {
+		address   string
+		wantName  string
+		wantFound bool
+		wantPages int
+	}{
+		{address: "20.0.0.1", wantName: "pip-1", wantFound: true, wantPages: 1},
+		{address: "20.0.0.5", wantName: "pip-5", wantFound: true, wantPages: 3},
+		{address: "20.0.0.9", wantFound: false, wantPages: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			s.ResetRequests()
+			ip, found, err := LookupPublicIP(ctx, tt.address)
+			if err != nil || found != tt.wantFound || to.String(ip.Name) != tt.wantName {
+				t.Errorf("LookupPublicIP() = %q, %v, %v, want %q, %v, nil", to.String(ip.Name), found, err, tt.wantName, tt.wantFound)
+			}
+			if got := len(s.Requests(http.MethodGet, "publicIPAddresses")); got != tt.wantPages {
+				t.Errorf("LookupPublicIP() read %d pages, want %d", got, tt.wantPages)
+			}
+		})
+	}
+}
+
+func TestDissociatePublicIP(t *testing.T) {
+	ctx := context.Background()
+	s := newSimulator(t)
+	s.AddPublicIP("pip-1", "20.0.0.1")
+	s.AddNIC("nic-0", "10.0.0.4", "10.0.0.5")
+	s.AssociatePublicIP("nic-0", "10.0.0.5", "pip-1")
+	s.Polls = 1
+
+	if err := DissociatePublicIP(ctx, "20.0.0.1"); err != nil {
+		t.Fatalf("DissociatePublicIP() = %v", err)
+	}
+	if got := s.AllocatedTo("pip-1"); got != "" {
+		t.Errorf("public IP allocated to %q, want none", got)
+	}
+	nic, err := GetNic(ctx, "nic-0")
+	if err != nil {
+		t.Fatalf("GetNic() = %v", err)
+	}
+	for _, ipconfig := range *nic.IPConfigurations {
+		if ipconfig.PublicIPAddress != nil {
+			t.Errorf("%s still references %s", to.String(ipconfig.Name), to.String(ipconfig.PublicIPAddress.ID))
+		}
+	}
+
+	// There is nothing left to dissociate.
+	s.ResetRequests()
+	if err := DissociatePublicIP(ctx, "20.0.0.1"); err != nil {
+		t.Fatalf("DissociatePublicIP() = %v", err)
+	}
+	if got := s.Requests(http.MethodPut, ""); len(got) != 0 {
+		t.Errorf("DissociatePublicIP() sent %v, want no update", got)
+	}
+}
+
+func TestDissociatePublicIPFromIPConfiguration(t *testing.T) {
+	ctx := context.Background()
+	s := newSimulator(t)
+	s.AddPublicIP("pip-1", "20.0.0.1")
+	nic0 := s.AddNIC("nic-0", "10.0.0.4")
+	nic1 := s.AddNIC("nic-1", "10.0.1.4")
+	s.AssociatePublicIP("nic-1", "10.0.1.4", "pip-1")
+
+	dissociated, err := DissociatePublicIPFromIPConfiguration(ctx, "20.0.0.1", nic0+"/ipConfigurations/ipconfig1")
+	if err != nil || dissociated {
+		t.Errorf("DissociatePublicIPFromIPConfiguration() = %v, %v, want false, nil", dissociated, err)
+	}
+	if got, want := s.AllocatedTo("pip-1"), nic1+"/ipConfigurations/ipconfig1"; got != want {
+		t.Errorf("public IP allocated to %q, want %q", got, want)
+	}
+
+	dissociated, err = DissociatePublicIPFromIPConfiguration(ctx, "20.0.0.1", nic1+"/ipConfigurations/ipconfig1")
+	if err != nil || !dissociated {
+		t.Errorf("DissociatePublicIPFromIPConfiguration() = %v, %v, want true, nil", dissociated, err)
+	}
+	if got := s.AllocatedTo("pip-1"); got != "" {
+		t.Errorf("public IP allocated to %q, want none", got)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	ctx := context.Background()
+	s := newSimulator(t)
+	s.AddPublicIP("pip-1", "20.0.0.1")
+
+	s.FailNext(http.MethodGet, "publicIPAddresses", armsim.Error{
+		Status: http.StatusForbidden, Code: "AuthorizationFailed", Message: "The client does not have authorization to perform action."})
+	_, _, err := LookupPublicIP(ctx, "20.0.0.1")
+	if err == nil || !strings.Contains(err.Error(), `Code="AuthorizationFailed"`) {
+		t.Errorf("LookupPublicIP() = %v, want an AuthorizationFailed error", err)
+	}
+	if detailed, ok := err.(autorest.DetailedError); !ok || detailed.StatusCode != http.StatusForbidden {
+		t.Errorf("LookupPublicIP() = %#v, want a detailed error with the status code 403", err)
+	}
+
+	_, err = GetPublicIP(ctx, "pip-2")
+	if detailed, ok := err.(autorest.DetailedError); !ok || detailed.StatusCode != http.StatusNotFound ||
+		!strings.Contains(err.Error(), armsim.CodeResourceNotFound) {
+		t.Errorf("GetPublicIP() = %v, want a ResourceNotFound error with the status code 404", err)
+	}
+
+	iam.SetResourceManagementAuthorizer(autorest.NullAuthorizer{})
+	_, err = GetPublicIP(ctx, "pip-1")
+	if err == nil || !strings.Contains(err.Error(), armsim.CodeAuthenticationFailed) {
+		t.Errorf("GetPublicIP() = %v, want an AuthenticationFailed error", err)
+	}
+}
@@ -13,14 +13,16 @@ import (
 	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-11-01/network"
 	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/config"
 	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/iam"
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/instrument"
 )
 
 func getIPConfigurationClient() network.InterfaceIPConfigurationsClient {
 	ipcClient := network.NewInterfaceIPConfigurationsClientWithBaseURI(
-		config.Environment().ResourceManagerEndpoint, config.SubscriptionID())
+		config.ResourceManagerEndpoint(), config.SubscriptionID())
 	auth, _ := iam.GetResourceManagementAuthorizer()
 	ipcClient.Authorizer = auth
 	ipcClient.AddToUserAgent(config.UserAgent())
+	ipcClient.Sender = instrument.Sender()
 	return ipcClient
 }
 
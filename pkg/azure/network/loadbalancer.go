@@ -13,13 +13,16 @@ import (
 	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/config"
 	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/iam"
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/instrument"
 )
 
 func getLBClient() network.LoadBalancersClient {
-	lbClient := network.NewLoadBalancersClient(config.SubscriptionID())
+	lbClient := network.NewLoadBalancersClientWithBaseURI(
+		config.ResourceManagerEndpoint(), config.SubscriptionID())
 	auth, _ := iam.GetResourceManagementAuthorizer()
 	lbClient.Authorizer = auth
 	lbClient.AddToUserAgent(config.UserAgent())
+	lbClient.Sender = instrument.Sender()
 	return lbClient
 }
 
@@ -131,7 +134,7 @@ func CreateLoadBalancer(ctx context.Context, lbName, pipName string) (lb network
 		return lb, fmt.Errorf("cannot create load balancer: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, lbClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, lbClient.Client)
 	if err != nil {
 		return lb, fmt.Errorf("cannot get load balancer create or update future response: %v", err)
 	}
@@ -15,15 +15,19 @@ import (
 	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/config"
 	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/iam"
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/instrument"
+	"github.com/yingeli/pod-external-ip-operator/pkg/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func getNicClient() network.InterfacesClient {
 	//nicClient := network.NewInterfacesClient(config.SubscriptionID())
 	nicClient := network.NewInterfacesClientWithBaseURI(
-		config.Environment().ResourceManagerEndpoint, config.SubscriptionID())
+		config.ResourceManagerEndpoint(), config.SubscriptionID())
 	auth, _ := iam.GetResourceManagementAuthorizer()
 	nicClient.Authorizer = auth
 	nicClient.AddToUserAgent(config.UserAgent())
+	nicClient.Sender = instrument.Sender()
 	return nicClient
 }
 
@@ -70,7 +74,7 @@ func CreateNIC(ctx context.Context, vnetName, subnetName, nsgName, ipName, nicNa
 		return nic, fmt.Errorf("cannot create nic: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, nicClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, nicClient.Client)
 	if err != nil {
 		return nic, fmt.Errorf("cannot get nic create or update future response: %v", err)
 	}
@@ -123,7 +127,7 @@ func CreateNICWithLoadBalancer(ctx context.Context, lbName, vnetName, subnetName
 		return nic, fmt.Errorf("cannot create nic: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, nicClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, nicClient.Client)
 	if err != nil {
 		return nic, fmt.Errorf("cannot get nic create or update future response: %v", err)
 	}
@@ -144,10 +148,12 @@ func DeleteNic(ctx context.Context, nic string) (result network.InterfacesDelete
 }
 
 // AssociateNicPrivateIPWithPublicIP associate public IP to network interface
-func AssociateNicPrivateIPWithPublicIP(ctx context.Context, nic network.Interface, privateIPAddr string, ip network.PublicIPAddress) error {
+func AssociateNicPrivateIPWithPublicIP(ctx context.Context, nic network.Interface, privateIPAddr string, ip network.PublicIPAddress) (err error) {
+	ctx, span := tracing.Start(ctx, "AssociateNicPrivateIPWithPublicIP", attribute.String("nic", to.String(nic.Name)), attribute.String("privateIP", privateIPAddr))
+	defer func() { tracing.End(span, err) }()
 	found := false
 	for _, ifconfig := range *nic.IPConfigurations {
-		if *ifconfig.PrivateIPAddress == privateIPAddr {
+		if ifconfig.PrivateIPAddress != nil && sameIP(*ifconfig.PrivateIPAddress, privateIPAddr) {
 			ifconfig.PublicIPAddress = &ip
 			found = true
 			break
@@ -164,7 +170,7 @@ func AssociateNicPrivateIPWithPublicIP(ctx context.Context, nic network.Interfac
 		return fmt.Errorf("failed to update nic: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, nicClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, nicClient.Client)
 	if err != nil {
 		return fmt.Errorf("cannot get nic update future response: %v", err)
 	}
@@ -177,7 +183,9 @@ func AssociateNicPrivateIPWithPublicIP(ctx context.Context, nic network.Interfac
 	return nil
 }
 
-func DissociateNicPublicIP(ctx context.Context, nic *network.Interface, ipconfigID string) error {
+func DissociateNicPublicIP(ctx context.Context, nic *network.Interface, ipconfigID string) (err error) {
+	ctx, span := tracing.Start(ctx, "DissociateNicPublicIP", attribute.String("nic", to.String(nic.Name)), attribute.String("ipconfig", ipconfigID))
+	defer func() { tracing.End(span, err) }()
 	ipconfigs := nic.IPConfigurations
 	l := len(*ipconfigs)
 	for i := 0; i < l; i++ {
@@ -188,8 +196,6 @@ func DissociateNicPublicIP(ctx context.Context, nic *network.Interface, ipconfig
 		}
 	}
 
-	fmt.Printf("getNicClient\n")
-
 	nicClient := getNicClient()
 
 	future, err := nicClient.CreateOrUpdate(ctx, config.GroupName(), *nic.Name, *nic)
@@ -197,7 +203,7 @@ func DissociateNicPublicIP(ctx context.Context, nic *network.Interface, ipconfig
 		return fmt.Errorf("cannot update nic: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, nicClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, nicClient.Client)
 	if err != nil {
 		return fmt.Errorf("cannot get nic update future response: %v", err)
 	}
@@ -206,12 +212,14 @@ func DissociateNicPublicIP(ctx context.Context, nic *network.Interface, ipconfig
 	return err
 }
 
-func DissociateNicPrivateIPWithPublicIP(ctx context.Context, nic *network.Interface, privateIPAddr string, publicIPAddr string) error {
+func DissociateNicPrivateIPWithPublicIP(ctx context.Context, nic *network.Interface, privateIPAddr string, publicIPAddr string) (err error) {
+	ctx, span := tracing.Start(ctx, "DissociateNicPrivateIPWithPublicIP", attribute.String("nic", to.String(nic.Name)), attribute.String("privateIP", privateIPAddr), attribute.String("publicIP", publicIPAddr))
+	defer func() { tracing.End(span, err) }()
 	ipconfigs := nic.IPConfigurations
 	l := len(*ipconfigs)
 	for i := 0; i < l; i++ {
 		ifconfig := (*ipconfigs)[i]
-		if ifconfig.PrivateIPAddress != nil && *ifconfig.PrivateIPAddress == privateIPAddr {
+		if ifconfig.PrivateIPAddress != nil && sameIP(*ifconfig.PrivateIPAddress, privateIPAddr) {
 			if ifconfig.PublicIPAddress == nil {
 				return nil
 			}
@@ -223,7 +231,7 @@ func DissociateNicPrivateIPWithPublicIP(ctx context.Context, nic *network.Interf
 			if err != nil {
 				return err
 			}
-			if *pip.IPAddress != publicIPAddr {
+			if pip.IPAddress == nil || !sameIP(*pip.IPAddress, publicIPAddr) {
 				return nil
 			}
 			ifconfig.PublicIPAddress = nil
@@ -238,7 +246,7 @@ func DissociateNicPrivateIPWithPublicIP(ctx context.Context, nic *network.Interf
 		return fmt.Errorf("cannot update nic: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, nicClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, nicClient.Client)
 	if err != nil {
 		return fmt.Errorf("cannot get nic update future response: %v", err)
 	}
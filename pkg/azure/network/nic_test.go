@@ -0,0 +1,101 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package network
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/armsim"
+)
+
+func TestAssociateNicPrivateIPWithPublicIP(t *testing.T) {
+	ctx := context.Background()
+	s := newSimulator(t)
+	s.AddPublicIP("pip-1", "20.0.0.1")
+	nicID := s.AddNIC("nic-0", "10.0.0.4", "10.0.0.5")
+	s.Polls = 2
+
+	nic, err := GetNic(ctx, "nic-0")
+	if err != nil {
+		t.Fatalf("GetNic() = %v", err)
+	}
+	pip, err := GetPublicIP(ctx, "pip-1")
+	if err != nil {
+		t.Fatalf("GetPublicIP() = %v", err)
+	}
+	s.ResetRequests()
+	if err := AssociateNicPrivateIPWithPublicIP(ctx, nic, "10.0.0.5", pip); err != nil {
+		t.Fatalf("AssociateNicPrivateIPWithPublicIP() = %v", err)
+	}
+	if got, want := s.AllocatedTo("pip-1"), nicID+"/ipConfigurations/ipconfig2"; got != want {
+		t.Errorf("public IP allocated to %q, want %q", got, want)
+	}
+	// The update is polled until it succeeds, then the result is read.
+	if got := len(s.Requests(http.MethodGet, "operations")); got != 3 {
+		t.Errorf("operation polled %d times, want 3", got)
+	}
+	if got := len(s.Requests(http.MethodGet, "networkInterfaces")); got != 1 {
+		t.Errorf("network interface read %d times after the update, want 1", got)
+	}
+
+	if err := AssociateNicPrivateIPWithPublicIP(ctx, nic, "10.0.0.6", pip); err == nil || !strings.Contains(err.Error(), "private ip not found") {
+		t.Errorf("AssociateNicPrivateIPWithPublicIP() = %v, want a private ip not found error", err)
+	}
+}
+
+func TestAssociateNicPrivateIPWithPublicIPInUse(t *testing.T) {
+	ctx := context.Background()
+	s := newSimulator(t)
+	s.AddPublicIP("pip-1", "20.0.0.1")
+	s.AddNIC("nic-0", "10.0.0.4")
+	holderID := s.AddNIC("nic-1", "10.0.1.4") + "/ipConfigurations/ipconfig1"
+	s.AssociatePublicIP("nic-1", "10.0.1.4", "pip-1")
+
+	nic, err := GetNic(ctx, "nic-0")
+	if err != nil {
+		t.Fatalf("GetNic() = %v", err)
+	}
+	pip, err := GetPublicIP(ctx, "pip-1")
+	if err != nil {
+		t.Fatalf("GetPublicIP() = %v", err)
+	}
+	err = AssociateNicPrivateIPWithPublicIP(ctx, nic, "10.0.0.4", pip)
+	if err == nil || !strings.Contains(err.Error(), `Code="PublicIPAddressInUse"`) ||
+		!strings.Contains(err.Error(), "already allocated to resource "+holderID+".") {
+		t.Errorf("AssociateNicPrivateIPWithPublicIP() = %v, want a PublicIPAddressInUse error naming %s", err, holderID)
+	}
+	if got := s.AllocatedTo("pip-1"); got != holderID {
+		t.Errorf("public IP allocated to %q, want %q", got, holderID)
+	}
+}
+
+func TestAssociateNicPrivateIPWithPublicIPOperationFailed(t *testing.T) {
+	ctx := context.Background()
+	s := newSimulator(t)
+	s.AddPublicIP("pip-1", "20.0.0.1")
+	s.AddNIC("nic-0", "10.0.0.4")
+	s.Polls = 1
+	s.FailNextOperation(armsim.Error{Code: "InternalServerError", Message: "An error occurred."})
+
+	nic, err := GetNic(ctx, "nic-0")
+	if err != nil {
+		t.Fatalf("GetNic() = %v", err)
+	}
+	pip, err := GetPublicIP(ctx, "pip-1")
+	if err != nil {
+		t.Fatalf("GetPublicIP() = %v", err)
+	}
+	err = AssociateNicPrivateIPWithPublicIP(ctx, nic, "10.0.0.4", pip)
+	if err == nil || !strings.Contains(err.Error(), "InternalServerError") {
+		t.Errorf("AssociateNicPrivateIPWithPublicIP() = %v, want an InternalServerError error", err)
+	}
+	if got := s.AllocatedTo("pip-1"); got != "" {
+		t.Errorf("public IP allocated to %q, want none", got)
+	}
+}
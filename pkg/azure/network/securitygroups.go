@@ -13,13 +13,16 @@ import (
 	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/config"
 	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/iam"
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/instrument"
 )
 
 func getNsgClient() network.SecurityGroupsClient {
-	nsgClient := network.NewSecurityGroupsClient(config.SubscriptionID())
+	nsgClient := network.NewSecurityGroupsClientWithBaseURI(
+		config.ResourceManagerEndpoint(), config.SubscriptionID())
 	a, _ := iam.GetResourceManagementAuthorizer()
 	nsgClient.Authorizer = a
 	nsgClient.AddToUserAgent(config.UserAgent())
+	nsgClient.Sender = instrument.Sender()
 	return nsgClient
 }
 
@@ -69,7 +72,7 @@ func CreateNetworkSecurityGroup(ctx context.Context, nsgName string) (nsg networ
 		return nsg, fmt.Errorf("cannot create nsg: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, nsgClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, nsgClient.Client)
 	if err != nil {
 		return nsg, fmt.Errorf("cannot get nsg create or update future response: %v", err)
 	}
@@ -93,7 +96,7 @@ func CreateSimpleNetworkSecurityGroup(ctx context.Context, nsgName string) (nsg
 		return nsg, fmt.Errorf("cannot create nsg: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, nsgClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, nsgClient.Client)
 	if err != nil {
 		return nsg, fmt.Errorf("cannot get nsg create or update future response: %v", err)
 	}
@@ -116,10 +119,12 @@ func GetNetworkSecurityGroup(ctx context.Context, nsgName string) (network.Secur
 // Network security group rules
 
 func getSecurityRulesClient() network.SecurityRulesClient {
-	rulesClient := network.NewSecurityRulesClient(config.SubscriptionID())
+	rulesClient := network.NewSecurityRulesClientWithBaseURI(
+		config.ResourceManagerEndpoint(), config.SubscriptionID())
 	a, _ := iam.GetResourceManagementAuthorizer()
 	rulesClient.Authorizer = a
 	rulesClient.AddToUserAgent(config.UserAgent())
+	rulesClient.Sender = instrument.Sender()
 	return rulesClient
 }
 
@@ -147,7 +152,7 @@ func CreateSSHRule(ctx context.Context, nsgName string) (rule network.SecurityRu
 		return rule, fmt.Errorf("cannot create SSH security rule: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, rulesClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, rulesClient.Client)
 	if err != nil {
 		return rule, fmt.Errorf("cannot get security rule create or update future response: %v", err)
 	}
@@ -179,7 +184,7 @@ func CreateHTTPRule(ctx context.Context, nsgName string) (rule network.SecurityR
 		return rule, fmt.Errorf("cannot create HTTP security rule: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, rulesClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, rulesClient.Client)
 	if err != nil {
 		return rule, fmt.Errorf("cannot get security rule create or update future response: %v", err)
 	}
@@ -211,7 +216,7 @@ func CreateSQLRule(ctx context.Context, nsgName, frontEndAddressPrefix string) (
 		return rule, fmt.Errorf("cannot create SQL security rule: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, rulesClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, rulesClient.Client)
 	if err != nil {
 		return rule, fmt.Errorf("cannot get security rule create or update future response: %v", err)
 	}
@@ -243,7 +248,7 @@ func CreateDenyOutRule(ctx context.Context, nsgName string) (rule network.Securi
 		return rule, fmt.Errorf("cannot create deny out security rule: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, rulesClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, rulesClient.Client)
 	if err != nil {
 		return rule, fmt.Errorf("cannot get security rule create or update future response: %v", err)
 	}
@@ -13,13 +13,16 @@ import (
 	"github.com/Azure/go-autorest/autorest/to"
 	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/config"
 	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/iam"
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/instrument"
 )
 
 func getSubnetsClient() network.SubnetsClient {
-	subnetsClient := network.NewSubnetsClient(config.SubscriptionID())
+	subnetsClient := network.NewSubnetsClientWithBaseURI(
+		config.ResourceManagerEndpoint(), config.SubscriptionID())
 	auth, _ := iam.GetResourceManagementAuthorizer()
 	subnetsClient.Authorizer = auth
 	subnetsClient.AddToUserAgent(config.UserAgent())
+	subnetsClient.Sender = instrument.Sender()
 	return subnetsClient
 }
 
@@ -41,7 +44,7 @@ func CreateVirtualNetworkSubnet(ctx context.Context, vnetName, subnetName string
 		return subnet, fmt.Errorf("cannot create subnet: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, subnetsClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, subnetsClient.Client)
 	if err != nil {
 		return subnet, fmt.Errorf("cannot get the subnet create or update future response: %v", err)
 	}
@@ -72,7 +75,7 @@ func CreateSubnetWithNetworkSecurityGroup(ctx context.Context, vnetName, subnetN
 		return subnet, fmt.Errorf("cannot create subnet: %v", err)
 	}
 
-	err = future.WaitForCompletionRef(ctx, subnetsClient.Client)
+	err = instrument.WaitForCompletion(ctx, future, subnetsClient.Client)
 	if err != nil {
 		return subnet, fmt.Errorf("cannot get the subnet create or update future response: %v", err)
 	}
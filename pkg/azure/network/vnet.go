@@ -0,0 +1,67 @@
+// Copyright (c) Microsoft and contributors.  All rights reserved.
+//
+// This source code is licensed under the MIT license found in the
+// LICENSE file in the root directory of this source tree.
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/services/network/mgmt/2019-11-01/network"
+	"github.com/Azure/go-autorest/autorest/azure"
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/config"
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/iam"
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/internal/instrument"
+)
+
+func getVnetClient() network.VirtualNetworksClient {
+	vnetClient := network.NewVirtualNetworksClientWithBaseURI(
+		config.ResourceManagerEndpoint(), config.SubscriptionID())
+	auth, _ := iam.GetResourceManagementAuthorizer()
+	vnetClient.Authorizer = auth
+	vnetClient.AddToUserAgent(config.UserAgent())
+	vnetClient.Sender = instrument.Sender()
+	return vnetClient
+}
+
+// GetVirtualNetworkOfSubnet returns the virtual network of a subnet, which may
+// live in another resource group than the nodes, e.g. for a custom VNet.
+func GetVirtualNetworkOfSubnet(ctx context.Context, subnetID string) (vnet network.VirtualNetwork, err error) {
+	i := strings.Index(strings.ToLower(subnetID), "/subnets/")
+	if i < 0 {
+		return vnet, fmt.Errorf("invalid subnet ID %s", subnetID)
+	}
+	r, err := azure.ParseResourceID(subnetID[:i])
+	if err != nil {
+		return vnet, fmt.Errorf("ParseResourceID error: %v", err)
+	}
+	vnetClient := getVnetClient()
+	return vnetClient.Get(ctx, r.ResourceGroup, r.ResourceName, "")
+}
+
+// GetNicVirtualNetworkPrefixes returns the address prefixes of the virtual
+// networks the ip configurations of a network interface are attached to.
+func GetNicVirtualNetworkPrefixes(ctx context.Context, nic network.Interface) ([]string, error) {
+	var prefixes []string
+	seen := make(map[string]bool)
+	for _, ipconfig := range *nic.IPConfigurations {
+		if ipconfig.Subnet == nil || ipconfig.Subnet.ID == nil {
+			continue
+		}
+		vnet, err := GetVirtualNetworkOfSubnet(ctx, *ipconfig.Subnet.ID)
+		if err != nil {
+			return nil, fmt.Errorf("GetVirtualNetworkOfSubnet error: %v", err)
+		}
+		if vnet.ID == nil || seen[*vnet.ID] {
+			continue
+		}
+		seen[*vnet.ID] = true
+		if vnet.AddressSpace != nil && vnet.AddressSpace.AddressPrefixes != nil {
+			prefixes = append(prefixes, *vnet.AddressSpace.AddressPrefixes...)
+		}
+	}
+	return prefixes, nil
+}
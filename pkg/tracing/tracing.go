@@ -0,0 +1,134 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tracing sets up the OpenTelemetry tracer provider of the operator.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// ExporterNone disables tracing.
+	ExporterNone = "none"
+	// ExporterOTLP exports the spans to an OTLP/HTTP collector.
+	ExporterOTLP = "otlp"
+	// ExporterStdout writes the spans as JSON to stdout, or to a file.
+	ExporterStdout = "stdout"
+)
+
+const tracerName = "github.com/yingeli/pod-external-ip-operator"
+
+// Config selects the exporter of the spans.
+type Config struct {
+	// Exporter is ExporterNone, ExporterOTLP or ExporterStdout.
+	Exporter string
+	// Endpoint is the host:port of the OTLP collector. When empty, the
+	// OTEL_EXPORTER_OTLP_ENDPOINT env var or localhost:4318 is used.
+	Endpoint string
+	// Insecure disables TLS to the OTLP collector.
+	Insecure bool
+	// File is the file the stdout exporter writes to instead of stdout.
+	File string
+	// ServiceName identifies the controller or daemon in the traces.
+	ServiceName string
+}
+
+// Setup installs the global tracer provider and propagator for config, and
+// returns a function that flushes the spans and shuts the provider down.
+func Setup(ctx context.Context, config Config) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	switch config.Exporter {
+	case "", ExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		opts := []otlptracehttp.Option{}
+		if config.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(config.Endpoint))
+		}
+		if config.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		e, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("error creating the OTLP exporter: %v", err)
+		}
+		exporter = e
+	case ExporterStdout:
+		var w io.Writer = os.Stdout
+		if config.File != "" {
+			f, err := os.OpenFile(config.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return nil, fmt.Errorf("error opening the trace file: %v", err)
+			}
+			w = f
+		}
+		e, err := stdouttrace.New(stdouttrace.WithWriter(w))
+		if err != nil {
+			return nil, fmt.Errorf("error creating the stdout exporter: %v", err)
+		}
+		exporter = e
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", config.Exporter)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(config.ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// Start starts a span of the global tracer provider, which does nothing
+// unless tracing is set up.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err, if any, on the span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Logger adds the trace and span IDs of the span in ctx, if any, to log.
+func Logger(ctx context.Context, log logr.Logger) logr.Logger {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return log
+	}
+	return log.WithValues("traceID", sc.TraceID().String(), "spanID", sc.SpanID().String())
+}
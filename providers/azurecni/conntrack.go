@@ -0,0 +1,77 @@
+package azurecni
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// ConntrackPolicyAnnotation selects what happens to the pod's existing
+	// connections when its egress IP changes.
+	ConntrackPolicyAnnotation = "azurecni.podexternalip.yglab.eu.org/conntrack"
+
+	// ConntrackPolicyFlush deletes the conntrack entries of the pod IP, so
+	// long-lived connections are reestablished from the new egress IP. This is
+	// the default.
+	ConntrackPolicyFlush = "flush"
+	// ConntrackPolicyKeep keeps the conntrack entries, so existing connections
+	// keep leaving from the old egress IP until they close or time out.
+	ConntrackPolicyKeep = "keep"
+)
+
+// conntrackFlusher deletes conntrack entries, so it can be faked in tests.
+type conntrackFlusher interface {
+	// FlushSource deletes the entries of the connections originating from ip.
+	FlushSource(ip string) error
+}
+
+type execConntrack struct{}
+
+func (execConntrack) FlushSource(ip string) error {
+	args := []string{"-D", "-s", ip}
+	if isIPv6(ip) {
+		args = append(args, "-f", "ipv6")
+	}
+	cmd := exec.Command("conntrack", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// conntrack exits with an error when there is no entry to delete.
+		if strings.Contains(stderr.String(), "0 flow entries have been deleted") {
+			return nil
+		}
+		return fmt.Errorf("conntrack -D failed: %v: %s", err, stderr.String())
+	}
+	return nil
+}
+
+// conntrackPolicy returns the conntrack policy of the pod, defaulting to
+// ConntrackPolicyFlush.
+func conntrackPolicy(pod *corev1.Pod) string {
+	switch policy := pod.Annotations[ConntrackPolicyAnnotation]; policy {
+	case "", ConntrackPolicyFlush:
+		return ConntrackPolicyFlush
+	case ConntrackPolicyKeep:
+		return ConntrackPolicyKeep
+	default:
+		log.Info("unknown conntrack policy, flushing", "pod", namespacedName(pod), "policy", policy)
+		return ConntrackPolicyFlush
+	}
+}
+
+// flushConntrack deletes the conntrack entries of the pod IPs unless the pod
+// keeps them. The egress IP has already changed, so a failure is only logged.
+func flushConntrack(conntrack conntrackFlusher, pod *corev1.Pod, ips []string) {
+	if conntrackPolicy(pod) == ConntrackPolicyKeep {
+		return
+	}
+	for _, ip := range ips {
+		if err := conntrack.FlushSource(ip); err != nil {
+			log.Error(err, "error flushing conntrack entries", "pod", namespacedName(pod), "ip", ip)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package azurecni
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+type fakeConntrack struct {
+	flushed []string
+}
+
+func (f *fakeConntrack) FlushSource(ip string) error {
+	f.flushed = append(f.flushed, ip)
+	return nil
+}
+
+func testPodWithPolicy(name string, policy string) *corev1.Pod {
+	pod := testPod(name)
+	if policy != "" {
+		pod.Annotations = map[string]string{ConntrackPolicyAnnotation: policy}
+	}
+	return pod
+}
+
+func TestConntrackFlush(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []func(*Associater) error
+		want  []string
+	}{
+		{
+			name: "new association flushes",
+			steps: []func(*Associater) error{
+				func(a *Associater) error { return a.addEgress(context.Background(), testPod("a"), "10.1.0.5") },
+			},
+			want: []string{"10.1.0.5"},
+		},
+		{
+			name: "unchanged association keeps connections",
+			steps: []func(*Associater) error{
+				func(a *Associater) error { return a.addEgress(context.Background(), testPod("a"), "10.1.0.5") },
+				func(a *Associater) error { return a.addEgress(context.Background(), testPod("a"), "10.1.0.5") },
+			},
+			want: []string{"10.1.0.5"},
+		},
+		{
+			name: "pod IP change flushes the new IP",
+			steps: []func(*Associater) error{
+				func(a *Associater) error { return a.addEgress(context.Background(), testPod("a"), "10.1.0.5") },
+				func(a *Associater) error { return a.addEgress(context.Background(), testPod("a"), "10.1.0.6") },
+			},
+			want: []string{"10.1.0.5", "10.1.0.6"},
+		},
+		{
+			name: "dissociate flushes",
+			steps: []func(*Associater) error{
+				func(a *Associater) error { return a.addEgress(context.Background(), testPod("a"), "fd00::5") },
+				func(a *Associater) error { return a.Dissociate(context.Background(), testPod("a"), "fd00::5", "") },
+				func(a *Associater) error { return a.Dissociate(context.Background(), testPod("a"), "fd00::5", "") },
+			},
+			want: []string{"fd00::5", "fd00::5"},
+		},
+		{
+			name: "keep policy",
+			steps: []func(*Associater) error{
+				func(a *Associater) error {
+					return a.addEgress(context.Background(), testPodWithPolicy("a", ConntrackPolicyKeep), "10.1.0.5")
+				},
+				func(a *Associater) error {
+					return a.Dissociate(context.Background(), testPodWithPolicy("a", ConntrackPolicyKeep), "10.1.0.5", "")
+				},
+			},
+			want: nil,
+		},
+		{
+			name: "unknown policy flushes",
+			steps: []func(*Associater) error{
+				func(a *Associater) error {
+					return a.addEgress(context.Background(), testPodWithPolicy("a", "sometimes"), "10.1.0.5")
+				},
+			},
+			want: []string{"10.1.0.5"},
+		},
+	}
+
+	for _, backend := range egressBackends {
+		for _, tt := range tests {
+			backend, tt := backend, tt
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				egress, _ := backend.new()
+				if err := egress.Setup([]string{"10.0.0.0/8", "fd00::/8"}); err != nil {
+					t.Fatalf("Setup: %v", err)
+				}
+				conntrack := &fakeConntrack{}
+				a := &Associater{egress: egress, conntrack: conntrack, pods: make(map[string]*corev1.Pod)}
+				for i, step := range tt.steps {
+					if err := step(a); err != nil {
+						t.Fatalf("step %d: %v", i, err)
+					}
+				}
+				if !reflect.DeepEqual(conntrack.flushed, tt.want) {
+					t.Errorf("got flushed %v, want %v", conntrack.flushed, tt.want)
+				}
+			})
+		}
+	}
+}
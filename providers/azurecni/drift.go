@@ -0,0 +1,208 @@
+package azurecni
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/yingeli/pod-external-ip-operator/pkg/tracing"
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+// Kinds of drift of the egress rules.
+const (
+	// DriftMissing is reported when the rules are no longer hooked, e.g.
+	// because another agent flushed the nat table.
+	DriftMissing = "missing"
+	// DriftReordered is reported when the jump to the rules comes after
+	// the masquerading rules of other agents, or the pod rules after the
+	// final RETURN.
+	DriftReordered = "reordered"
+	// DriftLocalNetworks is reported when the local networks differ.
+	DriftLocalNetworks = "local_networks"
+	// DriftPodRuleMissing is reported for a pod IP without its rule.
+	DriftPodRuleMissing = "pod_rule_missing"
+	// DriftPodRuleUnexpected is reported for a rule of a pod IP the daemon
+	// did not associate.
+	DriftPodRuleUnexpected = "pod_rule_unexpected"
+)
+
+// RepairEgressRules compares the egress rules of the node with the desired
+// ones, and repairs them. It returns the drifts it repaired.
+func (a *Associater) RepairEgressRules(ctx context.Context) ([]providers.EgressDrift, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	drifts, err := a.egressDrift()
+	if err != nil || len(drifts) == 0 {
+		return nil, err
+	}
+	if err := a.repairEgressRules(ctx, drifts); err != nil {
+		return nil, err
+	}
+	return drifts, nil
+}
+
+// AdoptEgressRules adopts the rules of the node whose pod IPs are claimed by
+// the same pod, e.g. rules added before the daemon restarted, so they are not
+// removed before their pods are associated again. claimed maps the pod IPs the
+// pods of the node still hold to the namespaced name of their pod. The rules
+// of claimed pod IPs are never reported unexpected, and the other ones only
+// once the rules were adopted.
+func (a *Associater) AdoptEgressRules(claimed map[string]string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.egress == nil {
+		return fmt.Errorf("egress rules are not initialized")
+	}
+	pods, err := a.egress.Pods()
+	if err != nil {
+		return err
+	}
+	for ip, name := range pods {
+		if _, ok := a.pods[ip]; !ok && claimed[ip] == name {
+			log.Info("adopting the egress rule of a pod", "podIP", ip, "pod", name)
+			a.pods[ip] = podFromName(name)
+		}
+	}
+	a.claimed = claimed
+	a.adopted = true
+	return nil
+}
+
+// egressDrift compares the egress rules of the node with the desired ones.
+// a.mu must be held.
+func (a *Associater) egressDrift() ([]providers.EgressDrift, error) {
+	if a.egress == nil {
+		return nil, fmt.Errorf("egress rules are not initialized")
+	}
+	hooked, err := a.egress.Hooked()
+	if err != nil {
+		return nil, err
+	}
+	if !hooked {
+		return []providers.EgressDrift{{Kind: DriftMissing, Message: "the egress rules are not hooked to POSTROUTING"}}, nil
+	}
+
+	var drifts []providers.EgressDrift
+	ordered, err := a.egress.Ordered()
+	if err != nil {
+		return nil, err
+	}
+	if !ordered {
+		drifts = append(drifts, providers.EgressDrift{Kind: DriftReordered, Message: "the egress rules come after rules of other agents that may masquerade the traffic"})
+	}
+
+	current, err := a.egress.LocalNetworks()
+	if err != nil {
+		return nil, err
+	}
+	if added, removed := diffNetworks(current, a.localNetworks); len(added) > 0 || len(removed) > 0 {
+		drifts = append(drifts, providers.EgressDrift{Kind: DriftLocalNetworks, Message: fmt.Sprintf("local networks %v are missing, %v are unexpected", added, removed)})
+	}
+
+	pods, err := a.egress.Pods()
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for ip := range a.pods {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		if pod := namespacedName(a.pods[ip]); pods[trimHostPrefix(ip)] != pod {
+			drifts = append(drifts, providers.EgressDrift{Kind: DriftPodRuleMissing, Message: fmt.Sprintf("the rule of pod IP %s of pod %s is missing", ip, pod), IP: ip, Pod: pod})
+		}
+	}
+	ips = ips[:0]
+	for ip := range pods {
+		ips = append(ips, ip)
+	}
+	sort.Strings(ips)
+	for _, ip := range ips {
+		if name, ok := a.claimed[ip]; !a.adopted || ok && name == pods[ip] {
+			continue
+		}
+		if p, ok := a.pods[ip]; !ok || namespacedName(p) != pods[ip] {
+			drifts = append(drifts, providers.EgressDrift{Kind: DriftPodRuleUnexpected, Message: fmt.Sprintf("the rule of pod IP %s of pod %s is unexpected", ip, pods[ip]), IP: ip, Pod: pods[ip]})
+		}
+	}
+	return drifts, nil
+}
+
+// repairEgressRules repairs the drifts. The rules are set up again when they
+// are missing, reordered or have other local networks, and the rules of the
+// pods added again when they may have been lost. a.mu must be held.
+func (a *Associater) repairEgressRules(ctx context.Context, drifts []providers.EgressDrift) (err error) {
+	_, span := tracing.Start(ctx, "RepairEgressRules", attribute.String("backend", a.backend), attribute.Int("drifts", len(drifts)))
+	defer func() { tracing.End(span, err) }()
+
+	setup, readdAll := false, false
+	var unexpected []string
+	for _, d := range drifts {
+		switch d.Kind {
+		case DriftMissing:
+			setup, readdAll = true, true
+		case DriftReordered:
+			if err := a.egress.Reorder(); err != nil {
+				return err
+			}
+			setup = true
+		case DriftLocalNetworks:
+			setup = true
+		case DriftPodRuleUnexpected:
+			unexpected = append(unexpected, d.Pod)
+		}
+	}
+	if setup {
+		if err := setupEgressRules(a.egress, a.localNetworks); err != nil {
+			return err
+		}
+	}
+
+	// The rules of a pod can only be removed all together, so the rules
+	// the pod should keep are added back below.
+	for _, name := range unexpected {
+		if _, err := a.egress.RemovePod(podFromName(name)); err != nil {
+			return err
+		}
+		readdAll = true
+	}
+	for _, d := range drifts {
+		if d.Kind == DriftPodRuleMissing && !readdAll {
+			if _, err := a.egress.AddOrUpdatePod(a.pods[d.IP], d.IP); err != nil {
+				return err
+			}
+		}
+	}
+	if readdAll {
+		for ip, pod := range a.pods {
+			if _, err := a.egress.AddOrUpdatePod(pod, ip); err != nil {
+				return fmt.Errorf("egress rule of pod %s cannot be added again: %v", namespacedName(pod), err)
+			}
+		}
+	}
+	return nil
+}
+
+// podFromName returns a pod with the namespaced name of a rule comment.
+func podFromName(name string) *corev1.Pod {
+	pod := &corev1.Pod{}
+	if i := strings.Index(name, "/"); i >= 0 {
+		pod.Namespace, pod.Name = name[:i], name[i+1:]
+	} else {
+		pod.Name = name
+	}
+	return pod
+}
+
+// newRulePod returns the pod kept for the rule of a pod IP, with only its
+// namespaced name.
+func newRulePod(pod *corev1.Pod) *corev1.Pod {
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: pod.Namespace, Name: pod.Name}}
+}
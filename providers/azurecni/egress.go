@@ -0,0 +1,192 @@
+package azurecni
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	utilnet "k8s.io/utils/net"
+
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+const (
+	EgressBackendAuto     = "auto"
+	EgressBackendIptables = "iptables"
+	EgressBackendNftables = "nftables"
+)
+
+// egressRules programs the node rules that let traffic from pods with an
+// external IP leave without being masqueraded to the node IP, except towards
+// local networks.
+type egressRules interface {
+	Setup(localNetworks []string) error
+	// LocalNetworks returns the local networks currently programmed.
+	LocalNetworks() ([]string, error)
+	// AddOrUpdatePod programs the pod's localIP and removes the pod's other
+	// IPs of the same family. It reports whether the rule for localIP was
+	// added.
+	AddOrUpdatePod(pod *corev1.Pod, localIP string) (bool, error)
+	// RemovePod removes the pod's IPs and returns the ones it removed.
+	RemovePod(pod *corev1.Pod) ([]string, error)
+	// Pods returns the pod IPs currently programmed, mapped to the namespaced
+	// name of their pod.
+	Pods() (map[string]string, error)
+	// Programmed tells whether the rules are on the node.
+	Programmed() (bool, error)
+	// Hooked tells whether the rules are complete for every IP family and
+	// hooked to the nat POSTROUTING chain, so they apply to the traffic.
+	Hooked() (bool, error)
+	// Ordered tells whether the hook comes before the rules of other agents
+	// that may masquerade the traffic, and the pod rules before the rules
+	// that end the chains.
+	Ordered() (bool, error)
+	// Reorder moves the hook and the pod rules back before the others.
+	Reorder() error
+	// Teardown removes the rules from the node.
+	Teardown() error
+}
+
+func newEgressRules(backend string) (egressRules, error) {
+	if backend == "" || backend == EgressBackendAuto {
+		backend = detectEgressBackend()
+		log.Info("detected egress backend", "backend", backend)
+	}
+
+	switch backend {
+	case EgressBackendIptables:
+		egress, err := newIptablesEgress()
+		if err != nil {
+			return nil, err
+		}
+		return &instrumentedEgress{egressRules: egress, backend: backend}, nil
+	case EgressBackendNftables:
+		return &instrumentedEgress{egressRules: newNftEgress(), backend: backend}, nil
+	default:
+		return nil, fmt.Errorf("unknown egress backend %q", backend)
+	}
+}
+
+// CleanupEgressRules removes the egress rules of every backend found on the
+// node, or only reports them when dryRun is set.
+func CleanupEgressRules(dryRun bool) ([]providers.EgressCleanup, error) {
+	var backends []egressRules
+	if egress, err := newIptablesEgress(); err != nil {
+		log.Info("iptables is not available", "err", err.Error())
+	} else {
+		backends = append(backends, egress)
+	}
+	if _, err := exec.LookPath("nft"); err == nil {
+		backends = append(backends, newNftEgress())
+	}
+	return cleanupEgressRules(backends, dryRun)
+}
+
+func cleanupEgressRules(backends []egressRules, dryRun bool) ([]providers.EgressCleanup, error) {
+	var cleanups []providers.EgressCleanup
+	for _, egress := range backends {
+		programmed, err := egress.Programmed()
+		if err != nil {
+			return cleanups, err
+		}
+		if !programmed {
+			continue
+		}
+		cleanup := providers.EgressCleanup{Backend: egressBackendName(egress)}
+		if cleanup.Pods, err = egress.Pods(); err != nil {
+			return cleanups, err
+		}
+		if !dryRun {
+			if err := egress.Teardown(); err != nil {
+				return cleanups, err
+			}
+		}
+		cleanups = append(cleanups, cleanup)
+	}
+	return cleanups, nil
+}
+
+func egressBackendName(egress egressRules) string {
+	switch e := egress.(type) {
+	case *instrumentedEgress:
+		return e.backend
+	case *iptablesEgress:
+		return EgressBackendIptables
+	case *nftEgress:
+		return EgressBackendNftables
+	}
+	return ""
+}
+
+// setupEgressRules sets up the egress rules, logging how the local networks
+// differ from the ones programmed before, e.g. by a previous daemon.
+func setupEgressRules(egress egressRules, localNetworks []string) error {
+	current, err := egress.LocalNetworks()
+	if err != nil {
+		log.Error(err, "error reading programmed local networks")
+	} else if added, removed := diffNetworks(current, localNetworks); len(added) > 0 || len(removed) > 0 {
+		log.Info("local networks changed", "added", added, "removed", removed)
+	}
+	return egress.Setup(localNetworks)
+}
+
+// diffNetworks returns the networks of desired missing from current, and the
+// networks of current missing from desired.
+func diffNetworks(current []string, desired []string) (added []string, removed []string) {
+	currentSet := make(map[string]bool)
+	for _, n := range current {
+		currentSet[trimHostPrefix(n)] = true
+	}
+	desiredSet := make(map[string]bool)
+	for _, n := range desired {
+		if n == "" {
+			continue
+		}
+		desiredSet[trimHostPrefix(n)] = true
+		if !currentSet[trimHostPrefix(n)] {
+			added = append(added, n)
+		}
+	}
+	for _, n := range current {
+		if !desiredSet[trimHostPrefix(n)] {
+			removed = append(removed, n)
+		}
+	}
+	return added, removed
+}
+
+// mergeNetworks returns the networks of all lists, without duplicates and
+// empty entries.
+func mergeNetworks(lists ...[]string) []string {
+	networks := []string{}
+	seen := make(map[string]bool)
+	for _, list := range lists {
+		for _, n := range list {
+			if n == "" || seen[trimHostPrefix(n)] {
+				continue
+			}
+			seen[trimHostPrefix(n)] = true
+			networks = append(networks, n)
+		}
+	}
+	return networks
+}
+
+// detectEgressBackend picks nftables when the nft tool is available and the
+// node's iptables is itself a front end to nf_tables, and iptables otherwise.
+func detectEgressBackend() string {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return EgressBackendIptables
+	}
+	out, err := exec.Command("iptables", "--version").Output()
+	if err != nil || strings.Contains(string(out), "nf_tables") {
+		return EgressBackendNftables
+	}
+	return EgressBackendIptables
+}
+
+// isIPv6 reports whether addr is an IPv6 address or network.
+func isIPv6(addr string) bool {
+	return utilnet.IsIPv6String(addr) || utilnet.IsIPv6CIDRString(addr)
+}
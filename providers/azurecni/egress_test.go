@@ -0,0 +1,819 @@
+package azurecni
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+// egressState is the effective egress configuration of a node, independent
+// of the backend that programmed it.
+type egressState struct {
+	Hooked        bool
+	LocalNetworks []string
+	Pods          map[string][]string
+}
+
+type egressBackend struct {
+	name string
+	new  func() (egressRules, func() egressState)
+}
+
+var egressBackends = []egressBackend{
+	{
+		name: EgressBackendIptables,
+		new: func() (egressRules, func() egressState) {
+			ipt, ip6t := newFakeIptables(), newFakeIptables()
+			return &iptablesEgress{ipt: ipt, ip6t: ip6t}, func() egressState {
+				return mergeEgressStates(ipt.state(), ip6t.state())
+			}
+		},
+	},
+	{
+		name: EgressBackendNftables,
+		new: func() (egressRules, func() egressState) {
+			nft := newFakeNft()
+			return &nftEgress{nft: nft}, nft.state
+		},
+	},
+}
+
+func testPod(name string) *corev1.Pod {
+	return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+}
+
+func addPod(name string, localIP string) func(egressRules) error {
+	return func(e egressRules) error {
+		_, err := e.AddOrUpdatePod(testPod(name), localIP)
+		return err
+	}
+}
+
+func removePod(name string) func(egressRules) error {
+	return func(e egressRules) error {
+		_, err := e.RemovePod(testPod(name))
+		return err
+	}
+}
+
+func TestEgressRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []func(egressRules) error
+		want  egressState
+	}{
+		{
+			name: "setup programs local networks",
+			steps: []func(egressRules) error{
+				func(e egressRules) error { return e.Setup([]string{"10.0.0.0/8", "", "192.168.0.0/16"}) },
+			},
+			want: egressState{Hooked: true, LocalNetworks: []string{"10.0.0.0/8", "192.168.0.0/16"}, Pods: map[string][]string{}},
+		},
+		{
+			name: "setup replaces local networks",
+			steps: []func(egressRules) error{
+				func(e egressRules) error { return e.Setup([]string{"10.0.0.0/8", "192.168.0.0/16"}) },
+				func(e egressRules) error { return e.Setup([]string{"172.16.0.0/12"}) },
+			},
+			want: egressState{Hooked: true, LocalNetworks: []string{"172.16.0.0/12"}, Pods: map[string][]string{}},
+		},
+		{
+			name: "add pod",
+			steps: []func(egressRules) error{
+				func(e egressRules) error { return e.Setup([]string{"10.0.0.0/8"}) },
+				addPod("a", "10.1.0.5"),
+				addPod("a", "10.1.0.5"),
+			},
+			want: egressState{Hooked: true, LocalNetworks: []string{"10.0.0.0/8"}, Pods: map[string][]string{"default/a": {"10.1.0.5"}}},
+		},
+		{
+			name: "update pod IP",
+			steps: []func(egressRules) error{
+				func(e egressRules) error { return e.Setup([]string{"10.0.0.0/8"}) },
+				addPod("a", "10.1.0.5"),
+				addPod("b", "10.1.0.7"),
+				addPod("a", "10.1.0.6"),
+			},
+			want: egressState{Hooked: true, LocalNetworks: []string{"10.0.0.0/8"}, Pods: map[string][]string{"default/a": {"10.1.0.6"}, "default/b": {"10.1.0.7"}}},
+		},
+		{
+			name: "remove pod",
+			steps: []func(egressRules) error{
+				func(e egressRules) error { return e.Setup([]string{"10.0.0.0/8"}) },
+				addPod("a", "10.1.0.5"),
+				addPod("b", "10.1.0.7"),
+				removePod("a"),
+				removePod("c"),
+			},
+			want: egressState{Hooked: true, LocalNetworks: []string{"10.0.0.0/8"}, Pods: map[string][]string{"default/b": {"10.1.0.7"}}},
+		},
+		{
+			name: "setup keeps pods",
+			steps: []func(egressRules) error{
+				func(e egressRules) error { return e.Setup([]string{"10.0.0.0/8"}) },
+				addPod("a", "10.1.0.5"),
+				func(e egressRules) error { return e.Setup([]string{"10.0.0.0/8"}) },
+			},
+			want: egressState{Hooked: true, LocalNetworks: []string{"10.0.0.0/8"}, Pods: map[string][]string{"default/a": {"10.1.0.5"}}},
+		},
+		{
+			name: "dual-stack pod",
+			steps: []func(egressRules) error{
+				func(e egressRules) error { return e.Setup([]string{"10.0.0.0/8", "fd00::/8"}) },
+				addPod("a", "10.1.0.5"),
+				addPod("a", "fd00::5"),
+				addPod("b", "fd00::7"),
+				addPod("a", "fd00::6"),
+			},
+			want: egressState{Hooked: true, LocalNetworks: []string{"10.0.0.0/8", "fd00::/8"}, Pods: map[string][]string{"default/a": {"10.1.0.5", "fd00::6"}, "default/b": {"fd00::7"}}},
+		},
+		{
+			name: "remove dual-stack pod",
+			steps: []func(egressRules) error{
+				func(e egressRules) error { return e.Setup([]string{"10.0.0.0/8", "fd00::/8"}) },
+				addPod("a", "10.1.0.5"),
+				addPod("a", "fd00::5"),
+				removePod("a"),
+			},
+			want: egressState{Hooked: true, LocalNetworks: []string{"10.0.0.0/8", "fd00::/8"}, Pods: map[string][]string{}},
+		},
+	}
+
+	for _, backend := range egressBackends {
+		for _, tt := range tests {
+			backend, tt := backend, tt
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				egress, state := backend.new()
+				for i, step := range tt.steps {
+					if err := step(egress); err != nil {
+						t.Fatalf("step %d: %v", i, err)
+					}
+				}
+				if got := state(); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("got state %+v, want %+v", got, tt.want)
+				}
+				localNetworks, err := egress.LocalNetworks()
+				if err != nil {
+					t.Fatalf("LocalNetworks: %v", err)
+				}
+				sort.Strings(localNetworks)
+				if !reflect.DeepEqual(localNetworks, tt.want.LocalNetworks) {
+					t.Errorf("got local networks %v, want %v", localNetworks, tt.want.LocalNetworks)
+				}
+				pods, err := egress.Pods()
+				if err != nil {
+					t.Fatalf("Pods: %v", err)
+				}
+				wantPods := make(map[string]string)
+				for pod, ips := range tt.want.Pods {
+					for _, ip := range ips {
+						wantPods[ip] = pod
+					}
+				}
+				if !reflect.DeepEqual(pods, wantPods) {
+					t.Errorf("got pods %v, want %v", pods, wantPods)
+				}
+			})
+		}
+	}
+}
+
+func TestCleanupEgressRules(t *testing.T) {
+	for _, backend := range egressBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			egress, state := backend.new()
+			if err := egress.Setup([]string{"10.0.0.0/8", "fd00::/8"}); err != nil {
+				t.Fatalf("Setup: %v", err)
+			}
+			if err := addPod("a", "10.1.0.5")(egress); err != nil {
+				t.Fatalf("AddOrUpdatePod: %v", err)
+			}
+			programmed := state()
+			wantCleanups := []providers.EgressCleanup{{Backend: backend.name, Pods: map[string]string{"10.1.0.5": "default/a"}}}
+
+			cleanups, err := cleanupEgressRules([]egressRules{egress}, true)
+			if err != nil {
+				t.Fatalf("dry run: %v", err)
+			}
+			if !reflect.DeepEqual(cleanups, wantCleanups) {
+				t.Errorf("dry run reported %+v, want %+v", cleanups, wantCleanups)
+			}
+			if got := state(); !reflect.DeepEqual(got, programmed) {
+				t.Errorf("dry run changed the state to %+v", got)
+			}
+
+			cleanups, err = cleanupEgressRules([]egressRules{egress}, false)
+			if err != nil {
+				t.Fatalf("cleanup: %v", err)
+			}
+			if !reflect.DeepEqual(cleanups, wantCleanups) {
+				t.Errorf("cleanup reported %+v, want %+v", cleanups, wantCleanups)
+			}
+			if got, want := state(), (egressState{Pods: map[string][]string{}}); !reflect.DeepEqual(got, want) {
+				t.Errorf("got state %+v after cleanup, want %+v", got, want)
+			}
+			if programmed, err := egress.Programmed(); err != nil || programmed {
+				t.Errorf("Programmed() = %v, %v after cleanup, want false", programmed, err)
+			}
+
+			cleanups, err = cleanupEgressRules([]egressRules{egress}, false)
+			if err != nil || len(cleanups) != 0 {
+				t.Errorf("second cleanup reported %+v, %v, want nothing", cleanups, err)
+			}
+		})
+	}
+}
+
+func TestCheckEgressRules(t *testing.T) {
+	for _, backend := range egressBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			egress, state := backend.new()
+			localNetworks := []string{"10.0.0.0/8", "fd00::/8"}
+			if err := egress.Setup(localNetworks); err != nil {
+				t.Fatalf("Setup: %v", err)
+			}
+			a := &Associater{egress: egress, conntrack: &fakeConntrack{}, localNetworks: localNetworks, pods: make(map[string]*corev1.Pod), adopted: true}
+			if err := a.addEgress(context.Background(), testPod("a"), "10.1.0.5"); err != nil {
+				t.Fatalf("addEgress: %v", err)
+			}
+			if err := a.CheckEgressRules(context.Background()); err != nil {
+				t.Errorf("CheckEgressRules: %v", err)
+			}
+			programmed := state()
+
+			if err := egress.Teardown(); err != nil {
+				t.Fatalf("Teardown: %v", err)
+			}
+			if hooked, err := egress.Hooked(); err != nil || hooked {
+				t.Errorf("Hooked() = %v, %v after teardown, want false", hooked, err)
+			}
+			if err := a.CheckEgressBackend(context.Background()); err != nil {
+				t.Errorf("CheckEgressBackend() = %v after teardown, want nil", err)
+			}
+			if hooked, err := egress.Hooked(); err != nil || hooked {
+				t.Errorf("Hooked() = %v, %v after the backend check, want false", hooked, err)
+			}
+			if drifts, err := a.RepairEgressRules(context.Background()); err != nil || len(drifts) != 1 || drifts[0].Kind != DriftMissing {
+				t.Fatalf("RepairEgressRules() = %+v, %v, want a repaired %s drift", drifts, err, DriftMissing)
+			}
+			if got := state(); !reflect.DeepEqual(got, programmed) {
+				t.Errorf("got state %+v once set up again, want %+v", got, programmed)
+			}
+
+			if err := addPod("b", "10.1.0.6")(egress); err != nil {
+				t.Fatalf("AddOrUpdatePod: %v", err)
+			}
+			if err := a.CheckEgressRules(context.Background()); err == nil {
+				t.Errorf("CheckEgressRules succeeded with an unexpected pod rule")
+			}
+		})
+	}
+}
+
+func TestRepairEgressRules(t *testing.T) {
+	localNetworks := []string{"10.0.0.0/8", "fd00::/8"}
+	tests := []struct {
+		name      string
+		drift     func(e egressRules) error
+		wantKinds []string
+	}{
+		{
+			name:  "no drift",
+			drift: func(e egressRules) error { return nil },
+		},
+		{
+			name:      "flushed",
+			drift:     func(e egressRules) error { return e.Teardown() },
+			wantKinds: []string{DriftMissing},
+		},
+		{
+			name:      "unexpected pod rule",
+			drift:     addPod("b", "10.1.0.6"),
+			wantKinds: []string{DriftPodRuleUnexpected},
+		},
+		{
+			name:      "missing pod rule",
+			drift:     removePod("a"),
+			wantKinds: []string{DriftPodRuleMissing},
+		},
+		{
+			name:      "local network removed",
+			drift:     func(e egressRules) error { return e.Setup([]string{"10.0.0.0/8"}) },
+			wantKinds: []string{DriftLocalNetworks},
+		},
+	}
+	for _, backend := range egressBackends {
+		for _, tt := range tests {
+			backend, tt := backend, tt
+			t.Run(backend.name+"/"+tt.name, func(t *testing.T) {
+				egress, state := backend.new()
+				if err := egress.Setup(localNetworks); err != nil {
+					t.Fatalf("Setup: %v", err)
+				}
+				a := &Associater{egress: egress, conntrack: &fakeConntrack{}, localNetworks: localNetworks, pods: make(map[string]*corev1.Pod), adopted: true}
+				if err := a.addEgress(context.Background(), testPod("a"), "10.1.0.5"); err != nil {
+					t.Fatalf("addEgress: %v", err)
+				}
+				want := state()
+
+				if err := tt.drift(egress); err != nil {
+					t.Fatalf("drift: %v", err)
+				}
+				drifts, err := a.RepairEgressRules(context.Background())
+				if err != nil {
+					t.Fatalf("RepairEgressRules: %v", err)
+				}
+				var kinds []string
+				for _, d := range drifts {
+					kinds = append(kinds, d.Kind)
+				}
+				if !reflect.DeepEqual(kinds, tt.wantKinds) {
+					t.Errorf("repaired %v, want %v", kinds, tt.wantKinds)
+				}
+				if got := state(); !reflect.DeepEqual(got, want) {
+					t.Errorf("got state %+v once repaired, want %+v", got, want)
+				}
+				if err := a.CheckEgressRules(context.Background()); err != nil {
+					t.Errorf("CheckEgressRules once repaired: %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestAdoptEgressRules(t *testing.T) {
+	for _, backend := range egressBackends {
+		backend := backend
+		t.Run(backend.name, func(t *testing.T) {
+			egress, state := backend.new()
+			localNetworks := []string{"10.0.0.0/8"}
+			if err := egress.Setup(localNetworks); err != nil {
+				t.Fatalf("Setup: %v", err)
+			}
+			for _, add := range []func(egressRules) error{addPod("a", "10.1.0.5"), addPod("b", "10.1.0.6"), addPod("c", "10.1.0.7")} {
+				if err := add(egress); err != nil {
+					t.Fatalf("AddOrUpdatePod: %v", err)
+				}
+			}
+			programmed := state()
+
+			// The daemon restarted, so it has not added the rules itself.
+			a := &Associater{egress: egress, conntrack: &fakeConntrack{}, localNetworks: localNetworks, pods: make(map[string]*corev1.Pod)}
+			if drifts, err := a.RepairEgressRules(context.Background()); err != nil || len(drifts) != 0 {
+				t.Errorf("RepairEgressRules() = %+v, %v before the rules were adopted, want no drift", drifts, err)
+			}
+			if got := state(); !reflect.DeepEqual(got, programmed) {
+				t.Errorf("got state %+v before the rules were adopted, want %+v", got, programmed)
+			}
+
+			// The pod IP of b is now claimed by another pod, and the one of c
+			// by no pod.
+			if err := a.AdoptEgressRules(map[string]string{"10.1.0.5": "default/a", "10.1.0.6": "default/d"}); err != nil {
+				t.Fatalf("AdoptEgressRules: %v", err)
+			}
+			drifts, err := a.RepairEgressRules(context.Background())
+			if err != nil {
+				t.Fatalf("RepairEgressRules: %v", err)
+			}
+			var ips []string
+			for _, d := range drifts {
+				if d.Kind != DriftPodRuleUnexpected {
+					t.Errorf("repaired a %s drift, want only %s", d.Kind, DriftPodRuleUnexpected)
+				}
+				ips = append(ips, d.IP)
+			}
+			if want := []string{"10.1.0.6", "10.1.0.7"}; !reflect.DeepEqual(ips, want) {
+				t.Errorf("repaired the rules of %v, want %v", ips, want)
+			}
+			if got, err := egress.Pods(); err != nil || !reflect.DeepEqual(got, map[string]string{"10.1.0.5": "default/a"}) {
+				t.Errorf("Pods() = %v, %v once repaired, want only the adopted rule", got, err)
+			}
+			if err := a.CheckEgressRules(context.Background()); err != nil {
+				t.Errorf("CheckEgressRules once repaired: %v", err)
+			}
+		})
+	}
+}
+
+func TestRepairReorderedIptables(t *testing.T) {
+	ipt, ip6t := newFakeIptables(), newFakeIptables()
+	egress := &iptablesEgress{ipt: ipt, ip6t: ip6t}
+	localNetworks := []string{"10.0.0.0/8"}
+	if err := egress.Setup(localNetworks); err != nil {
+		t.Fatalf("Setup: %v", err)
+	}
+	a := &Associater{egress: egress, conntrack: &fakeConntrack{}, localNetworks: localNetworks, pods: make(map[string]*corev1.Pod), adopted: true}
+	if err := a.addEgress(context.Background(), testPod("a"), "10.1.0.5"); err != nil {
+		t.Fatalf("addEgress: %v", err)
+	}
+	want := ipt.state()
+
+	// Another agent moves its masquerading rule first, and appends a rule
+	// after the RETURN of the egress chain.
+	if err := ipt.Insert("nat", "POSTROUTING", 1, "-j", "MASQUERADE"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ipt.Append("nat", egressChainName, "-s", "10.1.0.7", "-j", "ACCEPT", "-m", "comment", "--comment", "default/a"); err != nil {
+		t.Fatal(err)
+	}
+	if ordered, err := egress.Ordered(); err != nil || ordered {
+		t.Fatalf("Ordered() = %v, %v, want false", ordered, err)
+	}
+	if _, err := a.RepairEgressRules(context.Background()); err != nil {
+		t.Fatalf("RepairEgressRules: %v", err)
+	}
+	if ordered, err := egress.Ordered(); err != nil || !ordered {
+		t.Errorf("Ordered() = %v, %v once repaired, want true", ordered, err)
+	}
+	got := ipt.state()
+	if !got.Hooked || !reflect.DeepEqual(got.Pods, want.Pods) || !reflect.DeepEqual(got.LocalNetworks, want.LocalNetworks) {
+		t.Errorf("got state %+v once repaired, want %+v", got, want)
+	}
+}
+
+func TestDiffNetworks(t *testing.T) {
+	tests := []struct {
+		name        string
+		current     []string
+		desired     []string
+		wantAdded   []string
+		wantRemoved []string
+	}{
+		{
+			name:      "first setup",
+			desired:   []string{"10.0.0.0/8", ""},
+			wantAdded: []string{"10.0.0.0/8"},
+		},
+		{
+			name:    "unchanged",
+			current: []string{"10.0.0.0/8", "10.1.0.1/32"},
+			desired: []string{"10.1.0.1", "10.0.0.0/8"},
+		},
+		{
+			name:        "changed",
+			current:     []string{"10.0.0.0/8", "192.168.0.0/16"},
+			desired:     []string{"10.0.0.0/8", "172.16.0.0/12"},
+			wantAdded:   []string{"172.16.0.0/12"},
+			wantRemoved: []string{"192.168.0.0/16"},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			added, removed := diffNetworks(tt.current, tt.desired)
+			if !reflect.DeepEqual(added, tt.wantAdded) || !reflect.DeepEqual(removed, tt.wantRemoved) {
+				t.Errorf("got added %v, removed %v, want added %v, removed %v", added, removed, tt.wantAdded, tt.wantRemoved)
+			}
+		})
+	}
+}
+
+// fakeIptables keeps nat table chains in memory and lists them the way
+// iptables -S prints them.
+type fakeIptables struct {
+	chains map[string][][]string
+}
+
+func newFakeIptables() *fakeIptables {
+	return &fakeIptables{chains: map[string][][]string{"POSTROUTING": {{"-j", "KUBE-POSTROUTING"}}}}
+}
+
+func (f *fakeIptables) ChainExists(table, chain string) (bool, error) {
+	_, ok := f.chains[chain]
+	return ok, nil
+}
+
+func (f *fakeIptables) NewChain(table, chain string) error {
+	if _, ok := f.chains[chain]; ok {
+		return fmt.Errorf("chain %s already exists", chain)
+	}
+	f.chains[chain] = nil
+	return nil
+}
+
+func (f *fakeIptables) ClearChain(table, chain string) error {
+	f.chains[chain] = nil
+	return nil
+}
+
+func (f *fakeIptables) DeleteChain(table, chain string) error {
+	rules, ok := f.chains[chain]
+	if !ok {
+		return fmt.Errorf("no chain %s", chain)
+	}
+	if len(rules) > 0 {
+		return fmt.Errorf("chain %s is not empty", chain)
+	}
+	for name, rules := range f.chains {
+		for _, rule := range rules {
+			if len(rule) == 2 && rule[0] == "-j" && rule[1] == chain {
+				return fmt.Errorf("chain %s is referenced by %s", chain, name)
+			}
+		}
+	}
+	delete(f.chains, chain)
+	return nil
+}
+
+func (f *fakeIptables) find(chain string, rulespec []string) int {
+	for i, rule := range f.chains[chain] {
+		if reflect.DeepEqual(rule, rulespec) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (f *fakeIptables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	if _, ok := f.chains[chain]; !ok {
+		return false, fmt.Errorf("no chain %s", chain)
+	}
+	return f.find(chain, rulespec) >= 0, nil
+}
+
+func (f *fakeIptables) Insert(table, chain string, pos int, rulespec ...string) error {
+	rules, ok := f.chains[chain]
+	if !ok {
+		return fmt.Errorf("no chain %s", chain)
+	}
+	rules = append(rules[:pos-1], append([][]string{rulespec}, rules[pos-1:]...)...)
+	f.chains[chain] = rules
+	return nil
+}
+
+func (f *fakeIptables) Append(table, chain string, rulespec ...string) error {
+	if _, ok := f.chains[chain]; !ok {
+		return fmt.Errorf("no chain %s", chain)
+	}
+	f.chains[chain] = append(f.chains[chain], rulespec)
+	return nil
+}
+
+func (f *fakeIptables) AppendUnique(table, chain string, rulespec ...string) error {
+	if exists, err := f.Exists(table, chain, rulespec...); err != nil || exists {
+		return err
+	}
+	return f.Append(table, chain, rulespec...)
+}
+
+func (f *fakeIptables) Delete(table, chain string, rulespec ...string) error {
+	i := f.find(chain, rulespec)
+	if i < 0 {
+		return fmt.Errorf("no rule %v in chain %s", rulespec, chain)
+	}
+	f.chains[chain] = append(f.chains[chain][:i], f.chains[chain][i+1:]...)
+	return nil
+}
+
+func (f *fakeIptables) List(table, chain string) ([]string, error) {
+	rules, ok := f.chains[chain]
+	if !ok {
+		return nil, fmt.Errorf("no chain %s", chain)
+	}
+	list := []string{"-N " + chain}
+	for _, rule := range rules {
+		args := make([]string, len(rule))
+		for i, arg := range rule {
+			if i > 0 && rule[i-1] == "--comment" {
+				arg = `"` + arg + `"`
+			}
+			args[i] = arg
+		}
+		list = append(list, "-A "+chain+" "+strings.Join(args, " "))
+	}
+	return list, nil
+}
+
+// Restore applies the rules to a copy of the chains, which replaces them only
+// when every line succeeds, like iptables-restore --noflush.
+func (f *fakeIptables) Restore(rules string) error {
+	saved := f.chains
+	f.chains = map[string][][]string{}
+	for chain, rules := range saved {
+		f.chains[chain] = append([][]string(nil), rules...)
+	}
+
+	var err error
+	for _, line := range strings.Split(strings.TrimSpace(rules), "\n") {
+		args := splitRule(line)
+		switch {
+		case line == "*nat" || line == "COMMIT":
+		case strings.HasPrefix(line, ":"):
+			f.chains[strings.Fields(line[1:])[0]] = nil
+		case len(args) > 2 && args[0] == "-A":
+			err = f.Append("nat", args[1], args[2:]...)
+		case len(args) > 3 && args[0] == "-I" && args[2] == "1":
+			err = f.Insert("nat", args[1], 1, args[3:]...)
+		default:
+			err = fmt.Errorf("unsupported iptables-restore line %q", line)
+		}
+		if err != nil {
+			f.chains = saved
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeIptables) state() egressState {
+	state := egressState{Pods: map[string][]string{}}
+	postrouting := f.chains["POSTROUTING"]
+	local := f.chains[localChainName]
+	state.Hooked = len(postrouting) > 0 && reflect.DeepEqual(postrouting[0], []string{"-j", localChainName}) &&
+		len(local) >= 2 &&
+		reflect.DeepEqual(local[len(local)-2], []string{"-j", egressChainName}) &&
+		reflect.DeepEqual(local[len(local)-1], []string{"-j", "RETURN"})
+	for _, rule := range local {
+		if len(rule) == 4 && rule[0] == "-d" {
+			state.LocalNetworks = append(state.LocalNetworks, rule[1])
+		}
+	}
+	sort.Strings(state.LocalNetworks)
+	for _, rule := range f.chains[egressChainName] {
+		if comment := parseComment(rule); comment != "" {
+			state.Pods[comment] = append(state.Pods[comment], parseSource(rule))
+		}
+	}
+	return state
+}
+
+// mergeEgressStates merges the states of the IPv4 and IPv6 rules.
+func mergeEgressStates(states ...egressState) egressState {
+	merged := egressState{Hooked: true, Pods: map[string][]string{}}
+	for _, state := range states {
+		merged.Hooked = merged.Hooked && state.Hooked
+		merged.LocalNetworks = append(merged.LocalNetworks, state.LocalNetworks...)
+		for pod, addrs := range state.Pods {
+			merged.Pods[pod] = append(merged.Pods[pod], addrs...)
+		}
+	}
+	sort.Strings(merged.LocalNetworks)
+	for _, addrs := range merged.Pods {
+		sort.Strings(addrs)
+	}
+	return merged
+}
+
+// fakeNft interprets the subset of the nft syntax written by nftEgress.
+// Every script is applied to a copy of the rulesets that only replaces them
+// when all commands succeed, like an nft transaction.
+type fakeNft struct {
+	rulesets map[string]nftRuleset
+}
+
+type nftRuleset struct {
+	chain bool
+	rules []string
+	sets  map[string]map[string]string
+}
+
+func newFakeNft() *fakeNft {
+	return &fakeNft{rulesets: map[string]nftRuleset{}}
+}
+
+func (r nftRuleset) copy() nftRuleset {
+	c := nftRuleset{chain: r.chain, sets: map[string]map[string]string{}}
+	c.rules = append(c.rules, r.rules...)
+	for name, elems := range r.sets {
+		c.sets[name] = map[string]string{}
+		for k, v := range elems {
+			c.sets[name][k] = v
+		}
+	}
+	return c
+}
+
+func (f *fakeNft) Apply(script string) error {
+	rulesets := map[string]nftRuleset{}
+	for family, r := range f.rulesets {
+		rulesets[family] = r.copy()
+	}
+	for _, line := range strings.Split(strings.TrimSpace(script), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[3] != nftTableName {
+			return fmt.Errorf("unsupported nft command %q", line)
+		}
+		verb, object, family := fields[0], fields[1], fields[2]
+		r, ok := rulesets[family]
+		if !ok && !(verb == "add" && object == "table") {
+			return fmt.Errorf("no table %s %s", family, nftTableName)
+		}
+		switch {
+		case verb == "add" && object == "table":
+			if !ok {
+				rulesets[family] = nftRuleset{sets: map[string]map[string]string{}}
+			}
+		case verb == "delete" && object == "table":
+			delete(rulesets, family)
+			continue
+		case verb == "add" && object == "chain" && fields[4] == nftChainName:
+			r.chain = true
+		case verb == "add" && object == "set":
+			if _, ok := r.sets[fields[4]]; !ok {
+				r.sets[fields[4]] = map[string]string{}
+			}
+		case verb == "flush" && object == "chain" && fields[4] == nftChainName:
+			r.rules = nil
+		case verb == "flush" && object == "set":
+			r.sets[fields[4]] = map[string]string{}
+		case verb == "add" && object == "rule" && fields[4] == nftChainName:
+			r.rules = append(r.rules, strings.Join(fields[5:], " "))
+		case (verb == "add" || verb == "delete") && object == "element":
+			set, ok := r.sets[fields[4]]
+			if !ok {
+				return fmt.Errorf("no set %s", fields[4])
+			}
+			rest := strings.Join(fields[5:], " ")
+			if !strings.HasPrefix(rest, "{ ") || !strings.HasSuffix(rest, " }") {
+				return fmt.Errorf("malformed element command %q", line)
+			}
+			for _, elem := range strings.Split(rest[2:len(rest)-2], ", ") {
+				parts := strings.SplitN(elem, " comment ", 2)
+				if verb == "delete" {
+					if _, ok := set[parts[0]]; !ok {
+						return fmt.Errorf("no element %s in set %s", parts[0], fields[4])
+					}
+					delete(set, parts[0])
+				} else if len(parts) == 2 {
+					set[parts[0]] = strings.Trim(parts[1], `"`)
+				} else {
+					set[parts[0]] = ""
+				}
+			}
+		default:
+			return fmt.Errorf("unsupported nft command %q", line)
+		}
+		if verb != "add" || object != "table" {
+			rulesets[family] = r
+		}
+	}
+	f.rulesets = rulesets
+	return nil
+}
+
+func (f *fakeNft) List(args ...string) ([]byte, error) {
+	if len(args) == 1 && args[0] == "tables" {
+		var tables []interface{}
+		for family := range f.rulesets {
+			tables = append(tables, map[string]interface{}{"table": map[string]string{"family": family, "name": nftTableName}})
+		}
+		return json.Marshal(map[string]interface{}{"nftables": tables})
+	}
+	if len(args) != 4 || args[0] != "set" || args[2] != nftTableName {
+		return nil, fmt.Errorf("unsupported nft list %v", args)
+	}
+	set, ok := f.rulesets[args[1]].sets[args[3]]
+	if !ok {
+		return nil, fmt.Errorf("no set %s %s", args[1], args[3])
+	}
+	var elems []interface{}
+	for addr, comment := range set {
+		if i := strings.Index(addr, "/"); i >= 0 {
+			length, _ := strconv.Atoi(addr[i+1:])
+			elems = append(elems, map[string]interface{}{"prefix": map[string]interface{}{"addr": addr[:i], "len": length}})
+		} else if comment == "" {
+			elems = append(elems, addr)
+		} else {
+			elems = append(elems, map[string]interface{}{"elem": map[string]string{"val": addr, "comment": comment}})
+		}
+	}
+	return json.Marshal(map[string]interface{}{
+		"nftables": []interface{}{
+			map[string]interface{}{"metainfo": map[string]string{"version": "0.9.8"}},
+			map[string]interface{}{"set": map[string]interface{}{"name": args[3], "elem": elems}},
+		},
+	})
+}
+
+func (f *fakeNft) state() egressState {
+	var states []egressState
+	for _, family := range nftFamilies {
+		r, ok := f.rulesets[family.name]
+		state := egressState{Pods: map[string][]string{}}
+		state.Hooked = ok && r.chain && reflect.DeepEqual(r.rules, []string{
+			family.addrExpr + " daddr @" + nftLocalSetName + " return",
+			family.addrExpr + " saddr @" + nftEgressSetName + " snat to " + family.addrExpr + " saddr",
+		})
+		for addr := range r.sets[nftLocalSetName] {
+			state.LocalNetworks = append(state.LocalNetworks, addr)
+		}
+		for addr, comment := range r.sets[nftEgressSetName] {
+			state.Pods[comment] = append(state.Pods[comment], addr)
+		}
+		states = append(states, state)
+	}
+	return mergeEgressStates(states...)
+}
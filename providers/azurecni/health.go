@@ -0,0 +1,92 @@
+package azurecni
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/compute"
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/config"
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/imds"
+)
+
+// armCheckPeriod is how long the result of the ARM reachability check is
+// reused, so the probes do not add to the ARM request rate.
+const armCheckPeriod = time.Minute
+
+var armCheck struct {
+	mu      sync.Mutex
+	checked time.Time
+	err     error
+}
+
+// CheckToken checks that the Azure Resource Manager token can be acquired or
+// refreshed.
+func CheckToken(ctx context.Context) error {
+	if err := config.EnsureToken(ctx); err != nil {
+		return fmt.Errorf("cannot acquire the Azure Resource Manager token: %v", err)
+	}
+	return nil
+}
+
+// CheckARM checks that Azure Resource Manager is reachable by reading the VM
+// the operator runs on. The result is reused for a minute.
+func CheckARM(ctx context.Context) error {
+	armCheck.mu.Lock()
+	defer armCheck.mu.Unlock()
+	if !armCheck.checked.IsZero() && time.Since(armCheck.checked) < armCheckPeriod {
+		return armCheck.err
+	}
+	armCheck.err = checkARM(ctx)
+	armCheck.checked = time.Now()
+	return armCheck.err
+}
+
+func checkARM(ctx context.Context) error {
+	metadata, err := imds.GetMetadata()
+	if err != nil {
+		return fmt.Errorf("imds.GetMetadata error: %v", err)
+	}
+	if _, _, err := compute.GetVMPowerState(ctx, metadata.Compute.Name); err != nil {
+		return fmt.Errorf("Azure Resource Manager is not reachable: %v", err)
+	}
+	return nil
+}
+
+// CheckEgressBackend checks that the egress rules of the node can be read,
+// which fails when their backend is unusable, e.g. the iptables binary or
+// the netlink socket. It does not change the rules, which the drift checks
+// repair.
+func (a *Associater) CheckEgressBackend(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.egress == nil {
+		return fmt.Errorf("egress rules are not initialized")
+	}
+	if _, err := a.egress.Hooked(); err != nil {
+		return fmt.Errorf("cannot read the %s egress rules: %v", a.backend, err)
+	}
+	return nil
+}
+
+// CheckEgressRules checks that the egress rules are hooked and ordered, and
+// that the local networks and pod IPs programmed on the node are the desired
+// ones.
+func (a *Associater) CheckEgressRules(ctx context.Context) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	drifts, err := a.egressDrift()
+	if err != nil {
+		return err
+	}
+	if len(drifts) > 0 {
+		messages := make([]string, len(drifts))
+		for i, d := range drifts {
+			messages[i] = d.Message
+		}
+		return fmt.Errorf("egress rules drifted: %s", strings.Join(messages, "; "))
+	}
+	return nil
+}
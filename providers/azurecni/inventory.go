@@ -0,0 +1,86 @@
+package azurecni
+
+import (
+	"context"
+
+	"github.com/Azure/go-autorest/autorest/to"
+
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/network"
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+// Inventory lists the public IPs of the node resource group.
+type Inventory struct {
+}
+
+func NewInventory() Inventory {
+	return Inventory{}
+}
+
+func (i *Inventory) Initialize(ctx context.Context) error {
+	return initializeAzure()
+}
+
+// ExternalIPs returns the public IPs of the node resource group, with the
+// private IP and the VM of the IP configuration they are allocated to.
+func (i *Inventory) ExternalIPs(ctx context.Context) ([]providers.ExternalIP, error) {
+	result, err := network.ListPublicIPs(ctx)
+	if err != nil {
+		return nil, providerError(err)
+	}
+	providerIDs := make(map[string]string)
+	var ips []providers.ExternalIP
+	for result.NotDone() {
+		for _, pip := range result.Values() {
+			ip := providers.ExternalIP{Name: to.String(pip.Name)}
+			if pip.PublicIPAddressPropertiesFormat != nil {
+				ip.Address = to.String(pip.IPAddress)
+				if pip.IPConfiguration != nil && pip.IPConfiguration.ID != nil {
+					if ip.Holder, err = describeHolder(ctx, *pip.IPConfiguration.ID, providerIDs); err != nil {
+						return nil, err
+					}
+				}
+			}
+			ips = append(ips, ip)
+		}
+		if err := result.NextWithContext(ctx); err != nil {
+			return nil, providerError(err)
+		}
+	}
+	return ips, nil
+}
+
+// describeHolder looks up the private IP of an IP configuration, and the
+// provider ID of the VM of its network interface, which is cached by network
+// interface name in providerIDs. IP configurations of load balancers and
+// gateways only have their ID set.
+func describeHolder(ctx context.Context, id string, providerIDs map[string]string) (providers.Holder, error) {
+	holder := providers.Holder{ID: id}
+	r, err := network.ParseIPConfigurationID(id)
+	if err != nil {
+		return holder, nil
+	}
+
+	ipconfig, err := network.GetIPConfiguration(ctx, id)
+	if err != nil {
+		return holder, providerError(err)
+	}
+	if ipconfig.InterfaceIPConfigurationPropertiesFormat != nil {
+		holder.PrivateIP = to.String(ipconfig.PrivateIPAddress)
+		holder.Primary = to.Bool(ipconfig.Primary)
+	}
+
+	providerID, ok := providerIDs[r.NicName]
+	if !ok {
+		nic, err := network.GetNic(ctx, r.NicName)
+		if err != nil {
+			return holder, providerError(err)
+		}
+		if nic.InterfacePropertiesFormat != nil && nic.VirtualMachine != nil && nic.VirtualMachine.ID != nil {
+			providerID = "azure://" + *nic.VirtualMachine.ID
+		}
+		providerIDs[r.NicName] = providerID
+	}
+	holder.ProviderID = providerID
+	return holder, nil
+}
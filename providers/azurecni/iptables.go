@@ -1,7 +1,9 @@
 package azurecni
 
 import (
+	"bytes"
 	"fmt"
+	"os/exec"
 	"strings"
 
 	corev1 "k8s.io/api/core/v1"
@@ -14,102 +16,443 @@ const (
 	egressChainName = "EXTERNAL-IP-EGRESS"
 )
 
-func SetupIptables(localNetworks []string) error {
+// iptablesRunner is the subset of *iptables.IPTables used to program the
+// egress chains, so the rules can be exercised against a fake.
+type iptablesRunner interface {
+	ChainExists(table, chain string) (bool, error)
+	NewChain(table, chain string) error
+	ClearChain(table, chain string) error
+	DeleteChain(table, chain string) error
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	Insert(table, chain string, pos int, rulespec ...string) error
+	Append(table, chain string, rulespec ...string) error
+	AppendUnique(table, chain string, rulespec ...string) error
+	Delete(table, chain string, rulespec ...string) error
+	List(table, chain string) ([]string, error)
+	// Restore applies rules in the iptables-save format in a single commit,
+	// leaving the chains it does not declare untouched.
+	Restore(rules string) error
+}
+
+// execIptables adds iptables-restore to *iptables.IPTables.
+type execIptables struct {
+	*iptables.IPTables
+}
+
+func (ipt execIptables) Restore(rules string) error {
+	command := "iptables-restore"
+	if ipt.Proto() == iptables.ProtocolIPv6 {
+		command = "ip6tables-restore"
+	}
+	cmd := exec.Command(command, "--noflush", "--wait")
+	cmd.Stdin = strings.NewReader(rules)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", command, err, stderr.String())
+	}
+	return nil
+}
+
+// iptablesEgress programs the egress rules as EXTERNAL-IP-LOCAL and
+// EXTERNAL-IP-EGRESS chains in the iptables nat table, and in the ip6tables
+// nat table for IPv6 pods.
+type iptablesEgress struct {
+	ipt  iptablesRunner
+	ip6t iptablesRunner
+}
+
+func newIptablesEgress() (*iptablesEgress, error) {
 	ipt, err := iptables.New()
 	if err != nil {
-		return err
+		return nil, err
 	}
+	e := &iptablesEgress{ipt: execIptables{ipt}}
 
-	exists, err := ipt.ChainExists("nat", egressChainName)
+	ip6t, err := iptables.New(iptables.IPFamily(iptables.ProtocolIPv6))
 	if err != nil {
-		return err
+		log.Info("ip6tables is not available, IPv6 egress rules are disabled", "err", err.Error())
+	} else {
+		e.ip6t = execIptables{ip6t}
 	}
-	if !exists {
-		if err := ipt.NewChain("nat", egressChainName); err != nil {
-			return err
-		}
+	return e, nil
+}
+
+// runner returns the iptables runner for the IP family of addr.
+func (e *iptablesEgress) runner(addr string) (iptablesRunner, error) {
+	if !isIPv6(addr) {
+		return e.ipt, nil
 	}
-	ruleSpec := []string{"-j", "RETURN"}
-	if err := ipt.AppendUnique("nat", egressChainName, ruleSpec...); err != nil {
-		return err
+	if e.ip6t == nil {
+		return nil, fmt.Errorf("cannot program IPv6 address %s: ip6tables is not available", addr)
 	}
+	return e.ip6t, nil
+}
 
-	if err := ipt.ClearChain("nat", localChainName); err != nil {
-		return err
+// runners returns the iptables runners for every available IP family.
+func (e *iptablesEgress) runners() []iptablesRunner {
+	if e.ip6t == nil {
+		return []iptablesRunner{e.ipt}
 	}
+	return []iptablesRunner{e.ipt, e.ip6t}
+}
+
+func (e *iptablesEgress) Setup(localNetworks []string) error {
+	var localNetworks6 []string
+	var localNetworks4 []string
 	for _, ln := range localNetworks {
 		if ln == "" {
 			continue
 		}
-		ruleSpec := []string{"-d", ln, "-j", "RETURN"}
-		if err := ipt.AppendUnique("nat", localChainName, ruleSpec...); err != nil {
-			return fmt.Errorf("error adding local network %s, error: %v", ln, err)
+		if isIPv6(ln) {
+			localNetworks6 = append(localNetworks6, ln)
+		} else {
+			localNetworks4 = append(localNetworks4, ln)
 		}
 	}
-	ruleSpec = []string{"-j", egressChainName}
-	if err := ipt.Append("nat", localChainName, ruleSpec...); err != nil {
+
+	if err := setupChains(e.ipt, localNetworks4); err != nil {
 		return err
 	}
-	ruleSpec = []string{"-j", "RETURN"}
-	if err := ipt.Append("nat", localChainName, ruleSpec...); err != nil {
+	if e.ip6t != nil {
+		if err := setupChains(e.ip6t, localNetworks6); err != nil {
+			return err
+		}
+	} else if len(localNetworks6) > 0 {
+		return fmt.Errorf("cannot add IPv6 local networks %v: ip6tables is not available", localNetworks6)
+	}
+	return nil
+}
+
+// setupChains rebuilds EXTERNAL-IP-LOCAL with iptables-restore, so the chain
+// is swapped in a single commit and traffic to local networks is never
+// matched by a half written chain. EXTERNAL-IP-EGRESS keeps its pod rules.
+func setupChains(ipt iptablesRunner, localNetworks []string) error {
+	var b strings.Builder
+	b.WriteString("*nat\n")
+	fmt.Fprintf(&b, ":%s - [0:0]\n", localChainName)
+
+	exists, err := ipt.ChainExists("nat", egressChainName)
+	if err != nil {
 		return err
 	}
+	if exists {
+		ruleSpec := []string{"-j", "RETURN"}
+		if err := ipt.AppendUnique("nat", egressChainName, ruleSpec...); err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintf(&b, ":%s - [0:0]\n", egressChainName)
+		fmt.Fprintf(&b, "-A %s -j RETURN\n", egressChainName)
+	}
 
-	ruleSpec = []string{"-j", localChainName}
-	if err := insertUnique(ipt, "nat", "POSTROUTING", ruleSpec); err != nil {
+	for _, ln := range localNetworks {
+		fmt.Fprintf(&b, "-A %s -d %s -j RETURN\n", localChainName, ln)
+	}
+	fmt.Fprintf(&b, "-A %s -j %s\n", localChainName, egressChainName)
+	fmt.Fprintf(&b, "-A %s -j RETURN\n", localChainName)
+
+	hooked, err := ipt.Exists("nat", "POSTROUTING", "-j", localChainName)
+	if err != nil {
 		return err
 	}
+	if !hooked {
+		fmt.Fprintf(&b, "-I POSTROUTING 1 -j %s\n", localChainName)
+	}
+	b.WriteString("COMMIT\n")
 
+	if err := ipt.Restore(b.String()); err != nil {
+		return fmt.Errorf("error restoring %s chain, local networks %v: %v", localChainName, localNetworks, err)
+	}
 	return nil
 }
 
-func AddOrUpdatePodIPRules(pod *corev1.Pod, localIP string) error {
-	ipt, err := iptables.New()
-	if err != nil {
-		return err
+func (e *iptablesEgress) Programmed() (bool, error) {
+	for _, ipt := range e.runners() {
+		for _, chain := range []string{localChainName, egressChainName} {
+			exists, err := ipt.ChainExists("nat", chain)
+			if err != nil || exists {
+				return exists, err
+			}
+		}
 	}
+	return false, nil
+}
 
-	ruleSpec := []string{"-s", localIP, "-j", "ACCEPT", "-m", "comment", "--comment", namespacedName(pod)}
-	if err := insertUnique(ipt, "nat", egressChainName, ruleSpec); err != nil {
-		return err
+func (e *iptablesEgress) Hooked() (bool, error) {
+	for _, ipt := range e.runners() {
+		for _, chain := range []string{localChainName, egressChainName} {
+			exists, err := ipt.ChainExists("nat", chain)
+			if err != nil || !exists {
+				return false, err
+			}
+		}
+		hooked, err := ipt.Exists("nat", "POSTROUTING", "-j", localChainName)
+		if err != nil || !hooked {
+			return false, err
+		}
 	}
+	return true, nil
+}
 
-	rules, err := ipt.List("nat", egressChainName)
-	if err != nil {
+func (e *iptablesEgress) Ordered() (bool, error) {
+	for _, ipt := range e.runners() {
+		rules, err := ipt.List("nat", "POSTROUTING")
+		if err != nil {
+			return false, err
+		}
+		for _, rule := range rules {
+			ruleSpec := splitRule(rule)
+			if len(ruleSpec) < 2 || ruleSpec[0] != "-A" {
+				continue
+			}
+			if isJumpTo(ruleSpec[2:], localChainName) {
+				break
+			}
+			if mayMasquerade(ruleSpec[2:]) {
+				return false, nil
+			}
+		}
+
+		rules, err = ipt.List("nat", egressChainName)
+		if err != nil {
+			return false, err
+		}
+		returned := false
+		for _, rule := range rules {
+			ruleSpec := splitRule(rule)
+			if len(ruleSpec) < 2 || ruleSpec[0] != "-A" {
+				continue
+			}
+			if isJumpTo(ruleSpec[2:], "RETURN") {
+				returned = true
+			} else if returned && parseComment(ruleSpec) != "" {
+				return false, nil
+			}
+		}
+	}
+	return true, nil
+}
+
+// Reorder inserts the jump to EXTERNAL-IP-LOCAL first in POSTROUTING again,
+// and appends the RETURN of EXTERNAL-IP-EGRESS after the pod rules again.
+// EXTERNAL-IP-LOCAL is rebuilt by Setup.
+func (e *iptablesEgress) Reorder() error {
+	for _, ipt := range e.runners() {
+		if err := deleteIfExists(ipt, "POSTROUTING", "-j", localChainName); err != nil {
+			return err
+		}
+		if err := ipt.Insert("nat", "POSTROUTING", 1, "-j", localChainName); err != nil {
+			return err
+		}
+		if err := deleteIfExists(ipt, egressChainName, "-j", "RETURN"); err != nil {
+			return err
+		}
+		if err := ipt.Append("nat", egressChainName, "-j", "RETURN"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteIfExists(ipt iptablesRunner, chain string, ruleSpec ...string) error {
+	exists, err := ipt.Exists("nat", chain, ruleSpec...)
+	if err != nil || !exists {
 		return err
 	}
-	for _, rule := range rules {
-		ruleSpec := strings.Split(rule, " \"")
-		if parseComment(ruleSpec) == namespacedName(pod) && parseSource(ruleSpec) != localIP {
-			if err := ipt.Delete("nat", egressChainName, ruleSpec[2:]...); err != nil {
+	return ipt.Delete("nat", chain, ruleSpec...)
+}
+
+// isJumpTo tells whether the rule spec jumps to target without matches.
+func isJumpTo(ruleSpec []string, target string) bool {
+	return len(ruleSpec) == 2 && ruleSpec[0] == "-j" && ruleSpec[1] == target
+}
+
+// mayMasquerade tells whether the rule spec masquerades or SNATs, or jumps
+// to a chain that may do it.
+func mayMasquerade(ruleSpec []string) bool {
+	for i := 0; i+1 < len(ruleSpec); i++ {
+		if ruleSpec[i] != "-j" && ruleSpec[i] != "--jump" {
+			continue
+		}
+		switch ruleSpec[i+1] {
+		case "ACCEPT", "RETURN", "LOG", "MARK", "CONNMARK", "DROP":
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+func (e *iptablesEgress) Teardown() error {
+	for _, ipt := range e.runners() {
+		if err := teardownChains(ipt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// teardownChains unhooks EXTERNAL-IP-LOCAL from POSTROUTING, then deletes it
+// before EXTERNAL-IP-EGRESS, which it jumps to.
+func teardownChains(ipt iptablesRunner) error {
+	for _, chain := range []string{localChainName, egressChainName} {
+		exists, err := ipt.ChainExists("nat", chain)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		if chain == localChainName {
+			hooked, err := ipt.Exists("nat", "POSTROUTING", "-j", localChainName)
+			if err != nil {
 				return err
 			}
+			if hooked {
+				if err := ipt.Delete("nat", "POSTROUTING", "-j", localChainName); err != nil {
+					return err
+				}
+			}
+		}
+		if err := ipt.ClearChain("nat", chain); err != nil {
+			return err
+		}
+		if err := ipt.DeleteChain("nat", chain); err != nil {
+			return err
 		}
 	}
-
 	return nil
 }
 
-func RemovePodIPRules(pod *corev1.Pod) error {
-	ipt, err := iptables.New()
+func (e *iptablesEgress) LocalNetworks() ([]string, error) {
+	var localNetworks []string
+	for _, ipt := range e.runners() {
+		exists, err := ipt.ChainExists("nat", localChainName)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		rules, err := ipt.List("nat", localChainName)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			ruleSpec := splitRule(rule)
+			if len(ruleSpec) == 6 && ruleSpec[0] == "-A" && ruleSpec[2] == "-d" && ruleSpec[5] == "RETURN" {
+				localNetworks = append(localNetworks, ruleSpec[3])
+			}
+		}
+	}
+	return localNetworks, nil
+}
+
+func (e *iptablesEgress) AddOrUpdatePod(pod *corev1.Pod, localIP string) (bool, error) {
+	ipt, err := e.runner(localIP)
 	if err != nil {
-		return err
+		return false, err
 	}
 
+	ruleSpec := []string{"-s", localIP, "-j", "ACCEPT", "-m", "comment", "--comment", namespacedName(pod)}
+	inserted, err := insertUnique(ipt, "nat", egressChainName, ruleSpec)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := removePodRules(ipt, pod, localIP); err != nil {
+		return false, err
+	}
+	return inserted, nil
+}
+
+func (e *iptablesEgress) RemovePod(pod *corev1.Pod) ([]string, error) {
+	var removed []string
+	for _, ipt := range e.runners() {
+		ips, err := removePodRules(ipt, pod, "")
+		if err != nil {
+			return nil, err
+		}
+		removed = append(removed, ips...)
+	}
+	return removed, nil
+}
+
+func (e *iptablesEgress) Pods() (map[string]string, error) {
+	pods := make(map[string]string)
+	for _, ipt := range e.runners() {
+		rules, err := ipt.List("nat", egressChainName)
+		if err != nil {
+			return nil, err
+		}
+		for _, rule := range rules {
+			ruleSpec := splitRule(rule)
+			if len(ruleSpec) < 2 || ruleSpec[0] != "-A" {
+				continue
+			}
+			if pod, source := parseComment(ruleSpec), parseSource(ruleSpec); pod != "" && source != "" {
+				pods[trimHostPrefix(source)] = pod
+			}
+		}
+	}
+	return pods, nil
+}
+
+// removePodRules deletes the rules of the pod, except the one for keepIP, and
+// returns the source IPs of the deleted rules.
+func removePodRules(ipt iptablesRunner, pod *corev1.Pod, keepIP string) ([]string, error) {
 	rules, err := ipt.List("nat", egressChainName)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	var removed []string
 	for _, rule := range rules {
-		ruleSpec := strings.Split(rule, " \"")
-		if parseComment(ruleSpec) == namespacedName(pod) {
-			if err := ipt.Delete("nat", egressChainName, ruleSpec[2:]...); err != nil {
-				return err
-			}
+		ruleSpec := splitRule(rule)
+		if len(ruleSpec) < 2 || ruleSpec[0] != "-A" {
+			continue
+		}
+		if parseComment(ruleSpec) != namespacedName(pod) {
+			continue
+		}
+		if keepIP != "" && sameAddress(parseSource(ruleSpec), keepIP) {
+			continue
 		}
+		if err := ipt.Delete("nat", egressChainName, ruleSpec[2:]...); err != nil {
+			return nil, err
+		}
+		removed = append(removed, trimHostPrefix(parseSource(ruleSpec)))
 	}
 
-	return nil
+	return removed, nil
+}
+
+// splitRule splits a rule as printed by iptables -S into its arguments,
+// keeping quoted arguments such as comments together.
+func splitRule(rule string) []string {
+	var args []string
+	var arg strings.Builder
+	quoted, inArg := false, false
+	for _, c := range rule {
+		switch {
+		case c == '"':
+			quoted = !quoted
+			inArg = true
+		case c == ' ' && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args
 }
 
 func parseComment(ruleSpec []string) string {
@@ -131,17 +474,30 @@ func parseSource(ruleSpec []string) string {
 	return ""
 }
 
-func insertUnique(ipt *iptables.IPTables, table string, chain string, ruleSpec []string) error {
+// sameAddress compares a host address with one that iptables may have
+// printed with a /32 or /128 prefix length.
+func sameAddress(a string, b string) bool {
+	return trimHostPrefix(a) == trimHostPrefix(b)
+}
+
+func trimHostPrefix(addr string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(addr, "/32"), "/128")
+}
+
+// insertUnique inserts the rule at the top of chain unless it exists, and
+// reports whether it was inserted.
+func insertUnique(ipt iptablesRunner, table string, chain string, ruleSpec []string) (bool, error) {
 	hasRule, err := ipt.Exists(table, chain, ruleSpec...)
 	if err != nil {
-		return err
+		return false, err
 	}
-	if !hasRule {
-		if err := ipt.Insert(table, chain, 1, ruleSpec...); err != nil {
-			return err
-		}
+	if hasRule {
+		return false, nil
 	}
-	return nil
+	if err := ipt.Insert(table, chain, 1, ruleSpec...); err != nil {
+		return false, err
+	}
+	return true, nil
 }
 
 func namespacedName(pod *corev1.Pod) string {
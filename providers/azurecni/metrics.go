@@ -0,0 +1,70 @@
+package azurecni
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	ctrlmetrics "sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	egressPodRules = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "podexternalip_egress_pod_rules",
+		Help: "Number of pod IPs programmed in the node egress rules by backend and IP family.",
+	}, []string{"backend", "family"})
+
+	egressErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "podexternalip_egress_errors_total",
+		Help: "Number of errors programming the node egress rules by backend and operation.",
+	}, []string{"backend", "operation"})
+)
+
+func init() {
+	ctrlmetrics.Registry.MustRegister(egressPodRules, egressErrors)
+}
+
+// instrumentedEgress counts the errors of the egress rules, and the pod IPs
+// programmed after every change.
+type instrumentedEgress struct {
+	egressRules
+	backend string
+}
+
+func (e *instrumentedEgress) Setup(localNetworks []string) error {
+	err := e.egressRules.Setup(localNetworks)
+	e.observe("setup", err)
+	return err
+}
+
+func (e *instrumentedEgress) AddOrUpdatePod(pod *corev1.Pod, localIP string) (bool, error) {
+	added, err := e.egressRules.AddOrUpdatePod(pod, localIP)
+	e.observe("add_pod", err)
+	return added, err
+}
+
+func (e *instrumentedEgress) RemovePod(pod *corev1.Pod) ([]string, error) {
+	removed, err := e.egressRules.RemovePod(pod)
+	e.observe("remove_pod", err)
+	return removed, err
+}
+
+func (e *instrumentedEgress) observe(operation string, err error) {
+	if err != nil {
+		egressErrors.WithLabelValues(e.backend, operation).Inc()
+	}
+	pods, err := e.egressRules.Pods()
+	if err != nil {
+		egressErrors.WithLabelValues(e.backend, "list_pods").Inc()
+		return
+	}
+	counts := map[string]int{"ipv4": 0, "ipv6": 0}
+	for ip := range pods {
+		if isIPv6(ip) {
+			counts["ipv6"]++
+		} else {
+			counts["ipv4"]++
+		}
+	}
+	for family, count := range counts {
+		egressPodRules.WithLabelValues(e.backend, family).Set(float64(count))
+	}
+}
@@ -0,0 +1,343 @@
+package azurecni
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	nftTableName     = "external-ip"
+	nftChainName     = "postrouting"
+	nftLocalSetName  = "local-networks"
+	nftEgressSetName = "egress-pods"
+
+	// nftChainPriority places our chain just before the srcnat priority (100)
+	// used by the iptables-nft nat table, so the identity SNAT below wins over
+	// any MASQUERADE rule programmed by kube-proxy or the CNI.
+	nftChainPriority = 99
+)
+
+// nftRunner runs nft commands, so the rules can be exercised against a fake.
+type nftRunner interface {
+	// Apply runs script as a single, atomic nft transaction.
+	Apply(script string) error
+	// List returns the JSON output of nft list for args.
+	List(args ...string) ([]byte, error)
+}
+
+type execNft struct{}
+
+func (execNft) Apply(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("nft -f failed: %v: %s", err, stderr.String())
+	}
+	return nil
+}
+
+func (execNft) List(args ...string) ([]byte, error) {
+	cmd := exec.Command("nft", append([]string{"-j", "list"}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("nft list failed: %v: %s", err, stderr.String())
+	}
+	return out, nil
+}
+
+// nftFamily is an nftables address family, each with its own table.
+type nftFamily struct {
+	name     string
+	addrType string
+	addrExpr string
+}
+
+var nftFamilies = []nftFamily{
+	{name: "ip", addrType: "ipv4_addr", addrExpr: "ip"},
+	{name: "ip6", addrType: "ipv6_addr", addrExpr: "ip6"},
+}
+
+func nftFamilyOf(addr string) nftFamily {
+	if isIPv6(addr) {
+		return nftFamilies[1]
+	}
+	return nftFamilies[0]
+}
+
+// nftEgress programs the egress rules as a dedicated nftables table per IP
+// family. Local networks and pod IPs are kept in sets, so every change is a
+// single transaction that never leaves the chain half written.
+//
+// A packet whose destination is a local network returns, leaving it to the
+// regular masquerading. A packet from a pod with an external IP is SNATed to
+// its own address, which binds the connection's source NAT and stops later
+// nat chains from masquerading it to the node IP. This mirrors the ACCEPT
+// verdict in the iptables EXTERNAL-IP-EGRESS chain.
+type nftEgress struct {
+	nft nftRunner
+}
+
+func newNftEgress() *nftEgress {
+	return &nftEgress{nft: execNft{}}
+}
+
+func (e *nftEgress) Setup(localNetworks []string) error {
+	var b strings.Builder
+	for _, f := range nftFamilies {
+		fmt.Fprintf(&b, "add table %s %s\n", f.name, nftTableName)
+		fmt.Fprintf(&b, "add chain %s %s %s { type nat hook postrouting priority %d; }\n", f.name, nftTableName, nftChainName, nftChainPriority)
+		fmt.Fprintf(&b, "add set %s %s %s { type %s; flags interval; }\n", f.name, nftTableName, nftLocalSetName, f.addrType)
+		fmt.Fprintf(&b, "add set %s %s %s { type %s; }\n", f.name, nftTableName, nftEgressSetName, f.addrType)
+		fmt.Fprintf(&b, "flush chain %s %s %s\n", f.name, nftTableName, nftChainName)
+		fmt.Fprintf(&b, "flush set %s %s %s\n", f.name, nftTableName, nftLocalSetName)
+		var elems []string
+		for _, ln := range localNetworks {
+			if ln == "" || nftFamilyOf(ln) != f {
+				continue
+			}
+			elems = append(elems, ln)
+		}
+		if len(elems) > 0 {
+			fmt.Fprintf(&b, "add element %s %s %s { %s }\n", f.name, nftTableName, nftLocalSetName, strings.Join(elems, ", "))
+		}
+		fmt.Fprintf(&b, "add rule %s %s %s %s daddr @%s return\n", f.name, nftTableName, nftChainName, f.addrExpr, nftLocalSetName)
+		fmt.Fprintf(&b, "add rule %s %s %s %s saddr @%s snat to %s saddr\n", f.name, nftTableName, nftChainName, f.addrExpr, nftEgressSetName, f.addrExpr)
+	}
+	return e.nft.Apply(b.String())
+}
+
+func (e *nftEgress) AddOrUpdatePod(pod *corev1.Pod, localIP string) (bool, error) {
+	family := nftFamilyOf(localIP)
+	elems, err := e.listEgressPods(family)
+	if err != nil {
+		return false, err
+	}
+
+	var b strings.Builder
+	added := true
+	for addr, comment := range elems {
+		if !sameAddress(addr, localIP) {
+			if comment == namespacedName(pod) {
+				fmt.Fprintf(&b, "delete element %s %s %s { %s }\n", family.name, nftTableName, nftEgressSetName, addr)
+			}
+		} else if comment == namespacedName(pod) {
+			added = false
+		}
+	}
+	fmt.Fprintf(&b, "add element %s %s %s { %s comment %q }\n", family.name, nftTableName, nftEgressSetName, localIP, namespacedName(pod))
+	if err := e.nft.Apply(b.String()); err != nil {
+		return false, err
+	}
+	return added, nil
+}
+
+func (e *nftEgress) RemovePod(pod *corev1.Pod) ([]string, error) {
+	var b strings.Builder
+	var removed []string
+	for _, family := range nftFamilies {
+		elems, err := e.listEgressPods(family)
+		if err != nil {
+			return nil, err
+		}
+		for addr, comment := range elems {
+			if comment == namespacedName(pod) {
+				fmt.Fprintf(&b, "delete element %s %s %s { %s }\n", family.name, nftTableName, nftEgressSetName, addr)
+				removed = append(removed, addr)
+			}
+		}
+	}
+	if b.Len() == 0 {
+		return nil, nil
+	}
+	if err := e.nft.Apply(b.String()); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+func (e *nftEgress) Pods() (map[string]string, error) {
+	pods := make(map[string]string)
+	for _, family := range nftFamilies {
+		elems, err := e.listEgressPods(family)
+		if err != nil {
+			return nil, err
+		}
+		for addr, pod := range elems {
+			pods[addr] = pod
+		}
+	}
+	return pods, nil
+}
+
+func (e *nftEgress) Programmed() (bool, error) {
+	families, err := e.tableFamilies()
+	return len(families) > 0, err
+}
+
+// Hooked tells whether every family has our table. Its chain is a base chain
+// of the postrouting hook, which Setup always creates along with the table.
+func (e *nftEgress) Hooked() (bool, error) {
+	families, err := e.tableFamilies()
+	if err != nil {
+		return false, err
+	}
+	for _, f := range nftFamilies {
+		found := false
+		for _, family := range families {
+			found = found || family == f.name
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Ordered is always true, since the chain runs before the nat chains of
+// other agents by its priority.
+func (e *nftEgress) Ordered() (bool, error) {
+	return true, nil
+}
+
+// Reorder does nothing, see Ordered.
+func (e *nftEgress) Reorder() error {
+	return nil
+}
+
+// Teardown deletes the table of every family. Adding the table first keeps
+// the transaction from failing when it does not exist.
+func (e *nftEgress) Teardown() error {
+	var b strings.Builder
+	for _, f := range nftFamilies {
+		fmt.Fprintf(&b, "add table %s %s\n", f.name, nftTableName)
+		fmt.Fprintf(&b, "delete table %s %s\n", f.name, nftTableName)
+	}
+	return e.nft.Apply(b.String())
+}
+
+// tableFamilies returns the families that have our table.
+func (e *nftEgress) tableFamilies() ([]string, error) {
+	out, err := e.nft.List("tables")
+	if err != nil {
+		return nil, err
+	}
+	var listing nftListing
+	if err := json.Unmarshal(out, &listing); err != nil {
+		return nil, fmt.Errorf("error parsing nft output: %v", err)
+	}
+	var families []string
+	for _, obj := range listing.Nftables {
+		if obj.Table != nil && obj.Table.Name == nftTableName {
+			families = append(families, obj.Table.Family)
+		}
+	}
+	return families, nil
+}
+
+func (e *nftEgress) LocalNetworks() ([]string, error) {
+	families, err := e.tableFamilies()
+	if err != nil {
+		return nil, err
+	}
+
+	var localNetworks []string
+	for _, family := range families {
+		out, err := e.nft.List("set", family, nftTableName, nftLocalSetName)
+		if err != nil {
+			return nil, err
+		}
+		elems, err := parseNftSetElements(out)
+		if err != nil {
+			return nil, err
+		}
+		for elem := range elems {
+			localNetworks = append(localNetworks, elem)
+		}
+	}
+	return localNetworks, nil
+}
+
+// listEgressPods returns the pod IPs in the egress set of family, mapped to
+// the namespaced name of the pod kept in the element comment.
+func (e *nftEgress) listEgressPods(family nftFamily) (map[string]string, error) {
+	out, err := e.nft.List("set", family.name, nftTableName, nftEgressSetName)
+	if err != nil {
+		return nil, err
+	}
+	return parseNftSetElements(out)
+}
+
+// nftListing is the part of the nft -j list output we read.
+type nftListing struct {
+	Nftables []struct {
+		Table *struct {
+			Family string `json:"family"`
+			Name   string `json:"name"`
+		} `json:"table"`
+		Set *struct {
+			Elem []json.RawMessage `json:"elem"`
+		} `json:"set"`
+	} `json:"nftables"`
+}
+
+// parseNftSetElements parses the elements of a set listed by nft -j, mapped to
+// their comment. Elements with a comment are printed as an elem object.
+func parseNftSetElements(out []byte) (map[string]string, error) {
+	var listing nftListing
+	if err := json.Unmarshal(out, &listing); err != nil {
+		return nil, fmt.Errorf("error parsing nft output: %v", err)
+	}
+
+	elems := make(map[string]string)
+	for _, obj := range listing.Nftables {
+		if obj.Set == nil {
+			continue
+		}
+		for _, raw := range obj.Set.Elem {
+			var elem struct {
+				Elem *struct {
+					Val     json.RawMessage `json:"val"`
+					Comment string          `json:"comment"`
+				} `json:"elem"`
+			}
+			comment := ""
+			if err := json.Unmarshal(raw, &elem); err == nil && elem.Elem != nil {
+				raw, comment = elem.Elem.Val, elem.Elem.Comment
+			}
+			val, err := parseNftValue(raw)
+			if err != nil {
+				return nil, err
+			}
+			elems[val] = comment
+		}
+	}
+	return elems, nil
+}
+
+// parseNftValue parses an address, printed as a string, or a network, printed
+// as a prefix object.
+func parseNftValue(raw json.RawMessage) (string, error) {
+	var addr string
+	if err := json.Unmarshal(raw, &addr); err == nil {
+		return addr, nil
+	}
+	var prefix struct {
+		Prefix *struct {
+			Addr string `json:"addr"`
+			Len  int    `json:"len"`
+		} `json:"prefix"`
+	}
+	if err := json.Unmarshal(raw, &prefix); err != nil || prefix.Prefix == nil {
+		return "", fmt.Errorf("error parsing nft set element %s", raw)
+	}
+	return fmt.Sprintf("%s/%d", prefix.Prefix.Addr, prefix.Prefix.Len), nil
+}
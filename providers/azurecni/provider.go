@@ -3,8 +3,13 @@ package azurecni
 import (
 	"context"
 	"fmt"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 
+	"github.com/Azure/go-autorest/autorest/to"
+	"go.opentelemetry.io/otel/attribute"
 	corev1 "k8s.io/api/core/v1"
 
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -12,6 +17,9 @@ import (
 	"github.com/yingeli/pod-external-ip-operator/pkg/azure/compute"
 	"github.com/yingeli/pod-external-ip-operator/pkg/azure/config"
 	"github.com/yingeli/pod-external-ip-operator/pkg/azure/imds"
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/network"
+	"github.com/yingeli/pod-external-ip-operator/pkg/tracing"
+	"github.com/yingeli/pod-external-ip-operator/providers"
 )
 
 var (
@@ -20,10 +28,33 @@ var (
 
 type Associater struct {
 	//hostName string
+	backend   string
+	egress    egressRules
+	conntrack conntrackFlusher
+
+	mu            sync.Mutex
+	localNetworks []string
+	discovered    []string
+	// holders are the IP configurations the external IPs were found
+	// allocated to by the last association attempts that failed.
+	holders map[string]string
+	// pods are the pods whose egress rules were added, by pod IP, which
+	// CheckEgressRules compares with the rules of the node.
+	pods map[string]*corev1.Pod
+	// claimed are the pod IPs the pods of the node claim, mapped to the
+	// namespaced name of their pod, as last given to AdoptEgressRules. The
+	// rules of the node are only reported unexpected once adopted.
+	claimed map[string]string
+	adopted bool
 }
 
-func NewAssociater() Associater {
-	return Associater{}
+func NewAssociater(backend string) Associater {
+	return Associater{
+		backend:   backend,
+		conntrack: execConntrack{},
+		holders:   make(map[string]string),
+		pods:      make(map[string]*corev1.Pod),
+	}
 }
 
 func (a *Associater) Initialize(ctx context.Context, localNetworks []string) error {
@@ -32,35 +63,217 @@ func (a *Associater) Initialize(ctx context.Context, localNetworks []string) err
 	}
 	//a.hostName = hostName
 
-	if err := SetupIptables(localNetworks); err != nil {
+	egress, err := newEgressRules(a.backend)
+	if err != nil {
 		return err
 	}
+	a.egress = egress
+
+	return a.SetLocalNetworks(ctx, localNetworks)
+}
+
+// SetLocalNetworks programs the given local networks along with the prefixes
+// of the node's subnets and virtual networks. The rules are only rebuilt when
+// the resulting networks changed.
+func (a *Associater) SetLocalNetworks(ctx context.Context, localNetworks []string) error {
+	discovered, err := discoverLocalNetworks(ctx)
 
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err != nil {
+		log.Error(err, "error discovering local networks, keeping the previously discovered ones", "discovered", discovered, "previous", a.discovered)
+		discovered = mergeNetworks(discovered, a.discovered)
+	}
+
+	networks := mergeNetworks(localNetworks, discovered)
+	if a.localNetworks != nil {
+		if added, removed := diffNetworks(a.localNetworks, networks); len(added) == 0 && len(removed) == 0 {
+			return nil
+		}
+	}
+	_, span := tracing.Start(ctx, "SetupEgressRules", attribute.String("backend", a.backend))
+	err = setupEgressRules(a.egress, networks)
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+	a.localNetworks = networks
+	a.discovered = discovered
 	return nil
 }
 
 func (a *Associater) Associate(ctx context.Context, pod *corev1.Pod, localIP string, publicIP string) (bool, error) {
 	if err := compute.AssociateVMPrivateIPWithPublicIP(ctx, pod.Spec.NodeName, localIP, publicIP); err != nil {
-		log.Error(err, "error asscociating vm private ip with public ip", "err.Error()", err.Error())
+		tracing.Logger(ctx, log).Error(err, "error asscociating vm private ip with public ip", "err.Error()", err.Error())
 		if isPublicIPReferencedByMultipleIPConfigsError(err) || isPublicIPAddressInUseError(err) {
+			a.setHolder(publicIP, parseHolder(err))
 			return true, nil
 		} else {
-			return false, err
+			return false, providerError(err)
 		}
 	}
-	if err := AddOrUpdatePodIPRules(pod, localIP); err != nil {
+	a.setHolder(publicIP, "")
+	if err := a.addEgress(ctx, pod, localIP); err != nil {
 		return false, err
 	}
 	return false, nil
 }
 
+// Holder returns the IP configuration the public IP is allocated to. It is
+// taken from the error of the last association attempt when there is one,
+// and looked up from the public IP otherwise.
+func (a *Associater) Holder(ctx context.Context, publicIP string) (providers.Holder, error) {
+	a.mu.Lock()
+	id := a.holders[publicIP]
+	a.mu.Unlock()
+	if id == "" {
+		pip, found, err := network.LookupPublicIP(ctx, publicIP)
+		if err != nil {
+			return providers.Holder{}, providerError(err)
+		}
+		if !found || pip.IPConfiguration == nil || pip.IPConfiguration.ID == nil {
+			return providers.Holder{}, nil
+		}
+		id = *pip.IPConfiguration.ID
+	}
+	return describeHolder(ctx, id, make(map[string]string))
+}
+
+// Holders returns the IP configurations the public IPs are allocated to by
+// address, with the private IP of the ones of the primary network interface
+// of the VM of the node. It lists the public IPs and reads the network
+// interface once, whatever the number of public IPs.
+func (a *Associater) Holders(ctx context.Context, node string) (map[string]providers.Holder, error) {
+	pips, err := network.ListAllPublicIPs(ctx)
+	if err != nil {
+		return nil, providerError(err)
+	}
+	ipconfigs, err := compute.GetVMIPConfigurations(ctx, node)
+	if err != nil {
+		return nil, providerError(err)
+	}
+	local := make(map[string]providers.Holder)
+	for _, ipconfig := range ipconfigs {
+		if ipconfig.ID == nil || ipconfig.InterfaceIPConfigurationPropertiesFormat == nil {
+			continue
+		}
+		local[strings.ToLower(*ipconfig.ID)] = providers.Holder{
+			ID:        *ipconfig.ID,
+			PrivateIP: to.String(ipconfig.PrivateIPAddress),
+			Primary:   to.Bool(ipconfig.Primary),
+		}
+	}
+
+	holders := make(map[string]providers.Holder)
+	for _, pip := range pips {
+		if pip.PublicIPAddressPropertiesFormat == nil || pip.IPAddress == nil {
+			continue
+		}
+		var holder providers.Holder
+		if pip.IPConfiguration != nil && pip.IPConfiguration.ID != nil {
+			id := *pip.IPConfiguration.ID
+			var ok bool
+			if holder, ok = local[strings.ToLower(id)]; !ok {
+				holder = providers.Holder{ID: id}
+			}
+		}
+		holders[*pip.IPAddress] = holder
+	}
+	return holders, nil
+}
+
+// Release dissociates the public IP from the IP configuration holderID, if it
+// is still allocated to it.
+func (a *Associater) Release(ctx context.Context, publicIP string, holderID string) (bool, error) {
+	// The holder may have been taken from an outdated error, look it up
+	// again next time.
+	a.setHolder(publicIP, "")
+	released, err := network.DissociatePublicIPFromIPConfiguration(ctx, publicIP, holderID)
+	if err != nil {
+		return false, providerError(err)
+	}
+	return released, nil
+}
+
+func (a *Associater) setHolder(publicIP string, holder string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if holder == "" {
+		delete(a.holders, publicIP)
+	} else {
+		a.holders[publicIP] = holder
+	}
+}
+
+// addEgress lets localIP egress from its external IP. Connections tracked
+// before were masqueraded to the node IP, so they are flushed when the rule is
+// new, unless the pod keeps them.
+func (a *Associater) addEgress(ctx context.Context, pod *corev1.Pod, localIP string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, span := tracing.Start(ctx, "AddEgressRule", attribute.String("backend", a.backend), attribute.String("localIP", localIP))
+	added, err := a.egress.AddOrUpdatePod(pod, localIP)
+	tracing.End(span, err)
+	if err != nil {
+		return err
+	}
+	a.forgetPod(pod, localIP)
+	a.pods[localIP] = newRulePod(pod)
+	if added {
+		flushConntrack(a.conntrack, pod, []string{localIP})
+	}
+	return nil
+}
+
+// forgetPod forgets the egress rules of the pod, except the one of keepIP
+// and the ones of the other IP family.
+func (a *Associater) forgetPod(pod *corev1.Pod, keepIP string) {
+	for ip, p := range a.pods {
+		if namespacedName(p) == namespacedName(pod) && ip != keepIP && (keepIP == "" || isIPv6(ip) == isIPv6(keepIP)) {
+			delete(a.pods, ip)
+		}
+	}
+}
+
 func (p *Associater) Dissociate(ctx context.Context, pod *corev1.Pod, localIP string, publicIP string) error {
-	if err := RemovePodIPRules(pod); err != nil {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, span := tracing.Start(ctx, "RemoveEgressRules", attribute.String("backend", p.backend), attribute.String("localIP", localIP))
+	removed, err := p.egress.RemovePod(pod)
+	tracing.End(span, err)
+	if err != nil {
 		return err
 	}
+	p.forgetPod(pod, "")
+	flushConntrack(p.conntrack, pod, removed)
 	return nil
 }
 
+// LocalNetworks returns the local networks the egress rules were last set up
+// with: the configured ones and the discovered prefixes of the node.
+func (a *Associater) LocalNetworks() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string(nil), a.localNetworks...)
+}
+
+// EgressState reads the egress rules programmed on the node.
+func (a *Associater) EgressState() (providers.EgressState, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	state := providers.EgressState{Backend: egressBackendName(a.egress)}
+	var err error
+	if state.LocalNetworks, err = a.egress.LocalNetworks(); err != nil {
+		return state, err
+	}
+	sort.Strings(state.LocalNetworks)
+	if state.Pods, err = a.egress.Pods(); err != nil {
+		return state, err
+	}
+	return state, nil
+}
+
 type Finalizer struct {
 }
 
@@ -76,8 +289,38 @@ func (p *Finalizer) Initialize(ctx context.Context) error {
 	return nil
 }
 
+// Finalize dissociates the public IP from the local IP on the VM of the pod.
+// When the VM no longer exists, it dissociates the public IP from whichever
+// network interface still has the local IP.
 func (p *Finalizer) Finalize(ctx context.Context, pod *corev1.Pod, localIP string, publicIP string) error {
-	return compute.DissociateVMPrivateIPWithPublicIP(ctx, pod.Spec.NodeName, localIP, publicIP)
+	err := compute.DissociateVMPrivateIPWithPublicIP(ctx, pod.Spec.NodeName, localIP, publicIP)
+	if err == nil {
+		return nil
+	}
+	if _, found, getErr := compute.GetVMPowerState(ctx, pod.Spec.NodeName); getErr != nil || found {
+		return providerError(err)
+	}
+	if err := network.DissociatePublicIPFromPrivateIP(ctx, publicIP, localIP); err != nil {
+		return providerError(err)
+	}
+	return nil
+}
+
+// MachineExists tells whether the VM of the node exists and is not
+// deallocated. The VM is looked up from the provider ID of the node, and is
+// assumed to exist when it is not a VM of the subscription, e.g. an
+// instance of a scale set, since its absence cannot be told apart from a
+// lookup of the wrong resource.
+func (p *Finalizer) MachineExists(ctx context.Context, node *corev1.Node) (bool, error) {
+	vm, err := compute.ParseVMProviderID(node.Spec.ProviderID)
+	if err != nil || !strings.EqualFold(vm.SubscriptionID, config.SubscriptionID()) {
+		return true, nil
+	}
+	state, found, err := compute.GetVMPowerStateInGroup(ctx, vm.ResourceGroup, vm.Name)
+	if err != nil {
+		return false, providerError(err)
+	}
+	return found && state != "deallocated" && state != "deallocating", nil
 }
 
 func initializeAzure() (err error) {
@@ -96,6 +339,38 @@ func initializeAzure() (err error) {
 	return nil
 }
 
+// discoverLocalNetworks returns the prefixes of the subnets the node is in,
+// from the instance metadata, and of the virtual networks they belong to.
+// When the virtual networks cannot be read, e.g. because the identity of the
+// node has no access to a custom virtual network, it returns the subnet
+// prefixes with the error.
+func discoverLocalNetworks(ctx context.Context) ([]string, error) {
+	metadata, err := imds.GetMetadata()
+	if err != nil {
+		return nil, fmt.Errorf("imds.GetMetadata error: %v", err)
+	}
+	networks := metadata.SubnetPrefixes()
+
+	prefixes, err := compute.GetVMVirtualNetworkPrefixes(ctx, metadata.Compute.Name)
+	if err != nil {
+		return networks, fmt.Errorf("GetVMVirtualNetworkPrefixes error: %v", err)
+	}
+	return mergeNetworks(networks, prefixes), nil
+}
+
+var armErrorCodeRegexp = regexp.MustCompile(`Code="(\w+)"`)
+
+// providerError wraps err with the ARM error code found in its message. The
+// pkg/azure functions format the errors of the SDK into their own, so the code
+// is only left in the message.
+func providerError(err error) error {
+	code := ""
+	if m := armErrorCodeRegexp.FindStringSubmatch(err.Error()); m != nil {
+		code = m[1]
+	}
+	return &providers.Error{Code: code, Err: err}
+}
+
 func isPublicIPAddressInUseError(err error) bool {
 	/*
 		Sample PublicIPAddressInUse error
@@ -108,6 +383,17 @@ func isPublicIPAddressInUseError(err error) bool {
 	return strings.Contains(err.Error(), "PublicIPAddressInUse")
 }
 
+var holderRegexp = regexp.MustCompile(`already allocated to resource (/\S+/ipConfigurations/[^\s."\\]+)`)
+
+// parseHolder returns the IP configuration a PublicIPAddressInUse error says
+// the public IP is allocated to, or an empty string.
+func parseHolder(err error) string {
+	if m := holderRegexp.FindStringSubmatch(err.Error()); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
 func isPublicIPReferencedByMultipleIPConfigsError(err error) bool {
 	return strings.Contains(err.Error(), "PublicIPReferencedByMultipleIPConfigs")
 }
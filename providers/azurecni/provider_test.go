@@ -0,0 +1,172 @@
+package azurecni
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/armsim"
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/config"
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+func TestParseHolder(t *testing.T) {
+	const holder = "/subscriptions/xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx/resourceGroups/MC_rg/providers/Microsoft.Network/networkInterfaces/aks-agentpool-93984122-nic-0/ipConfigurations/ipconfig5"
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{
+			name: "in use",
+			err: errors.New(`failed to update nic: network.InterfacesClient#CreateOrUpdate: Failure sending request: StatusCode=0 -- Original Error: Code="PublicIPAddressInUse" ` +
+				`Message="Resource /subscriptions/xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx/resourceGroups/MC_rg/providers/Microsoft.Network/networkInterfaces/aks-agentpool-93984122-nic-2/ipConfigurations/ipconfig73 ` +
+				`is referencing public IP address /subscriptions/xxxxxxxx-xxxx-xxxx-xxxx-xxxxxxxxxxxx/resourceGroups/MC_rg/providers/Microsoft.Network/publicIPAddresses/pip-externelip-003 ` +
+				`that is already allocated to resource ` + holder + `."`),
+			want: holder,
+		},
+		{
+			name: "other error",
+			err:  errors.New(`Code="PublicIPReferencedByMultipleIPConfigs" Message="Public IP address is referenced by multiple ipconfigs"`),
+			want: "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseHolder(tt.err); got != tt.want {
+				t.Errorf("parseHolder() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAssociateErrors(t *testing.T) {
+	ctx := context.Background()
+	s := armsim.New("00000000-0000-0000-0000-000000000000", "rg")
+	config.SetGroup("AzurePublicCloud", "00000000-0000-0000-0000-000000000000", "rg")
+	config.SetResourceManager(s.URL, s.Authorizer())
+	defer func() {
+		config.SetResourceManager("", nil)
+		s.Close()
+	}()
+	s.AddPublicIP("pip-1", "20.0.0.1")
+	s.AddNIC("node-0-nic", "10.0.0.4")
+	s.AddVM("node-0", "node-0-nic")
+	holderID := s.AddNIC("node-1-nic", "10.0.1.4", "10.0.1.5") + "/ipConfigurations/ipconfig2"
+	vmID := s.AddVM("node-1", "node-1-nic")
+	s.AssociatePublicIP("node-1-nic", "10.0.1.5", "pip-1")
+
+	a := NewAssociater("")
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec:       corev1.PodSpec{NodeName: "node-0"},
+	}
+
+	s.FailNext(http.MethodGet, "virtualMachines", armsim.Error{
+		Status: http.StatusForbidden, Code: "AuthorizationFailed", Message: "The client does not have authorization to perform action."})
+	if _, err := a.Associate(ctx, pod, "10.0.0.4", "20.0.0.1"); providers.ErrorCode(err) != "AuthorizationFailed" {
+		t.Errorf("Associate() = %v, want the code AuthorizationFailed", err)
+	}
+
+	retry, err := a.Associate(ctx, pod, "10.0.0.4", "20.0.0.1")
+	if err != nil || !retry {
+		t.Fatalf("Associate() = %v, %v, want true, nil", retry, err)
+	}
+	holder, err := a.Holder(ctx, "20.0.0.1")
+	want := providers.Holder{ID: holderID, PrivateIP: "10.0.1.5", ProviderID: "azure://" + vmID}
+	if err != nil || holder != want {
+		t.Errorf("Holder() = %+v, %v, want %+v", holder, err, want)
+	}
+	released, err := a.Release(ctx, "20.0.0.1", holderID)
+	if err != nil || !released {
+		t.Errorf("Release() = %v, %v, want true, nil", released, err)
+	}
+	if got := s.AllocatedTo("pip-1"); got != "" {
+		t.Errorf("public IP allocated to %q, want none", got)
+	}
+}
+
+func TestHolders(t *testing.T) {
+	ctx := context.Background()
+	s := armsim.New("00000000-0000-0000-0000-000000000000", "rg")
+	config.SetGroup("AzurePublicCloud", "00000000-0000-0000-0000-000000000000", "rg")
+	config.SetResourceManager(s.URL, s.Authorizer())
+	defer func() {
+		config.SetResourceManager("", nil)
+		s.Close()
+	}()
+	s.PageSize = 2
+	s.AddPublicIP("pip-1", "20.0.0.1")
+	s.AddPublicIP("pip-2", "20.0.0.2")
+	s.AddPublicIP("pip-3", "20.0.0.3")
+	nodeNIC := s.AddNIC("node-0-nic", "10.0.0.4", "10.0.0.5")
+	s.AddVM("node-0", "node-0-nic")
+	otherNIC := s.AddNIC("node-1-nic", "10.0.1.4", "10.0.1.5")
+	s.AddVM("node-1", "node-1-nic")
+	s.AssociatePublicIP("node-0-nic", "10.0.0.5", "pip-1")
+	s.AssociatePublicIP("node-1-nic", "10.0.1.5", "pip-2")
+
+	a := NewAssociater("")
+	holders, err := a.Holders(ctx, "node-0")
+	if err != nil {
+		t.Fatalf("Holders() = %v", err)
+	}
+	want := map[string]providers.Holder{
+		"20.0.0.1": {ID: nodeNIC + "/ipConfigurations/ipconfig2", PrivateIP: "10.0.0.5"},
+		"20.0.0.2": {ID: otherNIC + "/ipConfigurations/ipconfig2"},
+		"20.0.0.3": {},
+	}
+	if !reflect.DeepEqual(holders, want) {
+		t.Errorf("Holders() = %+v, want %+v", holders, want)
+	}
+	if got := len(s.Requests(http.MethodGet, "networkInterfaces")); got != 1 {
+		t.Errorf("Holders() read %d network interfaces, want 1", got)
+	}
+}
+
+func TestMachineExists(t *testing.T) {
+	ctx := context.Background()
+	s := armsim.New("00000000-0000-0000-0000-000000000000", "rg")
+	config.SetGroup("AzurePublicCloud", "00000000-0000-0000-0000-000000000000", "rg")
+	config.SetResourceManager(s.URL, s.Authorizer())
+	defer func() {
+		config.SetResourceManager("", nil)
+		s.Close()
+	}()
+	s.AddNIC("node-0-nic", "10.0.0.4")
+	vmID := s.AddVM("node-0", "node-0-nic")
+	s.AddNIC("node-1-nic", "10.0.0.5")
+	s.AddVM("node-1", "node-1-nic")
+	s.SetPowerState("node-1", "deallocated")
+
+	const vmPrefix = "azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/"
+	tests := []struct {
+		name       string
+		providerID string
+		want       bool
+	}{
+		{name: "running", providerID: "azure://" + vmID, want: true},
+		{name: "deallocated", providerID: vmPrefix + "node-1", want: false},
+		{name: "deleted", providerID: vmPrefix + "node-2", want: false},
+		{name: "scale set instance", providerID: "azure:///subscriptions/00000000-0000-0000-0000-000000000000/resourceGroups/rg/providers/Microsoft.Compute/virtualMachineScaleSets/vmss/virtualMachines/0", want: true},
+		{name: "other subscription", providerID: "azure:///subscriptions/11111111-1111-1111-1111-111111111111/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/node-2", want: true},
+		{name: "no provider ID", providerID: "", want: true},
+	}
+	f := NewFinalizer()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node-2"},
+				Spec:       corev1.NodeSpec{ProviderID: tt.providerID},
+			}
+			if got, err := f.MachineExists(ctx, node); err != nil || got != tt.want {
+				t.Errorf("MachineExists(%q) = %v, %v, want %v, nil", tt.providerID, got, err, tt.want)
+			}
+		})
+	}
+}
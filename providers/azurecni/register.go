@@ -0,0 +1,110 @@
+package azurecni
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/yingeli/pod-external-ip-operator/pkg/azure/config"
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+// Name is the name the provider is registered with.
+const Name = "azurecni"
+
+const (
+	// CredentialsSourceEnvironment reads the AZURE_CLIENT_ID,
+	// AZURE_CLIENT_SECRET and AZURE_TENANT_ID env vars.
+	CredentialsSourceEnvironment = "Environment"
+	// CredentialsSourceFile reads the credentials file. The env vars that are
+	// set override its values.
+	CredentialsSourceFile = "File"
+)
+
+// Config is the typed config of the provider.
+type Config struct {
+	// EgressBackend is how the daemon programs the egress rules of its node:
+	// iptables, nftables or auto to detect it from the node.
+	EgressBackend string `json:"egressBackend,omitempty"`
+
+	Credentials Credentials `json:"credentials,omitempty"`
+}
+
+// Credentials is where the provider reads its service principal from.
+type Credentials struct {
+	// Source is Environment or File.
+	Source string `json:"source,omitempty"`
+
+	// File is the path of a JSON file with the aadClientId, aadClientSecret
+	// and tenantId keys, like the azure.json file of the AKS nodes.
+	File string `json:"file,omitempty"`
+}
+
+func init() {
+	providers.Register(Name, providers.Factory{
+		NewConfig: func() interface{} {
+			return &Config{
+				EgressBackend: EgressBackendAuto,
+				Credentials:   Credentials{Source: CredentialsSourceEnvironment},
+			}
+		},
+		New: func(c interface{}) (providers.Provider, error) {
+			return NewProvider(*c.(*Config))
+		},
+	})
+}
+
+// Provider creates the Azure CNI associaters, finalizers and inventories.
+type Provider struct {
+	config Config
+}
+
+// NewProvider validates the config and creates the provider.
+func NewProvider(c Config) (*Provider, error) {
+	switch c.EgressBackend {
+	case EgressBackendAuto, EgressBackendIptables, EgressBackendNftables:
+	default:
+		return nil, fmt.Errorf("egressBackend %q must be %s, %s or %s", c.EgressBackend, EgressBackendAuto, EgressBackendIptables, EgressBackendNftables)
+	}
+	switch c.Credentials.Source {
+	case CredentialsSourceEnvironment:
+	case CredentialsSourceFile:
+		if !path.IsAbs(c.Credentials.File) {
+			return nil, fmt.Errorf("credentials.file %q must be an absolute path", c.Credentials.File)
+		}
+		config.SetCredentialsFile(c.Credentials.File)
+	default:
+		return nil, fmt.Errorf("credentials.source %q must be %s or %s", c.Credentials.Source, CredentialsSourceEnvironment, CredentialsSourceFile)
+	}
+	return &Provider{config: c}, nil
+}
+
+func (p *Provider) NewAssociater() providers.Associater {
+	associater := NewAssociater(p.config.EgressBackend)
+	return &associater
+}
+
+func (p *Provider) NewFinalizer() providers.Finalizer {
+	finalizer := NewFinalizer()
+	return &finalizer
+}
+
+func (p *Provider) NewInventory() providers.Inventory {
+	inventory := NewInventory()
+	return &inventory
+}
+
+// Checks implements providers.Checker, the daemon is only ready while the
+// Azure Resource Manager token can be acquired and ARM is reachable.
+func (p *Provider) Checks() map[string]func(ctx context.Context) error {
+	return map[string]func(ctx context.Context) error{
+		"azure-token": CheckToken,
+		"arm":         CheckARM,
+	}
+}
+
+// CleanupEgressRules implements providers.EgressCleaner, see
+// CleanupEgressRules.
+func (p *Provider) CleanupEgressRules(dryRun bool) ([]providers.EgressCleanup, error) {
+	return CleanupEgressRules(dryRun)
+}
@@ -0,0 +1,64 @@
+package providers
+
+import "context"
+
+// EgressRules is implemented by the associaters that program the egress rules
+// of the node, so the daemon serves, checks and repairs them.
+type EgressRules interface {
+	// LocalNetworks returns the local networks the egress rules were last set
+	// up with.
+	LocalNetworks() []string
+	// EgressState reads the egress rules programmed on the node.
+	EgressState() (EgressState, error)
+	// CheckEgressBackend checks that the egress rules can be read, without
+	// changing them.
+	CheckEgressBackend(ctx context.Context) error
+	// CheckEgressRules checks that the egress rules are the desired ones.
+	CheckEgressRules(ctx context.Context) error
+	// AdoptEgressRules adopts the rules of the node of the pod IPs the pods
+	// of the node still claim, mapped to the namespaced name of their pod,
+	// e.g. after a restart. The rules of the claimed pod IPs are kept, and
+	// the other ones only removed once the rules were adopted.
+	AdoptEgressRules(claimed map[string]string) error
+	// RepairEgressRules repairs the egress rules that drifted from the
+	// desired ones, and returns the drifts it repaired.
+	RepairEgressRules(ctx context.Context) ([]EgressDrift, error)
+}
+
+// EgressCleaner is implemented by the providers that program egress rules, to
+// remove them from the node the operator is uninstalled from.
+type EgressCleaner interface {
+	// CleanupEgressRules removes the egress rules of the node, or only
+	// reports them when dryRun is set.
+	CleanupEgressRules(dryRun bool) ([]EgressCleanup, error)
+}
+
+// EgressState is the egress configuration programmed on the node.
+type EgressState struct {
+	Node          string   `json:"node,omitempty"`
+	Backend       string   `json:"backend"`
+	LocalNetworks []string `json:"localNetworks"`
+	// Pods are the pod IPs that egress from their external IP, mapped to the
+	// namespaced name of their pod.
+	Pods map[string]string `json:"pods"`
+}
+
+// EgressDrift is a difference between the egress rules of the node and the
+// desired ones.
+type EgressDrift struct {
+	// Kind is the kind of drift, named by the provider.
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+	// IP and Pod are the pod IP and the namespaced name of the pod of the
+	// pod rule drifts.
+	IP  string `json:"ip,omitempty"`
+	Pod string `json:"pod,omitempty"`
+}
+
+// EgressCleanup reports the egress rules of a backend found on the node.
+type EgressCleanup struct {
+	Backend string
+	// Pods are the pod IPs that were programmed, mapped to the namespaced
+	// name of their pod.
+	Pods map[string]string
+}
@@ -0,0 +1,27 @@
+package providers
+
+import "errors"
+
+// Error is an error of the cloud provider, with the provider's error code when
+// there is one.
+type Error struct {
+	Code string
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// ErrorCode returns the provider error code of err, or an empty string.
+func ErrorCode(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return ""
+}
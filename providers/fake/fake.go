@@ -0,0 +1,356 @@
+// Package fake is an in-memory provider for tests. It records the calls it
+// receives, keeps the external IPs associated with the pod IPs, and returns the
+// errors the tests inject.
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+// Name is the name the provider is registered with.
+const Name = "fake"
+
+// The provider error codes of the injected errors, the ones of Azure Resource
+// Manager.
+const (
+	CodeNotFound  = "NotFound"
+	CodeThrottled = "TooManyRequests"
+)
+
+// The methods of the provider, to inject errors and filter the calls.
+const (
+	MethodInitialize       = "Initialize"
+	MethodSetLocalNetworks = "SetLocalNetworks"
+	MethodAssociate        = "Associate"
+	MethodDissociate       = "Dissociate"
+	MethodHolder           = "Holder"
+	MethodHolders          = "Holders"
+	MethodRelease          = "Release"
+	MethodFinalize         = "Finalize"
+	MethodMachineExists    = "MachineExists"
+	MethodExternalIPs      = "ExternalIPs"
+)
+
+// Config is the typed config of the provider.
+type Config struct {
+	// InUse are the external IPs that are initially associated with other
+	// resources, mapped to the private IP of the resource.
+	InUse map[string]string `json:"inUse,omitempty"`
+}
+
+func init() {
+	providers.Register(Name, providers.Factory{
+		NewConfig: func() interface{} {
+			return &Config{}
+		},
+		New: func(c interface{}) (providers.Provider, error) {
+			p := New()
+			for externalIP, privateIP := range c.(*Config).InUse {
+				p.SetInUse(externalIP, privateIP)
+			}
+			return p, nil
+		},
+	})
+}
+
+// Call is a call received by the provider.
+type Call struct {
+	Method string
+	// Pod is the namespaced name of the pod, if any.
+	Pod        string
+	LocalIP    string
+	ExternalIP string
+}
+
+func (c Call) String() string {
+	return fmt.Sprintf("%s(%s, %s, %s)", c.Method, c.Pod, c.LocalIP, c.ExternalIP)
+}
+
+// Provider is the fake provider. Its associaters, finalizers and inventories
+// share its state, like the ones of a cloud provider share the cloud.
+type Provider struct {
+	mu            sync.Mutex
+	calls         []Call
+	holders       map[string]providers.Holder
+	errors        map[string][]error
+	missing       map[string]bool
+	localNetworks []string
+}
+
+// New returns a provider with no associated external IP.
+func New() *Provider {
+	return &Provider{
+		holders: make(map[string]providers.Holder),
+		errors:  make(map[string][]error),
+		missing: make(map[string]bool),
+	}
+}
+
+func (p *Provider) NewAssociater() providers.Associater {
+	return &Associater{p}
+}
+
+func (p *Provider) NewFinalizer() providers.Finalizer {
+	return &Finalizer{p}
+}
+
+func (p *Provider) NewInventory() providers.Inventory {
+	return &Inventory{p}
+}
+
+// InjectError makes the next call of method return err. Several errors are
+// returned by the next calls, in order.
+func (p *Provider) InjectError(method string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.errors[method] = append(p.errors[method], err)
+}
+
+// InjectNotFound makes the next call of method return a not found error.
+func (p *Provider) InjectNotFound(method string) {
+	p.InjectError(method, &providers.Error{Code: CodeNotFound, Err: fmt.Errorf("fake: the resource was not found")})
+}
+
+// InjectThrottled makes the next call of method return a throttling error.
+func (p *Provider) InjectThrottled(method string) {
+	p.InjectError(method, &providers.Error{Code: CodeThrottled, Err: fmt.Errorf("fake: too many requests")})
+}
+
+// SetInUse associates the external IP with a resource that is not a pod IP,
+// so the associations of the pods report it in use until it is released.
+func (p *Provider) SetInUse(externalIP string, privateIP string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.holders[externalIP] = providers.Holder{ID: holderID(privateIP), PrivateIP: privateIP}
+}
+
+// SetMachineExists sets whether the machine of the node exists. Machines
+// exist unless set otherwise.
+func (p *Provider) SetMachineExists(nodeName string, exists bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.missing[nodeName] = !exists
+}
+
+// Calls returns the calls received so far, or only the ones of the given
+// methods.
+func (p *Provider) Calls(methods ...string) []Call {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var calls []Call
+	for _, call := range p.calls {
+		if len(methods) == 0 || contains(methods, call.Method) {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// ResetCalls forgets the calls received so far.
+func (p *Provider) ResetCalls() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls = nil
+}
+
+// Associations returns the private IPs the external IPs are associated with.
+func (p *Provider) Associations() map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	associations := make(map[string]string)
+	for externalIP, holder := range p.holders {
+		associations[externalIP] = holder.PrivateIP
+	}
+	return associations
+}
+
+// LocalNetworks returns the local networks last set.
+func (p *Provider) LocalNetworks() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string{}, p.localNetworks...)
+}
+
+// call records a call and returns the next error injected for its method.
+func (p *Provider) call(method string, pod *corev1.Pod, localIP string, externalIP string) error {
+	call := Call{Method: method, LocalIP: localIP, ExternalIP: externalIP}
+	if pod != nil {
+		call.Pod = pod.Namespace + "/" + pod.Name
+	}
+	p.calls = append(p.calls, call)
+	if errs := p.errors[method]; len(errs) > 0 {
+		p.errors[method] = errs[1:]
+		return errs[0]
+	}
+	return nil
+}
+
+// detach detaches the external IP when it is associated with the local IP.
+func (p *Provider) detach(localIP string, externalIP string) {
+	if holder, ok := p.holders[externalIP]; ok && holder.PrivateIP == localIP {
+		delete(p.holders, externalIP)
+	}
+}
+
+// Associater is the associater of the fake provider.
+type Associater struct {
+	p *Provider
+}
+
+func (a *Associater) Initialize(ctx context.Context, localNetworks []string) error {
+	a.p.mu.Lock()
+	defer a.p.mu.Unlock()
+	if err := a.p.call(MethodInitialize, nil, "", ""); err != nil {
+		return err
+	}
+	a.p.localNetworks = append([]string{}, localNetworks...)
+	return nil
+}
+
+func (a *Associater) SetLocalNetworks(ctx context.Context, localNetworks []string) error {
+	a.p.mu.Lock()
+	defer a.p.mu.Unlock()
+	if err := a.p.call(MethodSetLocalNetworks, nil, "", ""); err != nil {
+		return err
+	}
+	a.p.localNetworks = append([]string{}, localNetworks...)
+	return nil
+}
+
+// Associate associates the external IP with the local IP, or returns true
+// when it is associated with another IP.
+func (a *Associater) Associate(ctx context.Context, pod *corev1.Pod, localIP string, externalIP string) (bool, error) {
+	a.p.mu.Lock()
+	defer a.p.mu.Unlock()
+	if err := a.p.call(MethodAssociate, pod, localIP, externalIP); err != nil {
+		return false, err
+	}
+	if holder, ok := a.p.holders[externalIP]; ok && holder.PrivateIP != localIP {
+		return true, nil
+	}
+	a.p.holders[externalIP] = providers.Holder{ID: holderID(localIP), PrivateIP: localIP}
+	return false, nil
+}
+
+func (a *Associater) Dissociate(ctx context.Context, pod *corev1.Pod, localIP string, externalIP string) error {
+	a.p.mu.Lock()
+	defer a.p.mu.Unlock()
+	if err := a.p.call(MethodDissociate, pod, localIP, externalIP); err != nil {
+		return err
+	}
+	a.p.detach(localIP, externalIP)
+	return nil
+}
+
+func (a *Associater) Holder(ctx context.Context, externalIP string) (providers.Holder, error) {
+	a.p.mu.Lock()
+	defer a.p.mu.Unlock()
+	if err := a.p.call(MethodHolder, nil, "", externalIP); err != nil {
+		return providers.Holder{}, err
+	}
+	return a.p.holders[externalIP], nil
+}
+
+// Holders returns the holders of the external IPs. The fake machines share
+// their private IPs, so all the holders have it set, whatever the node.
+func (a *Associater) Holders(ctx context.Context, node string) (map[string]providers.Holder, error) {
+	a.p.mu.Lock()
+	defer a.p.mu.Unlock()
+	if err := a.p.call(MethodHolders, nil, "", ""); err != nil {
+		return nil, err
+	}
+	holders := make(map[string]providers.Holder, len(a.p.holders))
+	for externalIP, holder := range a.p.holders {
+		holders[externalIP] = holder
+	}
+	return holders, nil
+}
+
+func (a *Associater) Release(ctx context.Context, externalIP string, holderID string) (bool, error) {
+	a.p.mu.Lock()
+	defer a.p.mu.Unlock()
+	if err := a.p.call(MethodRelease, nil, "", externalIP); err != nil {
+		return false, err
+	}
+	if holder, ok := a.p.holders[externalIP]; !ok || holder.ID != holderID {
+		return false, nil
+	}
+	delete(a.p.holders, externalIP)
+	return true, nil
+}
+
+// Finalizer is the finalizer of the fake provider.
+type Finalizer struct {
+	p *Provider
+}
+
+func (f *Finalizer) Initialize(ctx context.Context) error {
+	f.p.mu.Lock()
+	defer f.p.mu.Unlock()
+	return f.p.call(MethodInitialize, nil, "", "")
+}
+
+func (f *Finalizer) Finalize(ctx context.Context, pod *corev1.Pod, localIP string, externalIP string) error {
+	f.p.mu.Lock()
+	defer f.p.mu.Unlock()
+	if err := f.p.call(MethodFinalize, pod, localIP, externalIP); err != nil {
+		return err
+	}
+	f.p.detach(localIP, externalIP)
+	return nil
+}
+
+func (f *Finalizer) MachineExists(ctx context.Context, node *corev1.Node) (bool, error) {
+	f.p.mu.Lock()
+	defer f.p.mu.Unlock()
+	if err := f.p.call(MethodMachineExists, nil, "", ""); err != nil {
+		return false, err
+	}
+	return !f.p.missing[node.Name], nil
+}
+
+// Inventory is the inventory of the fake provider.
+type Inventory struct {
+	p *Provider
+}
+
+func (i *Inventory) Initialize(ctx context.Context) error {
+	i.p.mu.Lock()
+	defer i.p.mu.Unlock()
+	return i.p.call(MethodInitialize, nil, "", "")
+}
+
+// ExternalIPs returns the associated external IPs, sorted.
+func (i *Inventory) ExternalIPs(ctx context.Context) ([]providers.ExternalIP, error) {
+	i.p.mu.Lock()
+	defer i.p.mu.Unlock()
+	if err := i.p.call(MethodExternalIPs, nil, "", ""); err != nil {
+		return nil, err
+	}
+	var externalIPs []providers.ExternalIP
+	for address, holder := range i.p.holders {
+		externalIPs = append(externalIPs, providers.ExternalIP{Name: address, Address: address, Holder: holder})
+	}
+	sort.Slice(externalIPs, func(a, b int) bool { return externalIPs[a].Address < externalIPs[b].Address })
+	return externalIPs, nil
+}
+
+func holderID(privateIP string) string {
+	return "fake/ipconfigs/" + privateIP
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,69 @@
+package fake
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/yingeli/pod-external-ip-operator/providers"
+)
+
+func TestAssociateInUse(t *testing.T) {
+	ctx := context.Background()
+	p := New()
+	a := p.NewAssociater()
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}}
+	p.SetInUse("20.0.0.1", "10.0.0.5")
+
+	if retry, err := a.Associate(ctx, pod, "10.0.0.4", "20.0.0.1"); err != nil || !retry {
+		t.Fatalf("Associate() = %v, %v, want true, nil", retry, err)
+	}
+	holder, err := a.Holder(ctx, "20.0.0.1")
+	if err != nil || holder.PrivateIP != "10.0.0.5" {
+		t.Fatalf("Holder() = %+v, %v, want the private IP 10.0.0.5", holder, err)
+	}
+	if released, err := a.Release(ctx, "20.0.0.1", holder.ID); err != nil || !released {
+		t.Fatalf("Release() = %v, %v, want true, nil", released, err)
+	}
+	if retry, err := a.Associate(ctx, pod, "10.0.0.4", "20.0.0.1"); err != nil || retry {
+		t.Fatalf("Associate() = %v, %v, want false, nil", retry, err)
+	}
+	if got := p.Associations()["20.0.0.1"]; got != "10.0.0.4" {
+		t.Errorf("external IP associated with %q, want 10.0.0.4", got)
+	}
+	want := []Call{
+		{Method: MethodAssociate, Pod: "default/web", LocalIP: "10.0.0.4", ExternalIP: "20.0.0.1"},
+		{Method: MethodAssociate, Pod: "default/web", LocalIP: "10.0.0.4", ExternalIP: "20.0.0.1"},
+	}
+	if got := p.Calls(MethodAssociate); len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("Calls() = %v, want %v", got, want)
+	}
+}
+
+func TestInjectedErrors(t *testing.T) {
+	ctx := context.Background()
+	p := New()
+	f := p.NewFinalizer()
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"}}
+	p.InjectThrottled(MethodFinalize)
+	p.InjectNotFound(MethodFinalize)
+
+	for _, code := range []string{CodeThrottled, CodeNotFound, ""} {
+		err := f.Finalize(ctx, pod, "10.0.0.4", "20.0.0.1")
+		if got := providers.ErrorCode(err); got != code || (code == "") != (err == nil) {
+			t.Errorf("Finalize() = %v, want the code %q", err, code)
+		}
+	}
+}
+
+func TestRegistered(t *testing.T) {
+	provider, err := providers.New(Name, []byte(`{"inUse":{"20.0.0.1":"10.0.0.5"}}`))
+	if err != nil {
+		t.Fatalf("providers.New() error = %v", err)
+	}
+	if got := provider.(*Provider).Associations(); got["20.0.0.1"] != "10.0.0.5" {
+		t.Errorf("Associations() = %v, want 20.0.0.1 in use by 10.0.0.5", got)
+	}
+}
@@ -8,11 +8,55 @@ import (
 
 type Associater interface {
 	Initialize(ctx context.Context, localNetworks []string) error
+	// SetLocalNetworks updates the destinations that are not SNATed to the
+	// external IP, in addition to the ones the provider discovers itself.
+	SetLocalNetworks(ctx context.Context, localNetworks []string) error
 	Associate(ctx context.Context, pod *corev1.Pod, localIP string, externalIP string) (bool, error)
 	Dissociate(ctx context.Context, pod *corev1.Pod, localIP string, externalIP string) error
+	// Holder returns the resource the external IP is currently associated
+	// with, or an empty Holder if it is not associated.
+	Holder(ctx context.Context, externalIP string) (Holder, error)
+	// Holders returns the holders of the external IPs of the provider by
+	// address, reading them at once for the pods of a node. The private IP of
+	// a holder is only set when it is on the machine of the node.
+	Holders(ctx context.Context, node string) (map[string]Holder, error)
+	// Release detaches the external IP from the holder with the given ID. It
+	// returns false when the IP is no longer associated with that holder.
+	Release(ctx context.Context, externalIP string, holderID string) (bool, error)
+}
+
+// Holder is the resource an external IP is associated with.
+type Holder struct {
+	// ID identifies the resource, e.g. the IP configuration of a network
+	// interface.
+	ID string
+	// PrivateIP is the private IP the external IP is associated with.
+	PrivateIP string
+	// Primary tells whether PrivateIP is the primary IP of its machine,
+	// rather than a pod IP.
+	Primary bool
+	// ProviderID is the provider ID of the node of the machine, when known.
+	ProviderID string
 }
 
 type Finalizer interface {
 	Initialize(ctx context.Context) error
 	Finalize(ctx context.Context, pod *corev1.Pod, localIP string, externalIP string) error
+	// MachineExists tells whether the machine of the node exists and is
+	// allocated, so it can run the daemon that dissociates its pods.
+	MachineExists(ctx context.Context, node *corev1.Node) (bool, error)
+}
+
+// Inventory lists the external IPs of the cloud provider, for audits.
+type Inventory interface {
+	Initialize(ctx context.Context) error
+	ExternalIPs(ctx context.Context) ([]ExternalIP, error)
+}
+
+// ExternalIP is an external IP of the cloud provider.
+type ExternalIP struct {
+	Name    string
+	Address string
+	// Holder is empty when the external IP is not associated.
+	Holder Holder
 }
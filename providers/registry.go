@@ -0,0 +1,88 @@
+package providers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Provider creates the associaters, finalizers and inventories of a cloud
+// provider.
+type Provider interface {
+	NewAssociater() Associater
+	NewFinalizer() Finalizer
+	NewInventory() Inventory
+}
+
+// Checker is implemented by the providers that check their cloud in the
+// readiness probes, by name of the check.
+type Checker interface {
+	Checks() map[string]func(ctx context.Context) error
+}
+
+// Factory creates a provider from its typed config.
+type Factory struct {
+	// NewConfig returns the typed config of the provider, with its default
+	// values, into which the provider config of the operator is decoded.
+	NewConfig func() interface{}
+	// New validates the config returned by NewConfig and creates the
+	// provider.
+	New func(config interface{}) (Provider, error)
+}
+
+var registry = struct {
+	mu        sync.Mutex
+	factories map[string]Factory
+}{factories: make(map[string]Factory)}
+
+// Register makes a provider available by name. It panics when the name is
+// already registered, it is meant to be called by the init function of the
+// provider package.
+func Register(name string, factory Factory) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if _, ok := registry.factories[name]; ok {
+		panic(fmt.Sprintf("provider %s is already registered", name))
+	}
+	registry.factories[name] = factory
+}
+
+// Registered returns the names of the registered providers, sorted.
+func Registered() []string {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	names := make([]string, 0, len(registry.factories))
+	for name := range registry.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New creates the provider registered with name from its config in JSON,
+// which may be empty to use the defaults.
+func New(name string, config []byte) (Provider, error) {
+	registry.mu.Lock()
+	factory, ok := registry.factories[name]
+	registry.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q, the registered providers are %v", name, Registered())
+	}
+
+	typed := factory.NewConfig()
+	if len(config) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(config))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(typed); err != nil {
+			return nil, fmt.Errorf("invalid config of provider %s: %v", name, err)
+		}
+	}
+	provider, err := factory.New(typed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config of provider %s: %v", name, err)
+	}
+	return provider, nil
+}